@@ -1,114 +1,172 @@
 package main
 
 import (
-	"crypto/sha256"
-	"fmt"
-	"io"
+	"crypto/subtle"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
-
-	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/cache"
+	"github.com/pderyuga/httpfromtcp/internal/certs"
+	"github.com/pderyuga/httpfromtcp/internal/compress"
+	"github.com/pderyuga/httpfromtcp/internal/fileserver"
+	"github.com/pderyuga/httpfromtcp/internal/metrics"
+	"github.com/pderyuga/httpfromtcp/internal/proxy"
 	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/requestid"
 	"github.com/pderyuga/httpfromtcp/internal/response"
 	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/pderyuga/httpfromtcp/internal/servertiming"
+	"github.com/pderyuga/httpfromtcp/internal/sse"
+	"github.com/pderyuga/httpfromtcp/internal/statsd"
+	"github.com/pderyuga/httpfromtcp/internal/tracing"
 )
 
 const port = 42069
 
-func main() {
-	server, err := server.Serve(port, handler)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+// Directory listings of the assets are only served when ASSETS_LISTING is
+// set.
+var assets = fileserver.Handler(os.DirFS("assets"), fileserver.Options{
+	Listing:       os.Getenv("ASSETS_LISTING") != "",
+	Precompressed: true,
+})
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
-}
+var httpbin = cache.Handler(proxy.Handler(&url.URL{Scheme: "https", Host: "httpbin.org"}, proxy.Options{
+	Timeout: 30 * time.Second,
+	Retry:   proxy.RetryOptions{Attempts: 3, TryTimeout: 10 * time.Second},
+	Breaker: proxy.BreakerOptions{Failures: 5},
+}), cache.Options{})
 
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/video") {
+var registry = metrics.NewRegistry()
 
-		videoBytes, err := os.ReadFile("assets/vim.mp4")
-		if err != nil {
-			log.Fatal(err)
+// routes are the paths handler serves, which label metrics and spans.
+var routes = metrics.Routes("/", "/video", "/assets", "/metrics", "/events", "/httpbin", "/yourproblem", "/myproblem")
+
+var serveMetrics = registry.Handler()
+
+// forwardProxy serves absolute-form and CONNECT requests when
+// FORWARD_PROXY_HOSTS lists the destinations it may reach.
+var forwardProxy server.Handler
+
+func main() {
+	if hosts := os.Getenv("FORWARD_PROXY_HOSTS"); hosts != "" {
+		forwardOpts := proxy.ForwardOptions{AllowedHosts: strings.Split(hosts, ",")}
+		if user, password := os.Getenv("FORWARD_PROXY_USER"), os.Getenv("FORWARD_PROXY_PASSWORD"); user != "" {
+			forwardOpts.Authenticate = func(u, p string) bool {
+				// Both are compared in full so the time taken leaks neither.
+				userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+				passwordOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+				return userOK && passwordOK
+			}
 		}
-		w.WriteStatusLine(response.StatusOK)
+		forwardProxy = proxy.ForwardHandler(forwardOpts)
+	}
 
-		h := response.GetDefaultHeaders(len(videoBytes))
-		h.Override("Content-Type", "video/mp4")
-		w.WriteHeaders(h)
+	// Inside compress, so a compressed response's chunked framing is seen
+	// and its timings go in the trailer.
+	h := servertiming.Handler(handler, servertiming.Options{Trailer: true})
+	h = compress.Handler(h, compress.Options{})
+	h = compress.DecodeRequests(h, compress.DecodeOptions{})
 
-		_, err = w.WriteBody(videoBytes)
+	// New traces are sampled at TRACE_SAMPLE_RATE, none of them by default.
+	traceOpts := tracing.Options{Route: routes}
+	if rate := os.Getenv("TRACE_SAMPLE_RATE"); rate != "" {
+		sampleRate, err := strconv.ParseFloat(rate, 64)
 		if err != nil {
-			fmt.Printf("Error sending video: %v\n", err)
+			log.Fatalf("Error parsing TRACE_SAMPLE_RATE: %v", err)
 		}
-		return
+		traceOpts.SampleRate = sampleRate
 	}
+	if path := os.Getenv("TRACE_FILE"); path != "" {
+		exporter, err := tracing.OpenFile(path)
+		if err != nil {
+			log.Fatalf("Error opening trace file: %v", err)
+		}
+		defer exporter.Close()
+		traceOpts.Exporter = exporter
+	}
+	h = tracing.Handler(h, traceOpts)
+	h = requestid.Handler(h, requestid.Options{})
 
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		route := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-		url := "https://httpbin.org" + route
-		fmt.Println("Proxying to", url)
+	accessLog, err := accesslog.New(accesslog.Options{Format: accesslog.Combined, File: os.Getenv("ACCESS_LOG_FILE")})
+	if err != nil {
+		log.Fatalf("Error opening access log: %v", err)
+	}
+	defer accessLog.Close()
 
-		resp, err := http.Get(url)
+	opts := []server.Option{
+		server.WithHTTP2(),
+		server.WithAccessLog(accessLog),
+		server.WithObserver(metrics.NewServerMetrics(registry, metrics.Options{Route: routes})),
+	}
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		statsdClient, err := statsd.New(statsd.Options{Addr: addr, Prefix: "httpfromtcp."})
 		if err != nil {
-			log.Fatalf("Error making GET request: %v", err)
+			log.Fatalf("Error starting StatsD client: %v", err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("Unexpected status code: %d", resp.StatusCode)
+		defer statsdClient.Close()
+		opts = append(opts, server.WithObserver(statsd.NewObserver(statsdClient, routes)))
+	}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		reloader, err := certs.NewReloader(certs.KeyPair{CertFile: certFile, KeyFile: keyFile})
+		if err != nil {
+			log.Fatalf("Error loading certificates: %v", err)
 		}
+		defer reloader.Close()
+		reloader.Watch(time.Minute)
+		reloader.ReloadOnSignal()
+		opts = append(opts, server.WithTLS(server.TLSOptions{GetCertificate: reloader.GetCertificate}))
+	}
 
-		w.WriteStatusLine(response.StatusOK)
-
-		h := response.GetDefaultHeaders(0)
-		h.Remove("Content-Length")
-		h.Override("Content-Type", "text/plain")
-		h.Set("Transfer-Encoding", "chunked")
-		h.Set("Tralier", "X-Content-SHA256, X-Content-Length")
-		w.WriteHeaders(h)
+	server, err := server.Serve(port, h, opts...)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	defer server.Close()
+	log.Println("Server started on port", port)
 
-		fullBody := make([]byte, 0)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("Server gracefully stopped")
+}
 
-		buf := make([]byte, 1024)
-		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				fmt.Printf("Received %d bytes:\n%s\n", n, string(buf[:n]))
-				w.WriteChunkedBody(buf[:n])
-				fullBody = append(fullBody, buf[:n]...)
-			}
+func handler(w *response.Writer, req *request.Request) {
+	if forwardProxy != nil && proxy.IsForwardRequest(req) {
+		forwardProxy(w, req)
+		return
+	}
 
-			if err == io.EOF {
-				break
-			}
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/video") {
+		req.RequestLine.RequestTarget = "/vim.mp4"
+		assets(w, req)
+		return
+	}
 
-			if err != nil {
-				fmt.Println("Error reading response body:", err)
-				break
-			}
-		}
-		w.WriteChunkedBodyDone()
-		fmt.Println("Stream processed successfully")
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/assets/") {
+		server.StripPrefix("/assets", assets)(w, req)
+		return
+	}
 
-		hashedBody := sha256.Sum256(fullBody)
-		hashedBodyString := fmt.Sprintf("%x", hashedBody)
+	if req.RequestLine.RequestTarget == "/metrics" {
+		serveMetrics(w, req)
+		return
+	}
 
-		trailers := headers.NewHeaders()
-		trailers.Set("X-Content-SHA256", hashedBodyString)
-		trailers.Set("X-Content-Length", strconv.Itoa(len(fullBody)))
-		w.WriteTrailers(trailers)
+	if req.RequestLine.RequestTarget == "/events" {
+		streamEvents(w, req)
+		return
+	}
 
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
+		server.StripPrefix("/httpbin", httpbin)(w, req)
 		return
 	}
 
@@ -160,3 +218,29 @@ func handler(w *response.Writer, req *request.Request) {
 	w.WriteHeaders(headers)
 	w.WriteBody(body)
 }
+
+// streamEvents sends a tick every second, resuming the count from the
+// client's Last-Event-ID.
+func streamEvents(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req, sse.Options{})
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	tick, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case <-ticker.C:
+			tick++
+			id := strconv.Itoa(tick)
+			if err := stream.Send(sse.Event{Event: "tick", ID: id, Data: id}); err != nil {
+				return
+			}
+		}
+	}
+}
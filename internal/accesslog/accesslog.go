@@ -0,0 +1,202 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBufferSize = 1024
+
+type Format int
+
+const (
+	// Common is the Common Log Format of the NCSA and Apache servers.
+	Common Format = iota
+	// Combined is the Common Log Format with the referer and user agent.
+	Combined
+	// JSON writes one log/slog JSON record per request.
+	JSON
+)
+
+// The JSON field names, for Options.Fields.
+const (
+	FieldTime         = "time"
+	FieldRemoteAddr   = "remote_addr"
+	FieldUser         = "user"
+	FieldMethod       = "method"
+	FieldTarget       = "target"
+	FieldProto        = "proto"
+	FieldHost         = "host"
+	FieldReferer      = "referer"
+	FieldUserAgent    = "user_agent"
+	FieldRequestBytes = "request_bytes"
+	FieldStatus       = "status"
+	FieldRequestID    = "request_id"
+	FieldBytes        = "bytes"
+	// FieldDuration is in milliseconds.
+	FieldDuration = "duration_ms"
+	// FieldTimings is an object of the phase durations in milliseconds,
+	// named as in response.Timing.Phases.
+	FieldTimings = "timings"
+)
+
+type Options struct {
+	Format Format
+	// Fields selects the fields of the JSON format, all of them by
+	// default. The Common and Combined formats are fixed.
+	Fields []string
+	// Output receives the log lines, os.Stdout by default. File, when set,
+	// is opened for appending and used instead.
+	Output io.Writer
+	File   string
+	// BufferSize is how many lines may wait to be written, 1024 by
+	// default. Lines logged while the buffer is full are dropped rather
+	// than holding up the request.
+	BufferSize int
+}
+
+// Logger writes access log lines in the background. Lines are buffered and
+// flushed whenever the queue runs empty.
+type Logger struct {
+	opts   Options
+	fields map[string]bool
+	json   slog.Handler
+	closer io.Closer
+
+	mu      sync.RWMutex
+	closed  bool
+	lines   chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// New returns a Logger writing to opts.File or opts.Output.
+func New(opts Options) (*Logger, error) {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	l := &Logger{
+		opts:  opts,
+		lines: make(chan []byte, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+
+	out := opts.Output
+	if opts.File != "" {
+		file, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("accesslog: %w", err)
+		}
+		out, l.closer = file, file
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+
+	if opts.Format == JSON {
+		if opts.Fields != nil {
+			l.fields = make(map[string]bool, len(opts.Fields))
+			for _, field := range opts.Fields {
+				l.fields[field] = true
+			}
+		}
+		l.json = slog.NewJSONHandler(queueWriter{l}, nil)
+	}
+
+	go l.write(out)
+	return l, nil
+}
+
+// Log queues entry to be written.
+func (l *Logger) Log(entry Entry) {
+	switch l.opts.Format {
+	case Common:
+		l.enqueue(append(appendCommon(nil, entry), '\n'))
+	case Combined:
+		l.enqueue(append(appendCombined(nil, entry), '\n'))
+	case JSON:
+		record := slog.NewRecord(entry.Time, slog.LevelInfo, "request", 0)
+		if l.fields != nil && !l.fields[FieldTime] {
+			record.Time = time.Time{}
+		}
+		record.AddAttrs(attrs(entry, l.fields)...)
+		l.json.Handle(context.Background(), record)
+	}
+}
+
+// Dropped returns how many lines were dropped because the buffer was full.
+func (l *Logger) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Close writes out the queued lines and closes the log file, if the Logger
+// opened one. Lines logged afterwards are dropped.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.lines)
+	l.mu.Unlock()
+
+	<-l.done
+	if l.closer != nil {
+		return l.closer.Close()
+	}
+	return nil
+}
+
+func (l *Logger) enqueue(line []byte) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.lines <- line:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *Logger) write(out io.Writer) {
+	defer close(l.done)
+	bw := bufio.NewWriter(out)
+	// A bufio.Writer keeps failing after its first error, so it is only
+	// reported once.
+	failed := false
+	flush := func() {
+		if err := bw.Flush(); err != nil && !failed {
+			failed = true
+			log.Printf("Error writing access log: %v", err)
+		}
+	}
+	for line := range l.lines {
+		bw.Write(line)
+		if len(l.lines) == 0 {
+			flush()
+		}
+	}
+	flush()
+}
+
+// queueWriter hands the lines written by the slog handler to the queue.
+type queueWriter struct {
+	l *Logger
+}
+
+func (q queueWriter) Write(p []byte) (int, error) {
+	q.l.enqueue(append([]byte{}, p...))
+	return len(p), nil
+}
@@ -0,0 +1,163 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+func testEntry(t *testing.T) Entry {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /apache_pb.gif HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Authorization: Basic ZnJhbms6c2VjcmV0\r\n" +
+		"Referer: http://www.example.com/start.html\r\n" +
+		"User-Agent: Mozilla/4.08 \"quoted\"\r\n\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:54321"
+
+	entry := NewEntry(req, start)
+	req.RequestLine.RequestTarget = "/changed"
+	entry.Status = 200
+	entry.Bytes = 2326
+	entry.Duration = 1500 * time.Microsecond
+	return entry
+}
+
+func logLines(t *testing.T, opts Options, entries ...Entry) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	opts.Output = &buf
+	l, err := New(opts)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		l.Log(entry)
+	}
+	require.NoError(t, l.Close())
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestFormats(t *testing.T) {
+	entry := testEntry(t)
+
+	// Test: Common
+	lines := logLines(t, Options{Format: Common}, entry)
+	assert.Equal(t, []string{`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`}, lines)
+
+	// Test: Combined, with quotes escaped
+	lines = logLines(t, Options{Format: Combined}, entry)
+	assert.Equal(t, []string{`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`}, lines)
+
+	// Test: Missing values are dashes
+	lines = logLines(t, Options{Format: Combined}, Entry{Time: start, RemoteAddr: "[::1]:80", Status: 400})
+	assert.Equal(t, []string{`::1 - - [10/Oct/2000:13:55:36 -0700] "-" 400 - "-" "-"`}, lines)
+
+	// Test: Control characters
+	assert.Equal(t, `a\x0ab\\\xff`, escape("a\nb\\\xff"))
+}
+
+func TestJSON(t *testing.T) {
+	entry := testEntry(t)
+
+	// Test: All fields by default
+	lines := logLines(t, Options{Format: JSON}, entry)
+	require.Len(t, lines, 1)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "2000-10-10T13:55:36-07:00", record["time"])
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "127.0.0.1:54321", record["remote_addr"])
+	assert.Equal(t, "frank", record["user"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/apache_pb.gif", record["target"])
+	assert.Equal(t, "HTTP/1.1", record["proto"])
+	assert.Equal(t, "localhost", record["host"])
+	assert.Equal(t, `Mozilla/4.08 "quoted"`, record["user_agent"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(2326), record["bytes"])
+	assert.Equal(t, 1.5, record["duration_ms"])
+
+	// Test: Selected fields
+	lines = logLines(t, Options{Format: JSON, Fields: []string{FieldMethod, FieldStatus}}, entry)
+	record = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, map[string]any{"level": "INFO", "msg": "request", "method": "GET", "status": float64(200)}, record)
+
+	// Test: Phase timings are an object, left out when there are none
+	assert.NotContains(t, lines[0], FieldTimings)
+	entry.Timing.HandlerStart = entry.Time
+	entry.Timing.HandlerEnd = entry.Time.Add(1500 * time.Microsecond)
+	lines = logLines(t, Options{Format: JSON, Fields: []string{FieldTimings}}, entry)
+	record = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, map[string]any{"handler": 1.5}, record["timings"])
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("existing\n"), 0o644))
+
+	// Test: Lines are appended to the file
+	l, err := New(Options{File: path})
+	require.NoError(t, err)
+	l.Log(testEntry(t))
+	l.Log(testEntry(t))
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+	assert.True(t, strings.HasPrefix(string(data), "existing\n127.0.0.1 - frank"))
+
+	// Test: A file that cannot be opened
+	_, err = New(Options{File: filepath.Join(t.TempDir(), "missing", "access.log")})
+	assert.Error(t, err)
+}
+
+// blockingWriter holds up writes until release is closed.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.buf.Write(p)
+}
+
+func TestDropped(t *testing.T) {
+	out := &blockingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	l, err := New(Options{Output: out, BufferSize: 2})
+	require.NoError(t, err)
+	entry := testEntry(t)
+
+	// Test: Logging never blocks on a slow writer
+	l.Log(entry)
+	<-out.started
+	for i := 0; i < 5; i++ {
+		l.Log(entry)
+	}
+	assert.Equal(t, int64(3), l.Dropped())
+
+	// Test: Queued lines are written on Close, later ones dropped
+	close(out.release)
+	require.NoError(t, l.Close())
+	assert.Equal(t, 3, strings.Count(out.buf.String(), "\n"))
+	l.Log(entry)
+	assert.Equal(t, int64(4), l.Dropped())
+	assert.NoError(t, l.Close())
+}
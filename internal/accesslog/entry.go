@@ -0,0 +1,212 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+// Entry describes one request and its response.
+type Entry struct {
+	// Time is when the request started.
+	Time       time.Time
+	RemoteAddr string
+	// User is the name from Basic credentials, if any.
+	User   string
+	Method string
+	Target string
+	Proto  string
+	Host   string
+	// Referer and UserAgent come from the request headers.
+	Referer   string
+	UserAgent string
+	// RequestBytes is the size of the request body.
+	RequestBytes int
+	Status       int
+	// Bytes counts the response body bytes written to the connection.
+	Bytes    int
+	Duration time.Duration
+	// RequestID is set by middleware through FromContext.
+	RequestID string
+	// Timing holds the phases of the request and response.
+	Timing response.Timing
+}
+
+// NewEntry returns an Entry for req, started at start. The response fields
+// are left for the caller to fill in once the response is complete. It
+// copies what it needs, so later changes to req, such as a stripped
+// prefix, do not show up in the log.
+func NewEntry(req *request.Request, start time.Time) Entry {
+	entry := Entry{
+		Time:         start,
+		RemoteAddr:   req.RemoteAddr,
+		Method:       req.RequestLine.Method,
+		Target:       req.RequestLine.RequestTarget,
+		Proto:        "HTTP/" + req.RequestLine.HttpVersion,
+		RequestBytes: len(req.Body),
+	}
+	entry.Host, _ = req.Headers.Get("Host")
+	entry.Referer, _ = req.Headers.Get("Referer")
+	entry.UserAgent, _ = req.Headers.Get("User-Agent")
+	if authorization, ok := req.Headers.Get("Authorization"); ok {
+		entry.User = basicUser(authorization)
+	}
+	return entry
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying entry, which the server does
+// for every request it records so that middleware can add to the entry.
+func NewContext(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the entry being recorded for the request of ctx, or
+// nil. It must only be changed before the response is finished.
+func FromContext(ctx context.Context) *Entry {
+	entry, _ := ctx.Value(contextKey{}).(*Entry)
+	return entry
+}
+
+func basicUser(authorization string) string {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return ""
+	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	return user
+}
+
+// appendCommon appends entry in the Common Log Format:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326
+func appendCommon(b []byte, entry Entry) []byte {
+	host := entry.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	b = append(b, orDash(host)...)
+	b = append(b, " - "...)
+	b = append(b, orDash(escape(entry.User))...)
+	b = append(b, " ["...)
+	b = entry.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] \""...)
+	if entry.Method == "" {
+		b = append(b, '-')
+	} else {
+		b = append(b, escape(entry.Method)...)
+		b = append(b, ' ')
+		b = append(b, escape(entry.Target)...)
+		b = append(b, ' ')
+		b = append(b, escape(entry.Proto)...)
+	}
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(entry.Status), 10)
+	b = append(b, ' ')
+	if entry.Bytes == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(entry.Bytes), 10)
+	}
+	return b
+}
+
+// appendCombined appends entry in the Combined Log Format, which adds the
+// referer and user agent to the Common one.
+func appendCombined(b []byte, entry Entry) []byte {
+	b = appendCommon(b, entry)
+	b = append(b, " \""...)
+	b = append(b, orDash(escape(entry.Referer))...)
+	b = append(b, "\" \""...)
+	b = append(b, orDash(escape(entry.UserAgent))...)
+	return append(b, '"')
+}
+
+// attrs returns the JSON attributes of entry for the given fields.
+func attrs(entry Entry, fields map[string]bool) []slog.Attr {
+	all := []slog.Attr{
+		slog.String(FieldRemoteAddr, entry.RemoteAddr),
+		slog.String(FieldUser, entry.User),
+		slog.String(FieldMethod, entry.Method),
+		slog.String(FieldTarget, entry.Target),
+		slog.String(FieldProto, entry.Proto),
+		slog.String(FieldHost, entry.Host),
+		slog.String(FieldReferer, entry.Referer),
+		slog.String(FieldUserAgent, entry.UserAgent),
+		slog.Int(FieldRequestBytes, entry.RequestBytes),
+		slog.Int(FieldStatus, entry.Status),
+		slog.String(FieldRequestID, entry.RequestID),
+		slog.Int(FieldBytes, entry.Bytes),
+		slog.Float64(FieldDuration, float64(entry.Duration)/float64(time.Millisecond)),
+		slog.Attr{Key: FieldTimings, Value: slog.GroupValue(phaseAttrs(entry.Timing)...)},
+	}
+	if fields == nil {
+		return all
+	}
+	selected := all[:0]
+	for _, attr := range all {
+		if fields[attr.Key] {
+			selected = append(selected, attr)
+		}
+	}
+	return selected
+}
+
+// phaseAttrs returns the reached phases of t in milliseconds.
+func phaseAttrs(t response.Timing) []slog.Attr {
+	var attrs []slog.Attr
+	for _, phase := range t.Phases() {
+		attrs = append(attrs, slog.Float64(phase.Name, float64(phase.Duration)/float64(time.Millisecond)))
+	}
+	return attrs
+}
+
+// escape quotes what would break a log line, as Apache does: double
+// quotes and backslashes get a backslash, other control and non-ASCII
+// bytes become \xhh.
+func escape(s string) string {
+	clean := true
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
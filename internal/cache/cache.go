@@ -0,0 +1,501 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const (
+	defaultMaxEntrySize = 8 << 20
+	defaultMemoryBytes  = 64 << 20
+	defaultName         = "httpfromtcp"
+)
+
+// hopByHop lists the headers that are not stored with a response.
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Options struct {
+	// Store keeps the entries, a 64 MiB MemoryStore by default.
+	Store Store
+	// MaxEntrySize is the largest body stored, 8 MiB by default. Larger
+	// responses are passed through.
+	MaxEntrySize int
+	// Name identifies the cache in the Cache-Status header (RFC 9211).
+	Name string
+}
+
+// cache is a shared cache in front of a handler (RFC 9111).
+type cache struct {
+	next server.Handler
+	opts Options
+
+	mu sync.Mutex
+	// fetches collapses concurrent misses for a key into one call of next.
+	fetches map[string]chan struct{}
+	// refreshing holds the keys being revalidated in the background.
+	refreshing map[string]bool
+}
+
+// Handler caches the GET responses of next and serves them while fresh.
+// Stale entries are revalidated with conditional requests, or served while
+// next is revalidated in the background or fails, as stale-while-revalidate
+// and stale-if-error allow. Unsafe methods invalidate the stored responses
+// for their target.
+func Handler(next server.Handler, opts Options) server.Handler {
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(defaultMemoryBytes)
+	}
+	if opts.MaxEntrySize == 0 {
+		opts.MaxEntrySize = defaultMaxEntrySize
+	}
+	if opts.Name == "" {
+		opts.Name = defaultName
+	}
+	c := &cache{
+		next:       next,
+		opts:       opts,
+		fetches:    make(map[string]chan struct{}),
+		refreshing: make(map[string]bool),
+	}
+	return c.serve
+}
+
+func (c *cache) serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	_, upgrade := req.Headers.Get("Upgrade")
+	if method != "GET" && method != "HEAD" || upgrade {
+		c.next(w, req)
+		if !safeMethod(method) && w.StatusCode >= 200 && w.StatusCode < 400 {
+			c.opts.Store.Delete(primaryKey(req))
+		}
+		return
+	}
+
+	key := primaryKey(req)
+	reqCC := parseCacheControl(req.Headers)
+	entry, entryKey := c.lookup(req, key)
+	if entry != nil {
+		now := time.Now()
+		switch c.usable(entry, reqCC, now) {
+		case fresh:
+			c.serveEntry(w, req, entry, "hit")
+			return
+		case staleWhileRevalidate:
+			c.serveEntry(w, req, entry, "hit; detail=stale-while-revalidate")
+			c.refresh(req, key, entryKey, entry)
+			return
+		}
+		if reqCC.has("only-if-cached") {
+			writeGatewayTimeout(w)
+			return
+		}
+		if method == "GET" {
+			c.revalidate(w, req, key, entryKey, entry, reqCC)
+			return
+		}
+	} else if reqCC.has("only-if-cached") {
+		writeGatewayTimeout(w)
+		return
+	}
+
+	if method == "HEAD" {
+		c.next(w, req)
+		return
+	}
+	c.fetch(w, req, key, reqCC)
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+func primaryKey(req *request.Request) string {
+	host, _ := req.Headers.Get("Host")
+	return strings.ToLower(host) + req.RequestLine.RequestTarget
+}
+
+// variantKey extends key with the request's values of the headers named by
+// Vary, so each variant is stored separately.
+func variantKey(key string, vary []string, h headers.Headers) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		value, _ := h.Get(name)
+		fmt.Fprintf(&b, "\n%s: %s", name, strings.Join(strings.Fields(value), " "))
+	}
+	return b.String()
+}
+
+// lookup returns the stored response matching req and the key it is stored
+// under.
+func (c *cache) lookup(req *request.Request, key string) (*Entry, string) {
+	entry, ok := c.opts.Store.Get(key)
+	if !ok {
+		return nil, ""
+	}
+	if len(entry.Vary) == 0 {
+		return entry, key
+	}
+	variant := variantKey(key, entry.Vary, req.Headers)
+	if entry, ok = c.opts.Store.Get(variant); !ok || len(entry.Vary) > 0 {
+		return nil, ""
+	}
+	return entry, variant
+}
+
+type usability int
+
+const (
+	stale usability = iota
+	fresh
+	staleWhileRevalidate
+)
+
+// usable decides whether entry may answer a request with the given
+// directives without contacting next (RFC 9111 section 4.2 and RFC 5861).
+func (c *cache) usable(entry *Entry, reqCC directives, now time.Time) usability {
+	respCC := parseCacheControl(entry.Header)
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return stale
+	}
+
+	age := entry.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return stale
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	lifetime := freshnessLifetime(entry.StatusCode, entry.Header, entry.ResponseTime)
+	if age < lifetime {
+		return fresh
+	}
+
+	if mustRevalidate(respCC) {
+		return stale
+	}
+	staleness := age - lifetime
+	if maxStale, ok := reqCC["max-stale"]; ok {
+		limit, _ := reqCC.seconds("max-stale")
+		if maxStale == "" || staleness <= limit {
+			return fresh
+		}
+	}
+	if window, ok := respCC.seconds("stale-while-revalidate"); ok && staleness <= window {
+		return staleWhileRevalidate
+	}
+	return stale
+}
+
+// mustRevalidate reports whether a stale response must never be served
+// without revalidation; s-maxage implies proxy-revalidate.
+func mustRevalidate(respCC directives) bool {
+	return respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+}
+
+// staleIfError reports whether entry may stand in for an error response.
+func staleIfError(entry *Entry, reqCC directives, now time.Time) bool {
+	respCC := parseCacheControl(entry.Header)
+	if mustRevalidate(respCC) || respCC.has("no-cache") {
+		return false
+	}
+	staleness := entry.age(now) - freshnessLifetime(entry.StatusCode, entry.Header, entry.ResponseTime)
+	for _, cc := range []directives{reqCC, respCC} {
+		if window, ok := cc.seconds("stale-if-error"); ok && staleness <= window {
+			return true
+		}
+	}
+	return false
+}
+
+func isError(statusCode int) bool {
+	return statusCode == 0 || statusCode == 500 || statusCode == 502 || statusCode == 503 || statusCode == 504
+}
+
+// fetch answers a miss from next, storing the response when it may be
+// reused. While one request for a key is fetching, others for the same key
+// wait for it and then try the cache again.
+func (c *cache) fetch(w *response.Writer, req *request.Request, key string, reqCC directives) {
+	c.mu.Lock()
+	if done, ok := c.fetches[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return
+		}
+		if entry, _ := c.lookup(req, key); entry != nil && c.usable(entry, reqCC, time.Now()) == fresh {
+			c.serveEntry(w, req, entry, "hit; detail=collapsed")
+			return
+		}
+		c.fetchUncollapsed(w, req, key, reqCC)
+		return
+	}
+	done := make(chan struct{})
+	c.fetches[key] = done
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.fetches, key)
+		c.mu.Unlock()
+		close(done)
+	}()
+	c.fetchUncollapsed(w, req, key, reqCC)
+}
+
+func (c *cache) fetchUncollapsed(w *response.Writer, req *request.Request, key string, reqCC directives) {
+	// The client's own validators would turn the response into a 304 that
+	// cannot be stored; a 200 is always a valid answer to them.
+	fetchReq := withHeaders(req, func(h headers.Headers) {
+		h.Remove("If-None-Match")
+		h.Remove("If-Modified-Since")
+	})
+	rec := &recorder{
+		client:  w,
+		maxBody: c.opts.MaxEntrySize,
+		forward: func(statusCode int, h headers.Headers) bool {
+			c.addStatus(h, "fwd=miss")
+			return true
+		},
+	}
+	requestTime := time.Now()
+	c.run(rec, fetchReq)
+	c.maybeStore(req, key, reqCC, rec, requestTime, time.Now())
+}
+
+// revalidate asks next whether entry is still current. A 304 refreshes and
+// serves the entry; an error is answered with the entry when stale-if-error
+// allows it; anything else is passed on and stored in its place.
+func (c *cache) revalidate(w *response.Writer, req *request.Request, key, entryKey string, entry *Entry, reqCC directives) {
+	requestTime := time.Now()
+	useStale := staleIfError(entry, reqCC, requestTime)
+	rec := &recorder{
+		client:  w,
+		maxBody: c.opts.MaxEntrySize,
+		forward: func(statusCode int, h headers.Headers) bool {
+			if statusCode == http.StatusNotModified || useStale && isError(statusCode) {
+				return false
+			}
+			c.addStatus(h, "fwd=stale; fwd-status="+strconv.Itoa(statusCode))
+			return true
+		},
+	}
+	c.run(rec, conditional(req, entry))
+	responseTime := time.Now()
+
+	switch {
+	case rec.statusCode == http.StatusNotModified:
+		updated := freshen(entry, rec.header, requestTime, responseTime)
+		c.opts.Store.Set(entryKey, updated)
+		c.serveEntry(w, req, updated, "hit; fwd=stale; fwd-status=304")
+	case rec.forwarding:
+		c.maybeStore(req, key, reqCC, rec, requestTime, responseTime)
+	case useStale:
+		c.serveEntry(w, req, entry, fmt.Sprintf("hit; fwd=stale; fwd-status=%d; detail=stale-if-error", rec.statusCode))
+	}
+}
+
+// refresh revalidates entry in the background, once per key at a time.
+func (c *cache) refresh(req *request.Request, key, entryKey string, entry *Entry) {
+	c.mu.Lock()
+	if c.refreshing[entryKey] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[entryKey] = true
+	c.mu.Unlock()
+
+	// The refresh outlives the client's request.
+	refreshReq := conditional(req, entry).WithContext(context.WithoutCancel(req.Context()))
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, entryKey)
+			c.mu.Unlock()
+		}()
+		rec := &recorder{maxBody: c.opts.MaxEntrySize}
+		requestTime := time.Now()
+		c.run(rec, refreshReq)
+		responseTime := time.Now()
+		if rec.statusCode == http.StatusNotModified {
+			c.opts.Store.Set(entryKey, freshen(entry, rec.header, requestTime, responseTime))
+			return
+		}
+		c.maybeStore(refreshReq, key, directives{}, rec, requestTime, responseTime)
+	}()
+}
+
+// run calls next with a Writer that writes into rec.
+func (c *cache) run(rec *recorder, req *request.Request) {
+	w := &response.Writer{Framer: rec, WriterState: response.WritingStatusLine}
+	c.next(w, req)
+	w.Finish()
+}
+
+func (c *cache) maybeStore(req *request.Request, key string, reqCC directives, rec *recorder, requestTime, responseTime time.Time) {
+	if !rec.complete() || !storable(req.RequestLine.Method, req.Headers, reqCC, rec.statusCode, rec.header) {
+		return
+	}
+
+	h := cloneHeaders(rec.header)
+	for _, name := range hopByHop {
+		h.Remove(name)
+	}
+	h.Override("Content-Length", strconv.Itoa(len(rec.body)))
+	if _, ok := h.Get("Date"); !ok {
+		h.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+	}
+	entry := &Entry{
+		StatusCode:   rec.statusCode,
+		Header:       h,
+		Body:         rec.body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+
+	vary := varyNames(h)
+	if len(vary) == 0 {
+		c.opts.Store.Set(key, entry)
+		return
+	}
+	c.opts.Store.Set(key, &Entry{Vary: vary})
+	c.opts.Store.Set(variantKey(key, vary, req.Headers), entry)
+}
+
+func varyNames(h headers.Headers) []string {
+	vary, _ := h.Get("Vary")
+	var names []string
+	for _, name := range splitList(vary) {
+		name = strings.ToLower(name)
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// freshen returns a copy of entry updated with the headers of a 304
+// response (RFC 9111 section 4.3.4).
+func freshen(entry *Entry, h headers.Headers, requestTime, responseTime time.Time) *Entry {
+	updated := *entry
+	updated.Header = cloneHeaders(entry.Header)
+	for name, value := range h {
+		switch name {
+		case "content-length", "connection", "transfer-encoding", "keep-alive", "trailer", "upgrade":
+			continue
+		}
+		updated.Header.Override(name, value)
+	}
+	if _, ok := h.Get("Age"); !ok {
+		updated.Header.Remove("Age")
+	}
+	if _, ok := h.Get("Date"); !ok {
+		updated.Header.Override("Date", responseTime.UTC().Format(http.TimeFormat))
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// conditional returns a copy of req asking next to validate entry.
+func conditional(req *request.Request, entry *Entry) *request.Request {
+	return withHeaders(req, func(h headers.Headers) {
+		h.Remove("If-None-Match")
+		h.Remove("If-Modified-Since")
+		if etag, ok := entry.Header.Get("ETag"); ok {
+			h.Set("If-None-Match", etag)
+		}
+		if lastModified, ok := entry.Header.Get("Last-Modified"); ok {
+			h.Set("If-Modified-Since", lastModified)
+		}
+	})
+}
+
+// withHeaders returns a copy of req whose headers edit has changed,
+// leaving req untouched.
+func withHeaders(req *request.Request, edit func(h headers.Headers)) *request.Request {
+	out := req.WithContext(req.Context())
+	out.Headers = cloneHeaders(req.Headers)
+	edit(out.Headers)
+	return out
+}
+
+// serveEntry writes entry as the response to req, or 304 when the client's
+// validators match it.
+func (c *cache) serveEntry(w *response.Writer, req *request.Request, entry *Entry, status string) {
+	h := cloneHeaders(entry.Header)
+	h.Override("Age", strconv.FormatInt(int64(entry.age(time.Now())/time.Second), 10))
+	h.Set("Connection", "close")
+	c.addStatus(h, status)
+
+	if notModified(req.Headers, entry) {
+		h.Remove("Content-Length")
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	w.WriteStatusLine(response.StatusCode(entry.StatusCode))
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" && len(entry.Body) > 0 {
+		w.WriteBody(entry.Body)
+	}
+}
+
+func notModified(reqHeaders headers.Headers, entry *Entry) bool {
+	if entry.StatusCode != http.StatusOK {
+		return false
+	}
+	if ifNoneMatch, ok := reqHeaders.Get("If-None-Match"); ok {
+		etag, ok := entry.Header.Get("ETag")
+		return ok && etagMatches(ifNoneMatch, etag)
+	}
+	ifModifiedSince, ok := reqHeaders.Get("If-Modified-Since")
+	if !ok {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified := headerTime(entry.Header, "Last-Modified", time.Time{})
+	return !lastModified.IsZero() && !lastModified.After(since)
+}
+
+// addStatus appends this cache's member to the Cache-Status header.
+func (c *cache) addStatus(h headers.Headers, status string) {
+	h.Set("Cache-Status", c.opts.Name+"; "+status)
+}
+
+func writeGatewayTimeout(w *response.Writer) {
+	body := []byte("504 Gateway Timeout")
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/plain")
+	w.WriteStatusLine(response.StatusGatewayTimeout)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
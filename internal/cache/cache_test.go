@@ -0,0 +1,523 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// origin is a configurable handler that counts its calls and answers
+// If-None-Match against its ETag.
+type origin struct {
+	calls atomic.Int32
+	delay time.Duration
+
+	mu          sync.Mutex
+	status      response.StatusCode
+	header      map[string]string
+	body        string
+	chunked     bool
+	conditional []string
+}
+
+func newOrigin(body string, header map[string]string) *origin {
+	return &origin{status: response.StatusOK, body: body, header: header}
+}
+
+func (o *origin) set(status response.StatusCode, body string, header map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status, o.body, o.header = status, body, header
+}
+
+func (o *origin) handler(w *response.Writer, req *request.Request) {
+	o.calls.Add(1)
+	time.Sleep(o.delay)
+	o.mu.Lock()
+	status, body, chunked := o.status, o.body, o.chunked
+	h := response.GetDefaultHeaders(len(body))
+	for name, value := range o.header {
+		h.Override(name, value)
+	}
+	ifNoneMatch, conditional := req.Headers.Get("If-None-Match")
+	if conditional {
+		o.conditional = append(o.conditional, ifNoneMatch)
+	}
+	o.mu.Unlock()
+
+	if etag, ok := h.Get("ETag"); ok && conditional && etagMatches(ifNoneMatch, etag) {
+		h.Remove("Content-Length")
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	w.WriteStatusLine(status)
+	if chunked {
+		h.Remove("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte(body[:len(body)/2]))
+		w.WriteChunkedBody([]byte(body[len(body)/2:]))
+		return
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func do(t *testing.T, handler server.Handler, method, target string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	h := headers.NewHeaders()
+	h.Set("Host", "example.com")
+	for name, value := range header {
+		h.Set(name, value)
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+	}
+
+	var buf bytes.Buffer
+	w := &response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func get(t *testing.T, handler server.Handler, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	return do(t, handler, "GET", "/resource", header)
+}
+
+func TestFreshHit(t *testing.T) {
+	o := newOrigin("cached body", map[string]string{"Cache-Control": "max-age=60"})
+	h := Handler(o.handler, Options{})
+
+	// Test: A miss is passed through and stored
+	resp, body := get(t, h, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "cached body", body)
+	assert.Equal(t, "httpfromtcp; fwd=miss", resp.Header.Get("Cache-Status"))
+
+	// Test: A fresh hit does not call the handler
+	resp, body = get(t, h, nil)
+	assert.Equal(t, "cached body", body)
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, "0", resp.Header.Get("Age"))
+	assert.NotEmpty(t, resp.Header.Get("Date"))
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: HEAD is answered from the GET entry
+	resp, body = do(t, h, "HEAD", "/resource", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, int64(len("cached body")), resp.ContentLength)
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: Other targets and hosts are separate entries
+	do(t, h, "GET", "/resource?page=2", nil)
+	get(t, h, map[string]string{"Host": "other.example.com"})
+	assert.Equal(t, int32(3), o.calls.Load())
+}
+
+func TestChunkedResponseStored(t *testing.T) {
+	o := newOrigin("streamed in two chunks", map[string]string{"Cache-Control": "max-age=60"})
+	o.chunked = true
+	h := Handler(o.handler, Options{})
+
+	// Test: A chunked response streams through and is stored with a length
+	resp, body := get(t, h, nil)
+	assert.Equal(t, "streamed in two chunks", body)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	resp, body = get(t, h, nil)
+	assert.Equal(t, "streamed in two chunks", body)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.Equal(t, int32(1), o.calls.Load())
+}
+
+func TestNotStored(t *testing.T) {
+	cases := []struct {
+		name    string
+		method  string
+		request map[string]string
+		header  map[string]string
+		status  response.StatusCode
+	}{
+		{name: "no-store", header: map[string]string{"Cache-Control": "no-store, max-age=60"}},
+		{name: "private", header: map[string]string{"Cache-Control": "private, max-age=60"}},
+		{name: "no freshness or validator", header: map[string]string{}},
+		{name: "Vary: *", header: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}},
+		{name: "uncacheable status", status: response.StatusInternalServerError, header: map[string]string{"ETag": `"e"`}},
+		{name: "request no-store", request: map[string]string{"Cache-Control": "no-store"}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "authorization", request: map[string]string{"Authorization": "Bearer t"}, header: map[string]string{"Cache-Control": "max-age=60"}},
+		{name: "POST", method: "POST", header: map[string]string{"Cache-Control": "max-age=60"}},
+	}
+	for _, tc := range cases {
+		// Test: Responses the cache must not reuse
+		o := newOrigin("body", tc.header)
+		if tc.status != 0 {
+			o.status = tc.status
+		}
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		h := Handler(o.handler, Options{})
+		do(t, h, method, "/resource", tc.request)
+		do(t, h, method, "/resource", tc.request)
+		assert.Equal(t, int32(2), o.calls.Load(), tc.name)
+	}
+
+	// Test: Authorization with public is stored
+	o := newOrigin("body", map[string]string{"Cache-Control": "public, max-age=60"})
+	h := Handler(o.handler, Options{})
+	get(t, h, map[string]string{"Authorization": "Bearer t"})
+	get(t, h, map[string]string{"Authorization": "Bearer t"})
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: Bodies over MaxEntrySize are passed through
+	o = newOrigin("too large to keep", map[string]string{"Cache-Control": "max-age=60"})
+	h = Handler(o.handler, Options{MaxEntrySize: 4})
+	_, body := get(t, h, nil)
+	assert.Equal(t, "too large to keep", body)
+	get(t, h, nil)
+	assert.Equal(t, int32(2), o.calls.Load())
+}
+
+func TestExpiresAndHeuristics(t *testing.T) {
+	now := time.Now().UTC()
+
+	// Test: Expires relative to Date
+	o := newOrigin("body", map[string]string{
+		"Date":    now.Format(http.TimeFormat),
+		"Expires": now.Add(time.Minute).Format(http.TimeFormat),
+	})
+	h := Handler(o.handler, Options{})
+	get(t, h, nil)
+	resp, _ := get(t, h, nil)
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+
+	// Test: An Expires in the past is stale
+	o = newOrigin("body", map[string]string{
+		"Date":          now.Format(http.TimeFormat),
+		"Expires":       now.Add(-time.Minute).Format(http.TimeFormat),
+		"Last-Modified": now.Add(-time.Hour).Format(http.TimeFormat),
+	})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	get(t, h, nil)
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	// Test: s-maxage overrides max-age
+	o = newOrigin("body", map[string]string{"Cache-Control": "max-age=0, s-maxage=60"})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	get(t, h, nil)
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	// Test: A tenth of the time since Last-Modified
+	o = newOrigin("body", map[string]string{"Last-Modified": now.Add(-10 * time.Hour).Format(http.TimeFormat)})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	get(t, h, nil)
+	assert.Equal(t, int32(1), o.calls.Load())
+
+	h0 := headers.NewHeaders()
+	h0.Set("Date", now.Format(http.TimeFormat))
+	h0.Set("Last-Modified", now.Add(-10*time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, time.Hour, freshnessLifetime(200, h0, now))
+	h0.Override("Last-Modified", now.Add(-1000*time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, 24*time.Hour, freshnessLifetime(200, h0, now))
+	assert.Zero(t, freshnessLifetime(302, h0, now))
+}
+
+func TestAge(t *testing.T) {
+	now := time.Now()
+	h := headers.NewHeaders()
+	h.Set("Date", now.Add(-10*time.Second).UTC().Format(http.TimeFormat))
+	h.Set("Age", "30")
+	entry := &Entry{Header: h, RequestTime: now.Add(-2 * time.Second), ResponseTime: now.Add(-time.Second)}
+
+	// Test: The Age header plus the response delay and resident time
+	assert.Equal(t, 32*time.Second, entry.age(now))
+
+	// Test: The apparent age wins when it is larger
+	h.Override("Age", "1")
+	assert.InDelta(t, 10*time.Second, entry.age(now), float64(time.Second))
+}
+
+func TestVary(t *testing.T) {
+	o := newOrigin("", map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"})
+	h := Handler(func(w *response.Writer, req *request.Request) {
+		lang, _ := req.Headers.Get("Accept-Language")
+		o.set(response.StatusOK, "lang="+lang, o.header)
+		o.handler(w, req)
+	}, Options{})
+
+	// Test: Each variant is stored separately
+	_, body := get(t, h, map[string]string{"Accept-Language": "en"})
+	assert.Equal(t, "lang=en", body)
+	_, body = get(t, h, map[string]string{"Accept-Language": "fr"})
+	assert.Equal(t, "lang=fr", body)
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	resp, body := get(t, h, map[string]string{"Accept-Language": "en"})
+	assert.Equal(t, "lang=en", body)
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	_, body = get(t, h, map[string]string{"Accept-Language": "fr"})
+	assert.Equal(t, "lang=fr", body)
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	// Test: A missing header is a variant of its own
+	_, body = get(t, h, nil)
+	assert.Equal(t, "lang=", body)
+	assert.Equal(t, int32(3), o.calls.Load())
+}
+
+func TestRevalidation(t *testing.T) {
+	o := newOrigin("validated", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`})
+	h := Handler(o.handler, Options{})
+	get(t, h, nil)
+
+	// Test: A stale entry is revalidated and a 304 refreshes it
+	resp, body := get(t, h, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "validated", body)
+	assert.Equal(t, "httpfromtcp; hit; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, []string{`"v1"`}, o.conditional)
+
+	// Test: A changed resource replaces the entry
+	o.set(response.StatusOK, "changed", map[string]string{"Cache-Control": "max-age=60", "ETag": `"v2"`})
+	resp, body = get(t, h, nil)
+	assert.Equal(t, "changed", body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=200", resp.Header.Get("Cache-Status"))
+	_, body = get(t, h, nil)
+	assert.Equal(t, "changed", body)
+	assert.Equal(t, int32(3), o.calls.Load())
+
+	// Test: The 304's headers update the entry
+	o = newOrigin("body", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	o.set(response.StatusOK, "body", map[string]string{"Cache-Control": "max-age=60", "ETag": `"v1"`})
+	get(t, h, nil)
+	resp, _ = get(t, h, nil)
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, int32(2), o.calls.Load())
+}
+
+func TestRequestDirectives(t *testing.T) {
+	o := newOrigin("body", map[string]string{"Cache-Control": "max-age=60", "ETag": `"v1"`})
+	h := Handler(o.handler, Options{})
+
+	// Test: only-if-cached without an entry is a 504
+	resp, _ := get(t, h, map[string]string{"Cache-Control": "only-if-cached"})
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Zero(t, o.calls.Load())
+
+	get(t, h, nil)
+
+	// Test: no-cache revalidates a fresh entry
+	resp, _ = get(t, h, map[string]string{"Cache-Control": "no-cache"})
+	assert.Equal(t, "httpfromtcp; hit; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	resp, _ = get(t, h, map[string]string{"Pragma": "no-cache"})
+	assert.Equal(t, "httpfromtcp; hit; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, int32(3), o.calls.Load())
+
+	// Test: min-fresh beyond the remaining lifetime revalidates
+	get(t, h, map[string]string{"Cache-Control": "min-fresh=120"})
+	assert.Equal(t, int32(4), o.calls.Load())
+
+	// Test: max-stale accepts a stale entry
+	o = newOrigin("body", map[string]string{"Cache-Control": "max-age=0"})
+	h = Handler(o.handler, Options{})
+	o.set(response.StatusOK, "body", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`})
+	get(t, h, nil)
+	resp, _ = get(t, h, map[string]string{"Cache-Control": "max-stale"})
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, int32(1), o.calls.Load())
+}
+
+func TestClientConditional(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	o := newOrigin("body", map[string]string{"Cache-Control": "max-age=60", "ETag": `"v1"`, "Last-Modified": lastModified})
+	h := Handler(o.handler, Options{})
+
+	// Test: The client's validators do not stop the miss from being stored
+	resp, body := get(t, h, map[string]string{"If-None-Match": `"v1"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "body", body)
+
+	// Test: A hit answers matching validators with 304
+	resp, body = get(t, h, map[string]string{"If-None-Match": `W/"v1"`})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	resp, _ = get(t, h, map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Test: Validators that do not match get the full response
+	resp, body = get(t, h, map[string]string{"If-None-Match": `"v0"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "body", body)
+	assert.Equal(t, int32(1), o.calls.Load())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	o := newOrigin("old", map[string]string{"Cache-Control": "max-age=0, stale-while-revalidate=60"})
+	h := Handler(o.handler, Options{})
+	get(t, h, nil)
+
+	// Test: The stale entry is served while it is refreshed in the background
+	o.set(response.StatusOK, "new", map[string]string{"Cache-Control": "max-age=60"})
+	resp, body := get(t, h, nil)
+	assert.Equal(t, "old", body)
+	assert.Equal(t, "httpfromtcp; hit; detail=stale-while-revalidate", resp.Header.Get("Cache-Status"))
+	require.Eventually(t, func() bool {
+		_, body := get(t, h, nil)
+		return body == "new"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	// Test: Past the window the entry is revalidated in the foreground
+	o = newOrigin("old", map[string]string{"Cache-Control": "max-age=0, stale-while-revalidate=60, must-revalidate"})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	o.set(response.StatusOK, "new", nil)
+	_, body = get(t, h, nil)
+	assert.Equal(t, "new", body)
+}
+
+func TestStaleIfError(t *testing.T) {
+	o := newOrigin("good", map[string]string{"Cache-Control": "max-age=0, stale-if-error=60"})
+	h := Handler(o.handler, Options{})
+	get(t, h, nil)
+
+	// Test: An error is answered with the stale entry
+	o.set(response.StatusServiceUnavailable, "down", nil)
+	resp, body := get(t, h, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "good", body)
+	assert.Equal(t, "httpfromtcp; hit; fwd=stale; fwd-status=503; detail=stale-if-error", resp.Header.Get("Cache-Status"))
+
+	// Test: A handler that writes nothing counts as an error
+	h = Handler(func(w *response.Writer, req *request.Request) {
+		if o.calls.Load() > 0 {
+			o.calls.Add(1)
+			return
+		}
+		o.handler(w, req)
+	}, Options{})
+	o.calls.Store(0)
+	o.set(response.StatusOK, "good", map[string]string{"Cache-Control": "max-age=0, stale-if-error=60"})
+	get(t, h, nil)
+	_, body = get(t, h, nil)
+	assert.Equal(t, "good", body)
+
+	// Test: The request can allow stale-if-error too
+	o = newOrigin("good", map[string]string{"Cache-Control": "max-age=0"})
+	o.set(response.StatusOK, "good", map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`})
+	h = Handler(o.handler, Options{})
+	get(t, h, nil)
+	o.set(response.StatusBadGateway, "down", nil)
+	_, body = get(t, h, map[string]string{"Cache-Control": "stale-if-error=60"})
+	assert.Equal(t, "good", body)
+
+	// Test: Errors pass through without stale-if-error
+	resp, body = get(t, h, nil)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "down", body)
+}
+
+func TestCollapsing(t *testing.T) {
+	o := newOrigin("shared", map[string]string{"Cache-Control": "max-age=60"})
+	o.delay = 50 * time.Millisecond
+	h := Handler(o.handler, Options{})
+
+	// Test: Concurrent misses make one call to the handler
+	var wg sync.WaitGroup
+	statuses := make([]string, 5)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := get(t, h, nil)
+			assert.Equal(t, "shared", body)
+			statuses[i] = resp.Header.Get("Cache-Status")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), o.calls.Load())
+	assert.Contains(t, statuses, "httpfromtcp; fwd=miss")
+	assert.Contains(t, statuses, "httpfromtcp; hit; detail=collapsed")
+
+	// Test: Waiters fetch for themselves when the response is not stored
+	o = newOrigin("private", map[string]string{"Cache-Control": "private"})
+	o.delay = 50 * time.Millisecond
+	h = Handler(o.handler, Options{})
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, body := get(t, h, nil)
+			assert.Equal(t, "private", body)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), o.calls.Load())
+}
+
+func TestInvalidation(t *testing.T) {
+	o := newOrigin("body", map[string]string{"Cache-Control": "max-age=60"})
+	h := Handler(o.handler, Options{})
+	get(t, h, nil)
+
+	// Test: A successful unsafe request invalidates its target
+	do(t, h, "POST", "/resource", nil)
+	get(t, h, nil)
+	assert.Equal(t, int32(3), o.calls.Load())
+
+	// Test: A failed one does not
+	o.set(response.StatusInternalServerError, "", nil)
+	do(t, h, "DELETE", "/resource", nil)
+	o.set(response.StatusOK, "body", map[string]string{"Cache-Control": "max-age=60"})
+	get(t, h, nil)
+	assert.Equal(t, int32(4), o.calls.Load())
+}
+
+func TestParseCacheControl(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Cache-Control", `Max-Age=60, no-cache="Set-Cookie, X-Id", max-age=5, s-maxage=bad`)
+	cc := parseCacheControl(h)
+
+	// Test: Names are case-insensitive and the first occurrence wins
+	d, ok := cc.seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	// Test: Quoted arguments may contain commas
+	assert.Equal(t, "Set-Cookie, X-Id", cc["no-cache"])
+
+	// Test: Invalid arguments count as zero
+	d, ok = cc.seconds("s-maxage")
+	assert.True(t, ok)
+	assert.Zero(t, d)
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+)
+
+// maxHeuristicLifetime caps the freshness guessed from Last-Modified.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// directives holds parsed Cache-Control directives keyed by lowercase name.
+// Directives without an argument map to "".
+type directives map[string]string
+
+func parseCacheControl(h headers.Headers) directives {
+	d := directives{}
+	value, ok := h.Get("Cache-Control")
+	if !ok {
+		// Pragma: no-cache is honored only without Cache-Control (RFC 9111
+		// section 5.4).
+		if pragma, _ := h.Get("Pragma"); hasToken(pragma, "no-cache") {
+			d["no-cache"] = ""
+		}
+		return d
+	}
+	for _, part := range splitList(value) {
+		name, arg, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, dup := d[name]; !dup {
+			d[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds argument. An invalid argument counts as
+// zero, which errs on the side of staleness.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
+
+// splitList splits a comma separated header value, ignoring commas inside
+// quoted strings.
+func splitList(value string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, strings.TrimSpace(value[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(value[start:]))
+}
+
+func hasToken(value, token string) bool {
+	for _, part := range splitList(value) {
+		if strings.EqualFold(part, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// heuristicallyCacheable lists the status codes that may be stored without
+// explicit freshness (RFC 9110 section 15.1).
+func heuristicallyCacheable(statusCode int) bool {
+	switch statusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// storable implements RFC 9111 section 3 for a shared cache.
+func storable(method string, reqHeaders headers.Headers, reqCC directives, statusCode int, h headers.Headers) bool {
+	if method != "GET" || statusCode < 200 || statusCode == 206 || statusCode == 304 {
+		return false
+	}
+	respCC := parseCacheControl(h)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if vary, _ := h.Get("Vary"); hasToken(vary, "*") {
+		return false
+	}
+	if _, ok := reqHeaders.Get("Authorization"); ok {
+		if !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+			return false
+		}
+	}
+
+	_, expires := h.Get("Expires")
+	explicit := expires || respCC.has("max-age") || respCC.has("s-maxage") || respCC.has("public")
+	if !explicit && !heuristicallyCacheable(statusCode) {
+		return false
+	}
+	// A response that is stale from the start is only worth keeping when it
+	// can be revalidated or may be served stale.
+	_, etag := h.Get("ETag")
+	_, lastModified := h.Get("Last-Modified")
+	return etag || lastModified || respCC.has("stale-while-revalidate") || respCC.has("stale-if-error") ||
+		freshnessLifetime(statusCode, h, time.Now()) > 0
+}
+
+// freshnessLifetime implements RFC 9111 section 4.2.1 for a shared cache;
+// fallback is the date used when the response has no valid Date header.
+func freshnessLifetime(statusCode int, h headers.Headers, fallback time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date := headerTime(h, "Date", fallback)
+	if expires, ok := h.Get("Expires"); ok {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return max(t.Sub(date), 0)
+	}
+
+	if !heuristicallyCacheable(statusCode) && !cc.has("public") {
+		return 0
+	}
+	lastModified := headerTime(h, "Last-Modified", time.Time{})
+	if lastModified.IsZero() || !lastModified.Before(date) {
+		return 0
+	}
+	return min(date.Sub(lastModified)/10, maxHeuristicLifetime)
+}
+
+func headerTime(h headers.Headers, name string, fallback time.Time) time.Time {
+	value, ok := h.Get(name)
+	if !ok {
+		return fallback
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
+
+// etagMatches reports whether etag appears in a comma separated list, using
+// the weak comparison function from RFC 9110.
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DiskStore is a Store that keeps each entry in its own file under a
+// directory, so the cache survives restarts. It does not bound its size.
+type DiskStore struct {
+	dir string
+}
+
+// diskEntry is the file format; the key guards against reading an entry
+// written for another key.
+type diskEntry struct {
+	Key   string
+	Entry *Entry
+}
+
+// NewDiskStore returns a DiskStore rooted at dir, creating it if needed.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading cache entry: %v", err)
+		}
+		return nil, false
+	}
+	defer f.Close()
+
+	var stored diskEntry
+	if err := gob.NewDecoder(f).Decode(&stored); err != nil {
+		log.Printf("Error decoding cache entry %s: %v", f.Name(), err)
+		return nil, false
+	}
+	if stored.Key != key || stored.Entry == nil {
+		return nil, false
+	}
+	return stored.Entry, true
+}
+
+// Set writes the entry to a temporary file and renames it into place, so
+// readers never see a partial entry.
+func (s *DiskStore) Set(key string, entry *Entry) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Error writing cache entry: %v", err)
+		return
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		log.Printf("Error writing cache entry: %v", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(diskEntry{Key: key, Entry: entry})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("Error writing cache entry: %v", err)
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Error deleting cache entry: %v", err)
+	}
+}
+
+// path spreads the entries over 256 subdirectories named after the first
+// byte of the key's hash.
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+// recorder is the Framer behind the Writer handed to the wrapped handler.
+// It keeps a copy of the response for the cache and, when forward agrees
+// once the headers are known, streams the response on to the client.
+type recorder struct {
+	client *response.Writer
+	// forward decides whether the response goes to the client and may add
+	// headers to the client's copy. Nothing is forwarded when it is nil.
+	forward func(statusCode int, h headers.Headers) bool
+	maxBody int
+
+	statusCode int
+	header     headers.Headers
+	body       []byte
+	tooLarge   bool
+	trailer    headers.Headers
+	forwarding bool
+	err        error
+}
+
+func (r *recorder) WriteStatusLine(statusCode response.StatusCode) error {
+	r.statusCode = int(statusCode)
+	return nil
+}
+
+func (r *recorder) WriteHeaders(h headers.Headers) error {
+	r.header = cloneHeaders(h)
+	if r.client == nil || r.forward == nil || !r.forward(r.statusCode, h) {
+		return nil
+	}
+	r.forwarding = true
+	if err := r.client.WriteStatusLine(response.StatusCode(r.statusCode)); err != nil {
+		return r.fail(err)
+	}
+	return r.fail(r.client.WriteHeaders(h))
+}
+
+func (r *recorder) WriteBody(p []byte) (int, error) {
+	r.keep(p)
+	if r.forwarding {
+		if _, err := r.client.WriteBody(p); err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+func (r *recorder) WriteChunk(p []byte) (int, error) {
+	r.keep(p)
+	if r.forwarding {
+		if _, err := r.client.WriteChunkedBody(p); err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+func (r *recorder) WriteChunkedBodyDone() (int, error) {
+	if r.forwarding {
+		if _, err := r.client.WriteChunkedBodyDone(); err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	return 0, nil
+}
+
+func (r *recorder) WriteTrailers(h headers.Headers) error {
+	if len(h) > 0 {
+		r.trailer = cloneHeaders(h)
+	}
+	if r.forwarding {
+		return r.fail(r.client.WriteTrailers(h))
+	}
+	return nil
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+// complete reports whether the recorded response can be stored: it was
+// written in full, fit the size limit and has no trailers to lose.
+func (r *recorder) complete() bool {
+	return r.statusCode != 0 && r.header != nil && !r.tooLarge && r.trailer == nil && r.err == nil
+}
+
+func (r *recorder) keep(p []byte) {
+	if r.tooLarge {
+		return
+	}
+	if len(r.body)+len(p) > r.maxBody {
+		r.tooLarge = true
+		r.body = nil
+		return
+	}
+	r.body = append(r.body, p...)
+}
+
+func (r *recorder) fail(err error) error {
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+func cloneHeaders(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for name, value := range h {
+		out[name] = value
+	}
+	return out
+}
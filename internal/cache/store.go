@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+)
+
+// A Store keeps cache entries by key. Implementations must be safe for
+// concurrent use. Entries are never modified after Set; updates store a new
+// entry under the same key.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry)
+	Delete(key string)
+}
+
+// Entry is a stored response.
+type Entry struct {
+	StatusCode int
+	Header     headers.Headers
+	Body       []byte
+	// RequestTime and ResponseTime bracket the exchange that produced the
+	// response, for calculating its age (RFC 9111 section 4.2.3).
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary is set instead of a response on the entry stored under the
+	// primary key of a resource whose responses vary. It names the request
+	// headers that select the variant.
+	Vary []string
+}
+
+// Size approximates the memory the entry occupies.
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Body)) + 64
+	for name, value := range e.Header {
+		size += int64(len(name) + len(value))
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// age implements the age calculation of RFC 9111 section 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	date := headerTime(e.Header, "Date", e.ResponseTime)
+	apparentAge := max(e.ResponseTime.Sub(date), 0)
+
+	var ageValue time.Duration
+	if age, ok := e.Header.Get("Age"); ok {
+		if n, err := strconv.ParseInt(age, 10, 64); err == nil && n >= 0 {
+			ageValue = time.Duration(n) * time.Second
+		}
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// MemoryStore is a Store that keeps entries in memory and evicts the least
+// recently used ones beyond its size limit.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewMemoryStore returns a MemoryStore holding up to maxBytes of entries as
+// measured by Entry.Size.
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry, true
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry) {
+	size := entry.Size() + int64(len(key))
+	if size > s.maxBytes {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+}
+
+// Len returns the number of stored entries.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// remove drops elem; s.mu must be held.
+func (s *MemoryStore) remove(elem *list.Element) {
+	item := s.lru.Remove(elem).(*memoryItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
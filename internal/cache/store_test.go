@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func entryOf(body string) *Entry {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	now := time.Now().Round(0)
+	return &Entry{StatusCode: 200, Header: h, Body: []byte(body), RequestTime: now, ResponseTime: now}
+}
+
+func TestMemoryStore(t *testing.T) {
+	size := entryOf("aaaa").Size() + 1
+	s := NewMemoryStore(3 * size)
+
+	// Test: Get returns what Set stored
+	s.Set("a", entryOf("aaaa"))
+	s.Set("b", entryOf("bbbb"))
+	s.Set("c", entryOf("cccc"))
+	entry, ok := s.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "aaaa", string(entry.Body))
+	assert.Equal(t, 3, s.Len())
+
+	// Test: The least recently used entry is evicted
+	s.Set("d", entryOf("dddd"))
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = s.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// Test: Replacing an entry keeps the accounting right
+	s.Set("a", entryOf("AAAA"))
+	entry, _ = s.Get("a")
+	assert.Equal(t, "AAAA", string(entry.Body))
+	assert.Equal(t, 3, s.Len())
+
+	// Test: Delete
+	s.Delete("a")
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 2, s.Len())
+
+	// Test: Entries larger than the store are not kept
+	s.Set("huge", entryOf(strings.Repeat("x", int(3*size))))
+	_, ok = s.Get("huge")
+	assert.False(t, ok)
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	require.NoError(t, err)
+
+	// Test: Entries round-trip through the file system
+	stored := entryOf("on disk")
+	s.Set("example.com/a", stored)
+	entry, ok := s.Get("example.com/a")
+	require.True(t, ok)
+	assert.Equal(t, stored, entry)
+
+	// Test: Vary markers round-trip
+	s.Set("example.com/v", &Entry{Vary: []string{"accept-language"}})
+	entry, ok = s.Get("example.com/v")
+	require.True(t, ok)
+	assert.Equal(t, []string{"accept-language"}, entry.Vary)
+
+	// Test: Entries survive a new store on the same directory
+	s, err = NewDiskStore(dir)
+	require.NoError(t, err)
+	_, ok = s.Get("example.com/a")
+	assert.True(t, ok)
+
+	// Test: Missing and deleted keys
+	_, ok = s.Get("example.com/missing")
+	assert.False(t, ok)
+	s.Delete("example.com/a")
+	_, ok = s.Get("example.com/a")
+	assert.False(t, ok)
+	s.Delete("example.com/a")
+
+	// Test: A corrupt file is a miss
+	require.NoError(t, os.WriteFile(s.path("example.com/v"), []byte("garbage"), 0o644))
+	_, ok = s.Get("example.com/v")
+	assert.False(t, ok)
+
+	// Test: No temporary files are left behind
+	matches, err := filepath.Glob(filepath.Join(dir, "*", ".tmp-*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestDiskStoreHandler(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	require.NoError(t, err)
+	o := newOrigin("persisted", map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"})
+
+	// Test: A second cache on the same store serves the first one's entries
+	get(t, Handler(o.handler, Options{Store: store}), map[string]string{"Accept-Language": "en"})
+	resp, body := get(t, Handler(o.handler, Options{Store: store}), map[string]string{"Accept-Language": "en"})
+	assert.Equal(t, "persisted", body)
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, int32(1), o.calls.Load())
+}
@@ -0,0 +1,101 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Store selects a certificate by the SNI server name of a handshake. Names
+// come from each leaf's DNS SANs (or its common name when it has none) and may
+// be wildcards. The first certificate is the default.
+type Store struct {
+	certificates []*tls.Certificate
+	byName       map[string]*tls.Certificate
+}
+
+func NewStore(certificates ...tls.Certificate) (*Store, error) {
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates provided")
+	}
+
+	s := &Store{byName: map[string]*tls.Certificate{}}
+	for i := range certificates {
+		certificate := &certificates[i]
+		if certificate.Leaf == nil {
+			if len(certificate.Certificate) == 0 {
+				return nil, fmt.Errorf("certificate %d has no data", i)
+			}
+			leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("parsing certificate %d: %w", i, err)
+			}
+			certificate.Leaf = leaf
+		}
+
+		names := certificate.Leaf.DNSNames
+		if len(names) == 0 && certificate.Leaf.Subject.CommonName != "" {
+			names = []string{certificate.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = certificate
+			}
+		}
+		s.certificates = append(s.certificates, certificate)
+	}
+	return s, nil
+}
+
+func Load(pairs ...KeyPair) (*Store, error) {
+	certificates := make([]tls.Certificate, 0, len(pairs))
+	for _, pair := range pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", pair.CertFile, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return NewStore(certificates...)
+}
+
+// LoadPool reads a PEM bundle of CA certificates, such as the trust anchors
+// for client certificate verification.
+func LoadPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return s.certificates[0], nil
+	}
+
+	if certificate, ok := s.byName[name]; ok {
+		return certificate, nil
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if certificate, ok := s.byName["*."+rest]; ok {
+			return certificate, nil
+		}
+	}
+	return s.certificates[0], nil
+}
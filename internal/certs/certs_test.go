@@ -0,0 +1,48 @@
+package certs
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	defaultCert, err := SelfSigned("localhost", "127.0.0.1")
+	require.NoError(t, err)
+	exampleCert, err := SelfSigned("example.com", "www.example.com")
+	require.NoError(t, err)
+	wildcardCert, err := SelfSigned("*.apps.example.com")
+	require.NoError(t, err)
+
+	store, err := NewStore(defaultCert, exampleCert, wildcardCert)
+	require.NoError(t, err)
+	lookup := func(serverName string) *tls.Certificate {
+		certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err)
+		return certificate
+	}
+
+	// Test: Exact name
+	assert.Equal(t, exampleCert.Leaf, lookup("www.example.com").Leaf)
+
+	// Test: Case and trailing dot
+	assert.Equal(t, exampleCert.Leaf, lookup("Example.COM.").Leaf)
+
+	// Test: Wildcard name
+	assert.Equal(t, wildcardCert.Leaf, lookup("billing.apps.example.com").Leaf)
+
+	// Test: Wildcard only covers one label
+	assert.Equal(t, defaultCert.Leaf, lookup("a.b.apps.example.com").Leaf)
+
+	// Test: No SNI gets the default
+	assert.Equal(t, defaultCert.Leaf, lookup("").Leaf)
+
+	// Test: Unknown name gets the default
+	assert.Equal(t, defaultCert.Leaf, lookup("unknown.test").Leaf)
+
+	// Test: Empty store
+	_, err = NewStore()
+	require.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Reloader serves certificates loaded from files and swaps in new ones when
+// the files change or a signal arrives. Only new handshakes see the new pairs;
+// established connections keep the certificate they negotiated. A pair that
+// fails to load or has expired is rejected and the previous store stays live.
+type Reloader struct {
+	pairs []KeyPair
+	store atomic.Pointer[Store]
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	done   chan struct{}
+	once   sync.Once
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func NewReloader(pairs ...KeyPair) (*Reloader, error) {
+	r := &Reloader{
+		pairs:  pairs,
+		stamps: map[string]fileStamp{},
+		done:   make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.store.Load().GetCertificate(hello)
+}
+
+// Reload loads every pair from disk and atomically replaces the served store.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stamps = r.currentStamps()
+	store, err := Load(r.pairs...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, certificate := range store.certificates {
+		if now.After(certificate.Leaf.NotAfter) {
+			return fmt.Errorf("certificate for %s expired at %s", certificate.Leaf.Subject.CommonName, certificate.Leaf.NotAfter)
+		}
+	}
+
+	r.store.Store(store)
+	return nil
+}
+
+// Watch polls the certificate and key files every interval and reloads when
+// any of them changes.
+func (r *Reloader) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				if r.changed() {
+					r.reloadAndLog("file change")
+				}
+			}
+		}
+	}()
+}
+
+// ReloadOnSignal reloads whenever one of sigs arrives, SIGHUP by default.
+func (r *Reloader) ReloadOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sigs...)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-r.done:
+				return
+			case sig := <-sigChan:
+				r.reloadAndLog(sig.String())
+			}
+		}
+	}()
+}
+
+// Close stops watching files and signals.
+func (r *Reloader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
+
+func (r *Reloader) reloadAndLog(reason string) {
+	if err := r.Reload(); err != nil {
+		log.Printf("Certificate reload after %s failed, keeping previous certificates: %v", reason, err)
+		return
+	}
+	log.Printf("Certificates reloaded after %s", reason)
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.currentStamps()
+	for name, stamp := range current {
+		if r.stamps[name] != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) currentStamps() map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, pair := range r.pairs {
+		for _, name := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+			stamps[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
@@ -0,0 +1,105 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePair(t *testing.T, pair KeyPair, certificate tls.Certificate) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	require.NoError(t, os.WriteFile(pair.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(pair.KeyFile, keyPEM, 0o600))
+}
+
+func served(t *testing.T, r *Reloader) []byte {
+	t.Helper()
+	certificate, err := r.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	require.NoError(t, err)
+	return certificate.Certificate[0]
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	pair := KeyPair{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	first, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	second, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	third, err := SelfSigned("localhost")
+	require.NoError(t, err)
+
+	// Test: Initial load
+	writePair(t, pair, first)
+	r, err := NewReloader(pair)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, first.Certificate[0], served(t, r))
+
+	// Test: Explicit reload picks up the new pair
+	writePair(t, pair, second)
+	require.NoError(t, r.Reload())
+	assert.Equal(t, second.Certificate[0], served(t, r))
+
+	// Test: Mismatched pair is rejected and the old one stays in service
+	certPEM, err := os.ReadFile(pair.CertFile)
+	require.NoError(t, err)
+	writePair(t, pair, third)
+	require.NoError(t, os.WriteFile(pair.CertFile, certPEM, 0o600))
+	require.Error(t, r.Reload())
+	assert.Equal(t, second.Certificate[0], served(t, r))
+
+	// Test: Garbage is rejected
+	require.NoError(t, os.WriteFile(pair.KeyFile, []byte("not a key"), 0o600))
+	require.Error(t, r.Reload())
+	assert.Equal(t, second.Certificate[0], served(t, r))
+
+	// Test: Missing files at startup
+	_, err = NewReloader(KeyPair{CertFile: filepath.Join(dir, "nope.pem"), KeyFile: pair.KeyFile})
+	require.Error(t, err)
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	pair := KeyPair{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	first, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	second, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	third, err := SelfSigned("localhost")
+	require.NoError(t, err)
+
+	writePair(t, pair, first)
+	r, err := NewReloader(pair)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// Test: File change is picked up by polling
+	r.Watch(10 * time.Millisecond)
+	writePair(t, pair, second)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.CertFile, future, future))
+	assert.Eventually(t, func() bool {
+		return string(served(t, r)) == string(second.Certificate[0])
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Test: SIGHUP triggers a reload
+	r.ReloadOnSignal()
+	writePair(t, pair, third)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return string(served(t, r)) == string(third.Certificate[0])
+	}, 2*time.Second, 10*time.Millisecond)
+}
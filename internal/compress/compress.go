@@ -0,0 +1,201 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const defaultMinSize = 1024
+
+type Options struct {
+	// MinSize is the smallest Content-Length worth compressing. Responses
+	// without a Content-Length are always candidates. Zero means 1024; a
+	// negative value compresses bodies of any size.
+	MinSize int
+	// Level is the compression level passed to gzip and zlib. Zero means
+	// gzip.DefaultCompression rather than gzip.NoCompression, which can
+	// not be chosen: leave the handler out to send bodies as they are.
+	Level int
+}
+
+// Handler compresses the responses of next with gzip or deflate, negotiated
+// from the request's Accept-Encoding header.
+func Handler(next server.Handler, opts Options) server.Handler {
+	switch {
+	case opts.MinSize == 0:
+		opts.MinSize = defaultMinSize
+	case opts.MinSize < 0:
+		opts.MinSize = 0
+	}
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+		coding := Negotiate(acceptEncoding, "gzip", "deflate")
+
+		w.OnWriteHeaders(func(statusCode response.StatusCode, h headers.Headers) {
+			if !compressible(statusCode, h) {
+				return
+			}
+			addVary(h, "Accept-Encoding")
+
+			if coding == "" || req.RequestLine.Method == "HEAD" {
+				return
+			}
+			if contentLength, ok := h.Get("Content-Length"); ok {
+				n, err := strconv.Atoi(contentLength)
+				if err == nil && n < opts.MinSize {
+					return
+				}
+			}
+
+			h.Remove("Content-Length")
+			h.Override("Content-Encoding", coding)
+			if transferEncoding, _ := h.Get("Transfer-Encoding"); !strings.Contains(strings.ToLower(transferEncoding), "chunked") {
+				h.Override("Transfer-Encoding", "chunked")
+			}
+			// The compressed bytes differ from the identity representation,
+			// so a strong validator no longer applies.
+			if etag, ok := h.Get("ETag"); ok && !strings.HasPrefix(etag, "W/") {
+				h.Override("ETag", "W/"+etag)
+			}
+			w.EncodeBody(func(dst io.Writer) io.WriteCloser {
+				return newEncoder(coding, dst, opts.Level)
+			})
+		})
+
+		next(w, req)
+	}
+}
+
+// Negotiate picks the offered content coding with the highest q-value in an
+// Accept-Encoding header. Ties go to the earlier offer. It returns "" when
+// none of the offers is acceptable.
+func Negotiate(acceptEncoding string, offers ...string) string {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qvalues[coding] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, offer := range offers {
+		q, ok := qvalues[offer]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > bestQ {
+			best = offer
+			bestQ = q
+		}
+	}
+	return best
+}
+
+func newEncoder(coding string, dst io.Writer, level int) io.WriteCloser {
+	if coding == "deflate" {
+		encoder, err := zlib.NewWriterLevel(dst, level)
+		if err != nil {
+			return zlib.NewWriter(dst)
+		}
+		return encoder
+	}
+	encoder, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		return gzip.NewWriter(dst)
+	}
+	return encoder
+}
+
+func compressible(statusCode response.StatusCode, h headers.Headers) bool {
+	if statusCode < 200 || statusCode == 204 || statusCode == response.StatusPartialContent || statusCode == response.StatusNotModified {
+		return false
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return false
+	}
+	if _, ok := h.Get("Content-Range"); ok {
+		return false
+	}
+	if cacheControl, ok := h.Get("Cache-Control"); ok && strings.Contains(strings.ToLower(cacheControl), "no-transform") {
+		return false
+	}
+
+	contentType, _ := h.Get("Content-Type")
+	return compressibleType(contentType)
+}
+
+// compressibleType reports whether a media type is worth compressing. Most
+// images, audio, video and archives are already compressed.
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+
+	switch mediaType {
+	case "image/svg+xml", "image/x-icon", "image/bmp":
+		return true
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2",
+		"application/pdf", "application/octet-stream",
+		"font/woff", "font/woff2":
+		return false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func addVary(h headers.Headers, name string) {
+	vary, ok := h.Get("Vary")
+	if !ok {
+		h.Set("Vary", name)
+		return
+	}
+	for _, field := range strings.Split(vary, ",") {
+		field = strings.TrimSpace(field)
+		if field == "*" || strings.EqualFold(field, name) {
+			return
+		}
+	}
+	h.Set("Vary", name)
+}
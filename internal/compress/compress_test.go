@@ -0,0 +1,239 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var largeBody = strings.Repeat("<p>hello compression</p>\n", 200)
+
+func serve(t *testing.T, handler server.Handler, method, acceptEncoding string) (*http.Response, []byte) {
+	t.Helper()
+	h := headers.NewHeaders()
+	if acceptEncoding != "" {
+		h.Set("Accept-Encoding", acceptEncoding)
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     h,
+	}
+
+	var buf bytes.Buffer
+	w := &response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func fixedBody(contentType, body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Content-Type", contentType)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(decoded)
+}
+
+func TestNegotiate(t *testing.T) {
+	// Test: Single coding
+	assert.Equal(t, "gzip", Negotiate("gzip", "gzip", "deflate"))
+
+	// Test: Highest q-value wins
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0.5, deflate", "gzip", "deflate"))
+
+	// Test: Ties go to the first offer
+	assert.Equal(t, "gzip", Negotiate("deflate, gzip", "gzip", "deflate"))
+
+	// Test: Wildcard
+	assert.Equal(t, "gzip", Negotiate("*", "gzip", "deflate"))
+
+	// Test: Explicitly refused coding
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0, *;q=0.1", "gzip", "deflate"))
+
+	// Test: Nothing acceptable
+	assert.Equal(t, "", Negotiate("br, identity", "gzip", "deflate"))
+	assert.Equal(t, "", Negotiate("", "gzip", "deflate"))
+
+	// Test: Case and x-gzip alias
+	assert.Equal(t, "gzip", Negotiate("X-GZIP; Q=0.8", "gzip", "deflate"))
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(fixedBody("text/html", largeBody), Options{})
+
+	// Test: Gzip with a stale Content-Length dropped
+	resp, body := serve(t, handler, "GET", "gzip, deflate")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Less(t, len(body), len(largeBody))
+	assert.Equal(t, largeBody, gunzip(t, body))
+
+	// Test: Deflate
+	resp, body = serve(t, handler, "GET", "deflate")
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	reader, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, largeBody, string(decoded))
+
+	// Test: Client without Accept-Encoding still gets Vary
+	resp, body = serve(t, handler, "GET", "")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, largeBody, string(body))
+
+	// Test: HEAD is left alone
+	resp, _ = serve(t, handler, "HEAD", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	// Test: Tiny bodies are skipped
+	resp, body = serve(t, Handler(fixedBody("text/html", "<p>hi</p>"), Options{}), "GET", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "<p>hi</p>", string(body))
+
+	// Test: A negative MinSize compresses them too
+	resp, body = serve(t, Handler(fixedBody("text/html", "<p>hi</p>"), Options{MinSize: -1}), "GET", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "<p>hi</p>", gunzip(t, body))
+
+	// Test: Already compressed types are skipped
+	resp, _ = serve(t, Handler(fixedBody("image/png", largeBody), Options{}), "GET", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+}
+
+func TestHandlerChunked(t *testing.T) {
+	// Test: Chunked body with trailers
+	chunked := func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Remove("Content-Length")
+		h.Override("Content-Type", "text/plain")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first chunk, "))
+		w.WriteChunkedBody([]byte("second chunk"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	}
+	resp, body := serve(t, Handler(chunked, Options{}), "GET", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "first chunk, second chunk", gunzip(t, body))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestDecodeRequests(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		_, encoded := req.Headers.Get("Content-Encoding")
+		body := []byte(fmt.Sprintf("%s|%t", req.Body, encoded))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	handler := DecodeRequests(echo, DecodeOptions{MaxSize: 64})
+	post := func(contentEncoding string, body []byte) (*http.Response, string) {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		if contentEncoding != "" {
+			h.Set("Content-Encoding", contentEncoding)
+		}
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "POST", RequestTarget: "/telemetry", HttpVersion: "1.1"},
+			Headers:     h,
+			Body:        body,
+		}
+		var buf bytes.Buffer
+		handler(&response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}, req)
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(respBody)
+	}
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte(`{"cpu":0.5}`))
+	gzw.Close()
+
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(`{"cpu":0.7}`))
+	zw.Close()
+
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write([]byte(`{"cpu":0.9}`))
+	fw.Close()
+
+	// Test: Gzip body
+	resp, body := post("gzip", gz.Bytes())
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, `{"cpu":0.5}|false`, body)
+
+	// Test: Zlib deflate body
+	_, body = post("deflate", zl.Bytes())
+	assert.Equal(t, `{"cpu":0.7}|false`, body)
+
+	// Test: Raw deflate body
+	_, body = post("deflate", raw.Bytes())
+	assert.Equal(t, `{"cpu":0.9}|false`, body)
+
+	// Test: Identity passes through
+	_, body = post("", []byte("plain"))
+	assert.Equal(t, "plain|false", body)
+
+	// Test: Unsupported coding
+	resp, _ = post("br", []byte("???"))
+	assert.Equal(t, 415, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+
+	// Test: Decoded size limit
+	var bomb bytes.Buffer
+	bw := gzip.NewWriter(&bomb)
+	bw.Write(bytes.Repeat([]byte("a"), 65))
+	bw.Close()
+	resp, _ = post("gzip", bomb.Bytes())
+	assert.Equal(t, 413, resp.StatusCode)
+
+	// Test: Corrupt body
+	resp, _ = post("gzip", []byte("not gzip"))
+	assert.Equal(t, 400, resp.StatusCode)
+}
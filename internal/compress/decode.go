@@ -0,0 +1,140 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const defaultMaxDecodedSize = 10 << 20
+
+// acceptedRequestEncodings is advertised when a request uses a coding we
+// cannot decode.
+const acceptedRequestEncodings = "gzip, deflate"
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content coding")
+	ErrDecodedTooLarge     = errors.New("decoded body exceeds size limit")
+)
+
+type DecodeOptions struct {
+	// MaxSize limits the decoded body size to guard against zip bombs.
+	// Defaults to 10 MiB.
+	MaxSize int64
+}
+
+// DecodeRequests transparently decodes gzip and deflate request bodies before
+// calling next. Unsupported codings are answered with 415, oversized bodies
+// with 413 and corrupt ones with 400.
+func DecodeRequests(next server.Handler, opts DecodeOptions) server.Handler {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = defaultMaxDecodedSize
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		err := DecodeBody(req, opts.MaxSize)
+		switch {
+		case err == nil:
+			next(w, req)
+		case errors.Is(err, ErrUnsupportedEncoding):
+			h := response.GetDefaultHeaders(0)
+			h.Set("Accept-Encoding", acceptedRequestEncodings)
+			w.WriteStatusLine(response.StatusUnsupportedMediaType)
+			w.WriteHeaders(h)
+		case errors.Is(err, ErrDecodedTooLarge):
+			w.WriteStatusLine(response.StatusContentTooLarge)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		default:
+			body := []byte(fmt.Sprintf("Error decoding request body: %v", err))
+			h := response.GetDefaultHeaders(len(body))
+			h.Override("Content-Type", "text/plain")
+			w.WriteStatusLine(response.StatusBadrequest)
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+		}
+	}
+}
+
+// DecodeBody replaces req.Body with its decoded form according to the
+// Content-Encoding header and drops the header. Codings are undone in the
+// reverse of the order they were applied.
+func DecodeBody(req *request.Request, maxSize int64) error {
+	contentEncoding, ok := req.Headers.Get("Content-Encoding")
+	if !ok {
+		return nil
+	}
+
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, coding)
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, coding)
+		}
+	}
+
+	body := req.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoded, err := decode(codings[i], body, maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	req.Body = body
+	req.Headers.Remove("Content-Encoding")
+	if _, ok := req.Headers.Get("Content-Length"); ok {
+		req.Headers.Override("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func decode(coding string, data []byte, maxSize int64) ([]byte, error) {
+	var decoder io.ReadCloser
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		decoder, err = newDeflateReader(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(decoder, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > maxSize {
+		return nil, ErrDecodedTooLarge
+	}
+	return decoded, nil
+}
+
+// newDeflateReader accepts the zlib format required by RFC 9110 as well as
+// the raw deflate streams some clients send instead.
+func newDeflateReader(data []byte) (io.ReadCloser, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header, err := reader.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(reader)
+	}
+	return flate.NewReader(reader), nil
+}
@@ -0,0 +1,410 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/compress"
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const sniffLen = 512
+
+type Options struct {
+	// IndexFile is served for directory requests. Defaults to "index.html".
+	IndexFile string
+	// Listing renders HTML or JSON listings for directories without an index file.
+	Listing bool
+	// SPAFallback serves the root index file for missing paths that have no extension.
+	SPAFallback bool
+	// Precompressed serves a .br or .gz sibling of the requested file to
+	// clients that accept that encoding.
+	Precompressed bool
+}
+
+type sidecar struct {
+	coding string
+	name   string
+	info   fs.FileInfo
+}
+
+var sidecarExtensions = []struct {
+	ext    string
+	coding string
+}{
+	{ext: ".br", coding: "br"},
+	{ext: ".gz", coding: "gzip"},
+}
+
+type fileServer struct {
+	fsys   fs.FS
+	opts   Options
+	hashes sync.Map
+}
+
+type listingEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// Handler serves the files in fsys, using the request target as the path.
+func Handler(fsys fs.FS, opts Options) server.Handler {
+	if opts.IndexFile == "" {
+		opts.IndexFile = "index.html"
+	}
+	s := &fileServer{fsys: fsys, opts: opts}
+	return s.serve
+}
+
+func (s *fileServer) serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Allow", "GET, HEAD")
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		w.WriteHeaders(h)
+		return
+	}
+
+	target, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	urlPath, err := url.PathUnescape(target)
+	if err != nil || !strings.HasPrefix(urlPath, "/") {
+		writeError(w, req, response.StatusBadrequest)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		writeError(w, req, response.StatusNotFound)
+		return
+	}
+
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && s.opts.SPAFallback && path.Ext(name) == "" {
+			s.serveFallback(w, req)
+			return
+		}
+		writeError(w, req, response.StatusNotFound)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(urlPath, "/") {
+			location := target + "/"
+			if query != "" {
+				location += "?" + query
+			}
+			h := response.GetDefaultHeaders(0)
+			h.Set("Location", location)
+			w.WriteStatusLine(response.StatusMovedPermanently)
+			w.WriteHeaders(h)
+			return
+		}
+
+		index := path.Join(name, s.opts.IndexFile)
+		indexInfo, err := fs.Stat(s.fsys, index)
+		if err == nil && !indexInfo.IsDir() {
+			s.serveFile(w, req, index, indexInfo)
+			return
+		}
+		if s.opts.Listing {
+			s.serveListing(w, req, name, urlPath, query)
+			return
+		}
+		writeError(w, req, response.StatusForbidden)
+		return
+	}
+
+	s.serveFile(w, req, name, info)
+}
+
+func (s *fileServer) serveFallback(w *response.Writer, req *request.Request) {
+	info, err := fs.Stat(s.fsys, s.opts.IndexFile)
+	if err != nil || info.IsDir() {
+		writeError(w, req, response.StatusNotFound)
+		return
+	}
+	s.serveFile(w, req, s.opts.IndexFile, info)
+}
+
+func (s *fileServer) serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) {
+	h := headers.NewHeaders()
+	contentName, contentInfo, coding := name, info, ""
+	if s.opts.Precompressed {
+		sidecars := s.sidecars(name)
+		if len(sidecars) > 0 {
+			h.Set("Vary", "Accept-Encoding")
+			offers := make([]string, 0, len(sidecars))
+			for _, sidecar := range sidecars {
+				offers = append(offers, sidecar.coding)
+			}
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+			coding = compress.Negotiate(acceptEncoding, offers...)
+			for _, sidecar := range sidecars {
+				if sidecar.coding == coding {
+					contentName, contentInfo = sidecar.name, sidecar.info
+				}
+			}
+		}
+	}
+
+	f, err := s.fsys.Open(contentName)
+	if err != nil {
+		writeError(w, req, response.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	etag, err := s.etag(contentName, contentInfo)
+	if err != nil {
+		writeError(w, req, response.StatusInternalServerError)
+		return
+	}
+	if coding != "" {
+		// Each encoding is its own representation and needs its own validator.
+		etag = strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+	}
+	modTime := contentInfo.ModTime()
+
+	h.Set("ETag", etag)
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	h.Set("Connection", "close")
+
+	if notModified(req.Headers, etag, modTime) {
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+
+	ctype, err := s.contentType(name)
+	if err != nil {
+		writeError(w, req, response.StatusInternalServerError)
+		return
+	}
+	h.Set("Content-Type", ctype)
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+	}
+
+	if seeker, ok := f.(io.ReadSeeker); ok {
+		w.ServeContent(req, h, seeker, contentInfo.Size())
+		return
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(contentInfo.Size(), 10))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteBody(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sidecars lists the precompressed siblings of name, in order of preference.
+func (s *fileServer) sidecars(name string) []sidecar {
+	var found []sidecar
+	for _, candidate := range sidecarExtensions {
+		sidecarName := name + candidate.ext
+		info, err := fs.Stat(s.fsys, sidecarName)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		found = append(found, sidecar{coding: candidate.coding, name: sidecarName, info: info})
+	}
+	return found
+}
+
+func (s *fileServer) serveListing(w *response.Writer, req *request.Request, name, urlPath, query string) {
+	dirEntries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		writeError(w, req, response.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]listingEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, listingEntry{
+			Name:    dirEntry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   dirEntry.IsDir(),
+		})
+	}
+
+	var body []byte
+	contentType := "text/html; charset=utf-8"
+	if wantsJSON(req, query) {
+		body, err = json.Marshal(entries)
+		if err != nil {
+			writeError(w, req, response.StatusInternalServerError)
+			return
+		}
+		contentType = "application/json"
+	} else {
+		body = listingHTML(urlPath, entries)
+	}
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", contentType)
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+// etag derives a validator from the modification time and size, falling back
+// to a content hash for file systems without modification times (embed.FS).
+func (s *fileServer) etag(name string, info fs.FileInfo) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
+	}
+
+	key := fmt.Sprintf("%s:%d", name, info.Size())
+	if etag, ok := s.hashes.Load(key); ok {
+		return etag.(string), nil
+	}
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16])
+	s.hashes.Store(key, etag)
+	return etag, nil
+}
+
+func notModified(reqHeaders headers.Headers, etag string, modTime time.Time) bool {
+	if ifNoneMatch, ok := reqHeaders.Get("If-None-Match"); ok {
+		return etagMatches(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince, ok := reqHeaders.Get("If-Modified-Since")
+	if !ok || modTime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether etag appears in a comma separated list, using
+// the weak comparison function from RFC 9110.
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// contentType picks a media type from the extension of name, sniffing the
+// first bytes of the file when the extension is unknown.
+func (s *fileServer) contentType(name string) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sniff := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(sniff[:n]), nil
+}
+
+func wantsJSON(req *request.Request, query string) bool {
+	values, err := url.ParseQuery(query)
+	if err == nil && values.Get("format") != "" {
+		return values.Get("format") == "json"
+	}
+	accept, _ := req.Headers.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func listingHTML(urlPath string, entries []listingEntry) []byte {
+	var buf bytes.Buffer
+	title := html.EscapeString("Index of " + urlPath)
+	fmt.Fprintf(&buf, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n    <ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.IsDir {
+			name += "/"
+		}
+		link := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&buf, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(name))
+	}
+	buf.WriteString("    </ul>\n  </body>\n</html>\n")
+	return buf.Bytes()
+}
+
+func writeError(w *response.Writer, req *request.Request, statusCode response.StatusCode) {
+	body := response.GetStatusLine(statusCode)
+	body = bytes.TrimPrefix(bytes.TrimSpace(body), []byte("HTTP/1.1 "))
+	body = append(body, '\n')
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/plain")
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
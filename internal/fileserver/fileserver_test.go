@@ -0,0 +1,293 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+var testFS = fstest.MapFS{
+	"index.html":      {Data: []byte("<h1>home</h1>"), ModTime: modTime},
+	"app.js":          {Data: []byte("console.log(1)"), ModTime: modTime},
+	"notes":           {Data: []byte("plain text with no extension"), ModTime: modTime},
+	"docs/readme.txt": {Data: []byte("read me"), ModTime: modTime},
+	"empty/.keep":     {Data: []byte{}, ModTime: modTime},
+}
+
+func serve(t *testing.T, handler server.Handler, method, target string, reqHeaders map[string]string) (*http.Response, string) {
+	t.Helper()
+	h := headers.NewHeaders()
+	for name, value := range reqHeaders {
+		h.Set(name, value)
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+	}
+
+	var buf bytes.Buffer
+	handler(&response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}, req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServeFile(t *testing.T) {
+	handler := Handler(testFS, Options{})
+
+	// Test: Content-Type from extension
+	resp, body := serve(t, handler, "GET", "/app.js", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "console.log(1)", body)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+	assert.Equal(t, "14", resp.Header.Get("Content-Length"))
+	assert.Equal(t, modTime.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+
+	// Test: Content-Type from sniffing
+	resp, _ = serve(t, handler, "GET", "/notes", nil)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Test: HEAD has headers but no body
+	resp, body = serve(t, handler, "HEAD", "/app.js", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "", body)
+
+	// Test: Index file resolution
+	resp, body = serve(t, handler, "GET", "/", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", body)
+
+	// Test: Directory without trailing slash redirects
+	resp, _ = serve(t, handler, "GET", "/docs?x=1", nil)
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/docs/?x=1", resp.Header.Get("Location"))
+
+	// Test: Directory without index and listings disabled
+	resp, _ = serve(t, handler, "GET", "/docs/", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Missing file
+	resp, _ = serve(t, handler, "GET", "/missing.css", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Path traversal stays inside the root
+	resp, body = serve(t, handler, "GET", "/../../docs/readme.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "read me", body)
+
+	// Test: Unsupported method
+	resp, _ = serve(t, handler, "POST", "/app.js", nil)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestConditionalGet(t *testing.T) {
+	handler := Handler(testFS, Options{})
+	resp, _ := serve(t, handler, "GET", "/app.js", nil)
+	etag := resp.Header.Get("ETag")
+
+	// Test: Matching If-None-Match
+	resp, body := serve(t, handler, "GET", "/app.js", map[string]string{"If-None-Match": `"other", ` + etag})
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// Test: Weak If-None-Match
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"If-None-Match": "W/" + etag})
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: Mismatched If-None-Match wins over If-Modified-Since
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{
+		"If-None-Match":     `"other"`,
+		"If-Modified-Since": modTime.Format(http.TimeFormat),
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: If-Modified-Since not modified
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)})
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: If-Modified-Since modified
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Content hash ETag without modification times
+	noTimes := fstest.MapFS{"a.txt": {Data: []byte("same")}, "b.txt": {Data: []byte("same")}}
+	handler = Handler(noTimes, Options{})
+	respA, _ := serve(t, handler, "GET", "/a.txt", nil)
+	respB, _ := serve(t, handler, "GET", "/b.txt", nil)
+	assert.Equal(t, respA.Header.Get("ETag"), respB.Header.Get("ETag"))
+	assert.Empty(t, respA.Header.Get("Last-Modified"))
+}
+
+func TestListingAndFallback(t *testing.T) {
+	handler := Handler(testFS, Options{Listing: true, SPAFallback: true})
+
+	// Test: HTML listing
+	resp, body := serve(t, handler, "GET", "/docs/", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, body, `<a href="readme.txt">readme.txt</a>`)
+
+	// Test: JSON listing via Accept
+	resp, body = serve(t, handler, "GET", "/docs/", map[string]string{"Accept": "application/json"})
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var entries []listingEntry
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "readme.txt", entries[0].Name)
+	assert.Equal(t, int64(7), entries[0].Size)
+
+	// Test: JSON listing via query
+	resp, _ = serve(t, handler, "GET", "/empty/?format=json", nil)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	// Test: SPA fallback for client side routes
+	resp, body = serve(t, handler, "GET", "/users/42", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", body)
+
+	// Test: No SPA fallback for missing assets
+	resp, _ = serve(t, handler, "GET", "/missing.css", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestRanges(t *testing.T) {
+	handler := Handler(testFS, Options{})
+	resp, _ := serve(t, handler, "GET", "/app.js", nil)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	// Test: Single range
+	resp, body := serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=0-6"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "console", body)
+	assert.Equal(t, "bytes 0-6/14", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "7", resp.Header.Get("Content-Length"))
+
+	// Test: Suffix range
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=-3"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "(1)", body)
+
+	// Test: Open ended range past the end is clamped
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=8-100"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "log(1)", body)
+	assert.Equal(t, "bytes 8-13/14", resp.Header.Get("Content-Range"))
+
+	// Test: Multiple ranges
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=0-6, 12-13"})
+	assert.Equal(t, 206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Contains(t, part.Header.Get("Content-Type"), "javascript")
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	assert.Equal(t, []string{"bytes 0-6/14 console", "bytes 12-13/14 1)"}, parts)
+
+	// Test: Unsatisfiable range
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=100-"})
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "bytes */14", resp.Header.Get("Content-Range"))
+
+	// Test: Malformed range is ignored
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "lines=1-2"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "console.log(1)", body)
+
+	// Test: Matching If-Range ETag
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=0-0", "If-Range": etag})
+	assert.Equal(t, 206, resp.StatusCode)
+
+	// Test: Stale If-Range ETag sends the full representation
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=0-0", "If-Range": `"stale"`})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "console.log(1)", body)
+
+	// Test: Matching If-Range date
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"Range": "bytes=0-0", "If-Range": modTime.Format(http.TimeFormat)})
+	assert.Equal(t, 206, resp.StatusCode)
+}
+
+func TestPrecompressed(t *testing.T) {
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte("console.log(1)"))
+	gzw.Close()
+	fsys := fstest.MapFS{
+		"app.js":    {Data: []byte("console.log(1)"), ModTime: modTime},
+		"app.js.gz": {Data: gz.Bytes(), ModTime: modTime},
+		"plain.css": {Data: []byte("body {}"), ModTime: modTime},
+	}
+	handler := Handler(fsys, Options{Precompressed: true})
+
+	// Test: Sidecar served to clients accepting gzip
+	resp, body := serve(t, handler, "GET", "/app.js", map[string]string{"Accept-Encoding": "gzip, deflate"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+	assert.Equal(t, strconv.Itoa(gz.Len()), resp.Header.Get("Content-Length"))
+	assert.Equal(t, gz.String(), body)
+	gzipETag := resp.Header.Get("ETag")
+
+	// Test: Identity for clients without gzip
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Accept-Encoding": "br"})
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, "console.log(1)", body)
+	assert.NotEqual(t, gzipETag, resp.Header.Get("ETag"))
+
+	// Test: Conditional request against the encoded representation
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": gzipETag})
+	assert.Equal(t, 304, resp.StatusCode)
+	resp, _ = serve(t, handler, "GET", "/app.js", map[string]string{"If-None-Match": gzipETag})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Ranges apply to the encoded bytes
+	resp, body = serve(t, handler, "GET", "/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-1"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes 0-1/%d", gz.Len()), resp.Header.Get("Content-Range"))
+	assert.Equal(t, gz.String()[:2], body)
+
+	// Test: Files without sidecars have no Vary
+	resp, _ = serve(t, handler, "GET", "/plain.css", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Empty(t, resp.Header.Get("Vary"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+}
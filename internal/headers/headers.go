@@ -15,6 +15,10 @@ func NewHeaders() Headers {
 
 const crlf = "\r\n"
 
+// lineSeparator joins the values of fields that cannot be combined into
+// one line. No field value may contain it.
+const lineSeparator = "\n"
+
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
@@ -47,21 +51,45 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	if value == "" {
 		return 0, false, fmt.Errorf("Header contains only whitespaes")
 	}
+	if !validValue(value) {
+		return 0, false, fmt.Errorf("invalid header value for %s", key)
+	}
 
 	h.Set(key, value)
 	return idx + 2, false, nil
 }
 
+// Set adds value to key, joining it to an existing value with ", ".
+// Set-Cookie values cannot be joined that way (RFC 9110 section 5.3), so
+// they are kept apart and written as separate lines; see SplitLines.
+// Values containing CR, LF or NUL are dropped, as they could start a field
+// line of their own.
 func (h Headers) Set(key, value string) {
+	if !validValue(value) {
+		return
+	}
 	key = strings.ToLower(key)
 	existingValue, ok := h[key]
-	if ok {
-		h[key] = existingValue + ", " + value
-	} else {
+	switch {
+	case !ok:
 		h[key] = value
+	case key == "set-cookie":
+		h[key] = existingValue + lineSeparator + value
+	default:
+		h[key] = existingValue + ", " + value
 	}
 }
 
+// SplitLines splits the value of key as stored in Headers into the field
+// lines to write: one per Set-Cookie value, and the value itself for other
+// fields.
+func SplitLines(key, value string) []string {
+	if strings.ToLower(key) != "set-cookie" {
+		return []string{value}
+	}
+	return strings.Split(value, lineSeparator)
+}
+
 func (h Headers) Get(key string) (string, bool) {
 	key = strings.ToLower(key)
 	value, ok := h[key]
@@ -78,6 +106,12 @@ func (h Headers) Remove(key string) {
 	delete(h, key)
 }
 
+// validValue reports whether value is free of the CR, LF and NUL that RFC
+// 9110 section 5.5 forbids in field values.
+func validValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
+
 func isTchar(r rune) bool {
 	if unicode.IsLetter(r) || unicode.IsNumber(r) {
 		return true
@@ -75,4 +75,32 @@ func TestParse(t *testing.T) {
 	assert.Equal(t, "lane-loves-go, prime-loves-zig", headers["set-person"])
 	assert.Equal(t, 29, n)
 	assert.False(t, done)
+
+	// Test: Bare LF or CR in a value
+	for _, data := range []string{"X-Injected: a\nSet-Cookie: b=2\r\n\r\n", "X-Injected: a\rb\r\n\r\n"} {
+		headers = NewHeaders()
+		n, done, err = headers.Parse([]byte(data))
+		require.Error(t, err)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Repeated fields are combined
+	h := NewHeaders()
+	h.Set("Vary", "Accept")
+	h.Set("Vary", "Accept-Encoding")
+	assert.Equal(t, []string{"Accept, Accept-Encoding"}, SplitLines("vary", h["vary"]))
+
+	// Test: Set-Cookie values are kept apart
+	h.Set("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Set("Set-Cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, SplitLines("set-cookie", h["set-cookie"]))
+
+	// Test: Values that would start a new line are dropped
+	h.Set("X-Reflected", "a\r\nSet-Cookie: evil=1")
+	h.Set("X-Reflected", "ok\x00")
+	_, ok := h.Get("X-Reflected")
+	assert.False(t, ok)
 }
@@ -0,0 +1,195 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	frameHeaderLen = 9
+
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	maxWindowSize       = 1<<31 - 1
+	defaultWindowSize   = 65535
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// ConnectionError ends the whole connection with a GOAWAY.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError resets a single stream with RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.StreamID, e.Code, e.Reason)
+}
+
+// ReadFrame reads one frame, rejecting payloads larger than maxSize.
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxSize {
+		return nil, ConnectionError{Code: ErrCodeFrameSize, Reason: fmt.Sprintf("frame of %d bytes exceeds %d", length, maxSize)}
+	}
+
+	frame := &Frame{
+		Type:     FrameType(header[3]),
+		Flags:    Flags(header[4]),
+		StreamID: binary.BigEndian.Uint32(header[5:]) & maxWindowSize,
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func WriteFrame(w io.Writer, frame *Frame) error {
+	length := len(frame.Payload)
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+length)
+	buf[0] = byte(length >> 16)
+	buf[1] = byte(length >> 8)
+	buf[2] = byte(length)
+	buf[3] = byte(frame.Type)
+	buf[4] = byte(frame.Flags)
+	binary.BigEndian.PutUint32(buf[5:], frame.StreamID&maxWindowSize)
+	buf = append(buf, frame.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// stripPadding removes the pad length byte and padding from DATA and
+// HEADERS payloads.
+func stripPadding(frame *Frame) ([]byte, error) {
+	payload := frame.Payload
+	if !frame.Flags.Has(FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "padded frame without pad length"}
+	}
+	padLength := int(payload[0])
+	payload = payload[1:]
+	if padLength > len(payload) {
+		return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "padding exceeds payload"}
+	}
+	return payload[:len(payload)-padLength], nil
+}
+
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnectionError{Code: ErrCodeFrameSize, Reason: "SETTINGS payload is not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func settingsPayload(settings []Setting) []byte {
+	payload := make([]byte, 0, len(settings)*6)
+	for _, setting := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(setting.ID))
+		payload = binary.BigEndian.AppendUint32(payload, setting.Value)
+	}
+	return payload
+}
+
+func uint32Payload(values ...uint32) []byte {
+	payload := make([]byte, 0, len(values)*4)
+	for _, value := range values {
+		payload = binary.BigEndian.AppendUint32(payload, value)
+	}
+	return payload
+}
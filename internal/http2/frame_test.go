@@ -0,0 +1,46 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameCodec(t *testing.T) {
+	// Test: Round trip
+	var buf bytes.Buffer
+	frame := &Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 3, Payload: []byte("block")}
+	require.NoError(t, WriteFrame(&buf, frame))
+	assert.Equal(t, []byte{0, 0, 5, 1, 5, 0, 0, 0, 3}, buf.Bytes()[:frameHeaderLen])
+	got, err := ReadFrame(&buf, defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, frame, got)
+
+	// Test: Reserved stream bit is ignored
+	got, err = ReadFrame(bytes.NewReader([]byte{0, 0, 0, 4, 0, 0x80, 0, 0, 0}), defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), got.StreamID)
+
+	// Test: Oversized frame
+	_, err = ReadFrame(bytes.NewReader([]byte{0, 0x40, 1, 0, 0, 0, 0, 0, 1}), defaultMaxFrameSize)
+	var connErr ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, ErrCodeFrameSize, connErr.Code)
+
+	// Test: Padding
+	payload, err := stripPadding(&Frame{Type: FrameData, Flags: FlagPadded, Payload: []byte{2, 'h', 'i', 0, 0}})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), payload)
+	_, err = stripPadding(&Frame{Type: FrameData, Flags: FlagPadded, Payload: []byte{5, 'h', 'i'}})
+	assert.ErrorAs(t, err, &connErr)
+
+	// Test: Settings
+	settings := []Setting{{ID: SettingInitialWindowSize, Value: 10}, {ID: SettingMaxFrameSize, Value: 1 << 20}}
+	parsed, err := parseSettings(settingsPayload(settings))
+	require.NoError(t, err)
+	assert.Equal(t, settings, parsed)
+	_, err = parseSettings([]byte{0, 1, 0})
+	assert.ErrorAs(t, err, &connErr)
+}
@@ -0,0 +1,319 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// entryOverhead is the per entry size overhead from RFC 7541 section 4.1.
+const entryOverhead = 32
+
+// maxStringLength bounds a single decoded name or value.
+const maxStringLength = 64 << 10
+
+var (
+	ErrInvalidEncoding = errors.New("hpack: invalid encoding")
+	// ErrHeaderListTooLarge is returned for blocks that decode to more than
+	// the Decoder's header list size limit.
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+)
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are encoded as never indexed.
+	Sensitive bool
+}
+
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + entryOverhead)
+}
+
+var (
+	staticByField = map[HeaderField]int{}
+	staticByName  = map[string]int{}
+)
+
+func init() {
+	for i, field := range staticTable {
+		index := i + 1
+		if _, ok := staticByField[field]; !ok {
+			staticByField[field] = index
+		}
+		if _, ok := staticByName[field.Name]; !ok {
+			staticByName[field.Name] = index
+		}
+	}
+}
+
+// Decoder decodes header blocks for one connection, keeping the dynamic
+// table in sync with the peer's encoder.
+type Decoder struct {
+	dynamic []HeaderField // newest first
+	size    uint32
+	maxSize uint32
+	// allowedMaxSize is the SETTINGS_HEADER_TABLE_SIZE we advertised; the
+	// peer may not grow the table beyond it.
+	allowedMaxSize uint32
+	// maxListSize bounds the decoded size of a block, or 0 for no limit.
+	maxListSize uint32
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{maxSize: maxTableSize, allowedMaxSize: maxTableSize}
+}
+
+// SetMaxHeaderListSize limits the decoded size of a block, counted as in
+// SETTINGS_MAX_HEADER_LIST_SIZE, so that a small block of indexed fields
+// cannot expand without bound. Zero means no limit.
+func (d *Decoder) SetMaxHeaderListSize(size uint32) {
+	d.maxListSize = size
+}
+
+// Decode decodes a complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint64
+	appendField := func(field HeaderField) error {
+		listSize += uint64(field.size())
+		if d.maxListSize > 0 && listSize > uint64(d.maxListSize) {
+			return ErrHeaderListTooLarge
+		}
+		fields = append(fields, field)
+		return nil
+	}
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field.
+			index, rest, err := readInteger(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.at(index)
+			if err != nil {
+				return nil, err
+			}
+			if err := appendField(field); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing.
+			field, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(field)
+			if err := appendField(field); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, only allowed before the first field.
+			if sawField {
+				return nil, fmt.Errorf("%w: table size update after header field", ErrInvalidEncoding)
+			}
+			size, rest, err := readInteger(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d exceeds limit %d", ErrInvalidEncoding, size, d.allowedMaxSize)
+			}
+			d.maxSize = uint32(size)
+			d.evict()
+			block = rest
+		default:
+			// Literal without indexing (0000) or never indexed (0001).
+			field, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			field.Sensitive = b&0x10 != 0
+			if err := appendField(field); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+		}
+	}
+
+	return fields, nil
+}
+
+func (d *Decoder) at(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, fmt.Errorf("%w: index 0", ErrInvalidEncoding)
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	dynamicIndex := index - uint64(len(staticTable)) - 1
+	if dynamicIndex >= uint64(len(d.dynamic)) {
+		return HeaderField{}, fmt.Errorf("%w: index %d out of range", ErrInvalidEncoding, index)
+	}
+	return d.dynamic[dynamicIndex], nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	index, rest, err := readInteger(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	var field HeaderField
+	if index == 0 {
+		field.Name, rest, err = readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	} else {
+		indexed, err := d.at(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		field.Name = indexed.Name
+	}
+
+	field.Value, rest, err = readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return field, rest, nil
+}
+
+func (d *Decoder) add(field HeaderField) {
+	field.Sensitive = false
+	if field.size() > d.maxSize {
+		// An entry larger than the table empties it (RFC 7541 section 4.4).
+		d.dynamic = nil
+		d.size = 0
+		return
+	}
+	d.dynamic = append([]HeaderField{field}, d.dynamic...)
+	d.size += field.size()
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// Encode encodes fields as a header block. It never adds entries to the
+// dynamic table, so it needs no per connection state: fields are sent as
+// static table references or literals without indexing.
+func Encode(fields []HeaderField) []byte {
+	var dst []byte
+	for _, field := range fields {
+		if !field.Sensitive {
+			if index, ok := staticByField[HeaderField{Name: field.Name, Value: field.Value}]; ok {
+				dst = appendInteger(dst, 0x80, 7, uint64(index))
+				continue
+			}
+		}
+
+		first := byte(0x00)
+		if field.Sensitive {
+			first = 0x10
+		}
+		if index, ok := staticByName[field.Name]; ok {
+			dst = appendInteger(dst, first, 4, uint64(index))
+		} else {
+			dst = appendInteger(dst, first, 4, 0)
+			dst = appendString(dst, field.Name)
+		}
+		dst = appendString(dst, field.Value)
+	}
+	return dst
+}
+
+// readInteger decodes an integer with an N-bit prefix (RFC 7541 section 5.1).
+func readInteger(block []byte, prefix uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrInvalidEncoding)
+	}
+	mask := uint64(1)<<prefix - 1
+	value := uint64(block[0]) & mask
+	block = block[1:]
+	if value < mask {
+		return value, block, nil
+	}
+
+	var shift uint
+	for {
+		if len(block) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", ErrInvalidEncoding)
+		}
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+		shift += 7
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrInvalidEncoding)
+		}
+	}
+}
+
+func appendInteger(dst []byte, first byte, prefix uint8, value uint64) []byte {
+	mask := uint64(1)<<prefix - 1
+	if value < mask {
+		return append(dst, first|byte(value))
+	}
+	dst = append(dst, first|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+func readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrInvalidEncoding)
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := readInteger(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrInvalidEncoding)
+	}
+	if length > maxStringLength {
+		return "", nil, fmt.Errorf("%w: string of %d bytes is too long", ErrInvalidEncoding, length)
+	}
+
+	data := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(data), rest, nil
+	}
+	decoded, err := huffmanDecode(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return decoded, rest, nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	if encodedLen := huffmanEncodedLen(s); encodedLen < len(s) {
+		dst = appendInteger(dst, 0x80, 7, uint64(encodedLen))
+		return huffmanAppend(dst, s)
+	}
+	dst = appendInteger(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
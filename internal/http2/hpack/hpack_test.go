@@ -0,0 +1,142 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecodeRequests(t *testing.T) {
+	// Examples from RFC 7541 Appendix C.4, decoded on one connection.
+	d := NewDecoder(4096)
+
+	// Test: First request
+	fields, err := d.Decode(mustHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+	assert.Equal(t, uint32(57), d.size)
+
+	// Test: Second request references the dynamic table
+	fields, err = d.Decode(mustHex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+	assert.Equal(t, uint32(110), d.size)
+
+	// Test: Third request
+	fields, err = d.Decode(mustHex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":path", Value: "/index.html"}, fields[2])
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+	assert.Equal(t, uint32(164), d.size)
+}
+
+func TestDecodeEviction(t *testing.T) {
+	// Examples from RFC 7541 Appendix C.6, with a 256 byte table.
+	d := NewDecoder(256)
+
+	// Test: First response
+	fields, err := d.Decode(mustHex(t, "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}, fields)
+	assert.Equal(t, uint32(222), d.size)
+
+	// Test: Second response evicts the oldest entry
+	fields, err = d.Decode(mustHex(t, "4883 640e ff c1 c0 bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":status", Value: "307"}, fields[0])
+	assert.Equal(t, HeaderField{Name: "location", Value: "https://www.example.com"}, fields[3])
+	assert.Equal(t, uint32(222), d.size)
+
+	// Test: Table size update above the advertised limit
+	_, err = d.Decode([]byte{0x3f, 0xe1, 0x1f})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// Test: Index zero
+	_, err := NewDecoder(4096).Decode([]byte{0x80})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Index beyond the tables
+	_, err = NewDecoder(4096).Decode([]byte{0xbe})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Truncated string
+	_, err = NewDecoder(4096).Decode([]byte{0x40, 0x05, 'a'})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Huffman padding that is not all ones
+	_, err = NewDecoder(4096).Decode([]byte{0x00, 0x81, 0x00, 0x00})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Table size update after a field
+	_, err = NewDecoder(4096).Decode([]byte{0x82, 0x20})
+	require.ErrorIs(t, err, ErrInvalidEncoding)
+}
+
+func TestDecodeHeaderListSize(t *testing.T) {
+	// A 4000 byte field added to the dynamic table, then indexed 1000
+	// times: a 5 KB block that decodes to 4 MB.
+	block := append([]byte{0x40, 0x01, 'x', 0x7f, 0xa1, 0x1e}, strings.Repeat("a", 4000)...)
+	block = append(block, bytes.Repeat([]byte{0xbe}, 1000)...)
+
+	// Test: Unlimited by default
+	fields, err := NewDecoder(4096).Decode(block)
+	require.NoError(t, err)
+	assert.Len(t, fields, 1001)
+
+	// Test: The limit counts the decoded fields
+	d := NewDecoder(4096)
+	d.SetMaxHeaderListSize(1 << 20)
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "418"},
+		{Name: "content-type", Value: "text/html"},
+		{Name: "x-custom-header", Value: strings.Repeat("long value ", 20)},
+		{Name: "set-cookie", Value: "session=secret", Sensitive: true},
+		{Name: "x-empty", Value: ""},
+	}
+
+	// Test: Encoded fields decode to the same list
+	block := Encode(fields)
+	assert.Equal(t, byte(0x88), block[0])
+	decoded, err := NewDecoder(4096).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Huffman coding of every byte value
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	decodedString, err := huffmanDecode(huffmanAppend(nil, all.String()))
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), decodedString)
+}
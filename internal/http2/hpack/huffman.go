@@ -0,0 +1,91 @@
+package hpack
+
+import (
+	"fmt"
+	"strings"
+)
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   byte
+	leaf     bool
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for symbol, code := range huffmanCodes {
+		node := root
+		length := huffmanCodeLens[symbol]
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &huffmanNode{}
+			}
+			node = node.children[bit]
+		}
+		node.leaf = true
+		node.symbol = byte(symbol)
+	}
+	return root
+}
+
+// huffmanDecode decodes a Huffman coded string. Padding must be a prefix of
+// the EOS code (all ones) shorter than a byte, and EOS itself is an error.
+func huffmanDecode(data []byte) (string, error) {
+	var out strings.Builder
+	node := huffmanRoot
+	depth := 0
+	allOnes := true
+
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			node = node.children[bit]
+			if node == nil {
+				return "", fmt.Errorf("%w: invalid Huffman code", ErrInvalidEncoding)
+			}
+			depth++
+			allOnes = allOnes && bit == 1
+			if node.leaf {
+				out.WriteByte(node.symbol)
+				node = huffmanRoot
+				depth = 0
+				allOnes = true
+			}
+		}
+	}
+
+	if depth > 7 || !allOnes {
+		return "", fmt.Errorf("%w: invalid Huffman padding", ErrInvalidEncoding)
+	}
+	return out.String(), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanAppend(dst []byte, s string) []byte {
+	var acc uint64
+	var bits uint
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLens[s[i]] | uint64(huffmanCodes[s[i]])
+		bits += uint(huffmanCodeLens[s[i]])
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		// Pad with the most significant bits of EOS.
+		acc = acc<<(8-bits) | (1<<(8-bits) - 1)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,1005 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/http2/hpack"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+// Preface is the client connection preface that opens every HTTP/2
+// connection (RFC 9113 section 3.4).
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultMaxHeaderListSize    = 1 << 20
+	defaultMaxBodySize          = 10 << 20
+	headerTableSize             = 4096
+)
+
+type Handler func(w *response.Writer, req *request.Request)
+
+type ConnOptions struct {
+	// Reader replaces conn for reads, for example a bufio.Reader that still
+	// holds the peeked preface.
+	Reader io.Reader
+	// TLS is the negotiated TLS state, exposed on every request.
+	TLS *tls.ConnectionState
+	// Upgrade is an HTTP/1.1 request that asked for "Upgrade: h2c". It is
+	// served as stream 1, and UpgradeSettings holds its decoded
+	// HTTP2-Settings header.
+	Upgrade         *request.Request
+	UpgradeSettings []byte
+	// MaxConcurrentStreams defaults to 100.
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize bounds each header block, both as received and as
+	// decoded, 1 MiB by default. A peer that exceeds it is sent GOAWAY.
+	MaxHeaderListSize uint32
+	// MaxBodySize bounds each request body, 10 MiB by default. A stream
+	// whose body exceeds it is reset with CANCEL.
+	MaxBodySize int64
+	// Context is the parent of every stream's request context, which is
+	// also cancelled when the stream is reset or the connection ends. When
+	// it is done the connection is shut down: the peer is sent GOAWAY,
+	// new streams are refused, and the connection is closed once the
+	// running handlers have returned.
+	Context context.Context
+	// RequestTimeout, when positive, sets a deadline on request contexts.
+	RequestTimeout time.Duration
+}
+
+type streamState int
+
+const (
+	streamOpen streamState = iota
+	streamHalfClosedRemote
+	streamClosed
+)
+
+type stream struct {
+	id            uint32
+	state         streamState
+	req           *request.Request
+	sendWindow    int64
+	recvWindow    int64
+	contentLength int64
+	reset         bool
+	cancel        context.CancelFunc
+}
+
+type serverConn struct {
+	conn    net.Conn
+	reader  io.Reader
+	handler Handler
+	opts    ConnOptions
+	decoder *hpack.Decoder
+
+	// writeMu serializes frames on the wire, keeping a HEADERS frame and
+	// its CONTINUATION frames together.
+	writeMu sync.Mutex
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	lastStreamID      uint32
+	goingAway         bool
+	closed            bool
+	// running counts the handlers that have not returned.
+	running int
+
+	// recvWindow is the connection's receive window, used only by the
+	// read loop.
+	recvWindow int64
+
+	// Header blocks in progress, continued by CONTINUATION frames.
+	continuationStream uint32
+	headerBlock        []byte
+	headerEndStream    bool
+	headerStart        time.Time
+
+	ctx context.Context
+}
+
+// HasPreface reports whether the buffered connection starts with the HTTP/2
+// preface. It peeks one byte at a time so an HTTP/1.1 request shorter than
+// the preface does not block it.
+func HasPreface(br *bufio.Reader) bool {
+	for n := 1; n <= len(Preface); n++ {
+		peeked, err := br.Peek(n)
+		if err != nil || peeked[n-1] != Preface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// IsUpgradeRequest reports whether req asks to switch to cleartext HTTP/2 and
+// returns its decoded HTTP2-Settings.
+func IsUpgradeRequest(req *request.Request) ([]byte, bool) {
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	if !hasToken(upgrade, "h2c") || !hasToken(connection, "upgrade") || !hasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	encoded, ok := req.Headers.Get("HTTP2-Settings")
+	if !ok || strings.Contains(encoded, ",") {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
+
+// ServeConn serves HTTP/2 on conn until the peer goes away or the
+// connection fails. The client preface has not been consumed yet.
+func ServeConn(conn net.Conn, handler Handler, opts ConnOptions) error {
+	if opts.Reader == nil {
+		opts.Reader = conn
+	}
+	if opts.MaxConcurrentStreams == 0 {
+		opts.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	if opts.MaxHeaderListSize == 0 {
+		opts.MaxHeaderListSize = defaultMaxHeaderListSize
+	}
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = defaultMaxBodySize
+	}
+
+	sc := &serverConn{
+		conn:              conn,
+		reader:            opts.Reader,
+		handler:           handler,
+		opts:              opts,
+		decoder:           hpack.NewDecoder(headerTableSize),
+		streams:           map[uint32]*stream{},
+		sendWindow:        defaultWindowSize,
+		recvWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.decoder.SetMaxHeaderListSize(opts.MaxHeaderListSize)
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	ctx, cancel := context.WithCancel(opts.Context)
+	sc.ctx = ctx
+	stop := context.AfterFunc(opts.Context, sc.shutdown)
+
+	err := sc.serve()
+	stop()
+	cancel()
+
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	for sc.running > 0 {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (sc *serverConn) serve() error {
+	err := sc.writeFrame(&Frame{Type: FrameSettings, Payload: settingsPayload([]Setting{
+		{ID: SettingMaxConcurrentStreams, Value: sc.opts.MaxConcurrentStreams},
+		{ID: SettingEnablePush, Value: 0},
+		{ID: SettingMaxHeaderListSize, Value: sc.opts.MaxHeaderListSize},
+	})})
+	if err != nil {
+		return err
+	}
+
+	if sc.opts.Upgrade != nil {
+		settings, err := parseSettings(sc.opts.UpgradeSettings)
+		if err != nil {
+			return err
+		}
+		if err := sc.applySettings(settings); err != nil {
+			return err
+		}
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(sc.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != Preface {
+		return sc.goAway(ConnectionError{Code: ErrCodeProtocol, Reason: "invalid connection preface"})
+	}
+
+	if sc.opts.Upgrade != nil {
+		sc.startUpgradedStream()
+	}
+
+	first := true
+	for {
+		frame, err := ReadFrame(sc.reader, defaultMaxFrameSize)
+		if err != nil {
+			var connErr ConnectionError
+			if errors.As(err, &connErr) {
+				return sc.goAway(connErr)
+			}
+			return err
+		}
+		if first && frame.Type != FrameSettings {
+			return sc.goAway(ConnectionError{Code: ErrCodeProtocol, Reason: "first frame is not SETTINGS"})
+		}
+		first = false
+
+		err = sc.processFrame(frame)
+		var streamErr StreamError
+		var connErr ConnectionError
+		switch {
+		case errors.As(err, &streamErr):
+			sc.resetStream(streamErr)
+		case errors.As(err, &connErr):
+			return sc.goAway(connErr)
+		case err != nil:
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) processFrame(frame *Frame) error {
+	if sc.continuationStream != 0 && (frame.Type != FrameContinuation || frame.StreamID != sc.continuationStream) {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "expected CONTINUATION frame"}
+	}
+
+	switch frame.Type {
+	case FrameSettings:
+		return sc.processSettings(frame)
+	case FrameHeaders:
+		return sc.processHeaders(frame)
+	case FrameContinuation:
+		return sc.processContinuation(frame)
+	case FrameData:
+		return sc.processData(frame)
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(frame)
+	case FramePing:
+		return sc.processPing(frame)
+	case FrameRSTStream:
+		return sc.processRSTStream(frame)
+	case FrameGoAway:
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case FramePriority:
+		if frame.StreamID == 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "PRIORITY on stream 0"}
+		}
+		if len(frame.Payload) != 5 {
+			return StreamError{StreamID: frame.StreamID, Code: ErrCodeFrameSize, Reason: "PRIORITY payload is not 5 bytes"}
+		}
+		return nil
+	case FramePushPromise:
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "clients cannot push"}
+	default:
+		// Unknown frame types are ignored (RFC 9113 section 4.1).
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(frame *Frame) error {
+	if frame.StreamID != 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "SETTINGS on a stream"}
+	}
+	if frame.Flags.Has(FlagAck) {
+		if len(frame.Payload) != 0 {
+			return ConnectionError{Code: ErrCodeFrameSize, Reason: "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(frame.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, setting := range settings {
+		switch setting.ID {
+		case SettingEnablePush:
+			if setting.Value > 1 {
+				return ConnectionError{Code: ErrCodeProtocol, Reason: "invalid ENABLE_PUSH"}
+			}
+		case SettingInitialWindowSize:
+			if setting.Value > maxWindowSize {
+				return ConnectionError{Code: ErrCodeFlowControl, Reason: "INITIAL_WINDOW_SIZE too large"}
+			}
+			delta := int64(setting.Value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(setting.Value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnectionError{Code: ErrCodeFlowControl, Reason: "stream window overflow"}
+				}
+			}
+		case SettingMaxFrameSize:
+			if setting.Value < defaultMaxFrameSize || setting.Value > maxFrameSizeLimit {
+				return ConnectionError{Code: ErrCodeProtocol, Reason: "invalid MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameSize = setting.Value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(frame *Frame) error {
+	id := frame.StreamID
+	if id == 0 || id%2 == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("HEADERS on invalid stream %d", id)}
+	}
+
+	payload, err := stripPadding(frame)
+	if err != nil {
+		return err
+	}
+	if frame.Flags.Has(FlagPriority) {
+		if len(payload) < 5 {
+			return ConnectionError{Code: ErrCodeFrameSize, Reason: "HEADERS priority truncated"}
+		}
+		payload = payload[5:]
+	}
+
+	sc.mu.Lock()
+	st, exists := sc.streams[id]
+	sc.mu.Unlock()
+
+	if exists {
+		// A second HEADERS frame carries trailers and must end the stream.
+		if st.state != streamOpen {
+			return StreamError{StreamID: id, Code: ErrCodeStreamClosed, Reason: "HEADERS on closed stream"}
+		}
+		if !frame.Flags.Has(FlagEndStream) {
+			return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "trailers without END_STREAM"}
+		}
+	} else if id <= sc.lastStreamID {
+		return ConnectionError{Code: ErrCodeStreamClosed, Reason: fmt.Sprintf("HEADERS on closed stream %d", id)}
+	}
+
+	if err := sc.checkHeaderBlock(len(payload)); err != nil {
+		return err
+	}
+	sc.headerBlock = append(sc.headerBlock[:0], payload...)
+	sc.headerStart = time.Now()
+	sc.headerEndStream = frame.Flags.Has(FlagEndStream)
+	if !frame.Flags.Has(FlagEndHeaders) {
+		sc.continuationStream = id
+		return nil
+	}
+	return sc.endHeaders(id)
+}
+
+func (sc *serverConn) processContinuation(frame *Frame) error {
+	if sc.continuationStream == 0 || frame.StreamID != sc.continuationStream {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "unexpected CONTINUATION"}
+	}
+	if err := sc.checkHeaderBlock(len(sc.headerBlock) + len(frame.Payload)); err != nil {
+		return err
+	}
+	sc.headerBlock = append(sc.headerBlock, frame.Payload...)
+	if !frame.Flags.Has(FlagEndHeaders) {
+		return nil
+	}
+	sc.continuationStream = 0
+	return sc.endHeaders(frame.StreamID)
+}
+
+// checkHeaderBlock refuses header blocks of size bytes beyond
+// MaxHeaderListSize, so endless CONTINUATION frames cannot exhaust memory.
+// An encoded block is rarely larger than the list it decodes to.
+func (sc *serverConn) checkHeaderBlock(size int) error {
+	if size > int(sc.opts.MaxHeaderListSize) {
+		return ConnectionError{Code: ErrCodeEnhanceYourCalm, Reason: "header block too large"}
+	}
+	return nil
+}
+
+func (sc *serverConn) endHeaders(id uint32) error {
+	fields, err := sc.decoder.Decode(sc.headerBlock)
+	if errors.Is(err, hpack.ErrHeaderListTooLarge) {
+		return ConnectionError{Code: ErrCodeEnhanceYourCalm, Reason: err.Error()}
+	}
+	if err != nil {
+		return ConnectionError{Code: ErrCodeCompression, Reason: err.Error()}
+	}
+
+	sc.mu.Lock()
+	st, exists := sc.streams[id]
+	if exists {
+		sc.mu.Unlock()
+		// Request trailers are decoded to keep the HPACK state in sync and
+		// then merged into the request headers.
+		for _, field := range fields {
+			if strings.HasPrefix(field.Name, ":") {
+				return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "pseudo-header in trailers"}
+			}
+			if !validFieldValue(field.Value) {
+				return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "invalid value for " + field.Name}
+			}
+			st.req.Headers.Set(field.Name, field.Value)
+		}
+		return sc.endRequest(st)
+	}
+
+	sc.lastStreamID = id
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return StreamError{StreamID: id, Code: ErrCodeRefusedStream, Reason: "connection is going away"}
+	}
+	// A reset stream stays in streams until its handler returns, so HEADERS
+	// followed by RST_STREAM cannot start handlers without bound.
+	active := len(sc.streams)
+	sc.mu.Unlock()
+
+	if uint32(active) >= sc.opts.MaxConcurrentStreams {
+		return StreamError{StreamID: id, Code: ErrCodeRefusedStream, Reason: "too many concurrent streams"}
+	}
+
+	req, err := requestFromFields(fields)
+	if err != nil {
+		return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: err.Error()}
+	}
+	req.TLS = sc.opts.TLS
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.LocalAddr = sc.conn.LocalAddr().String()
+	req.Timing.Start = sc.headerStart
+	req.Timing.HeadersDone = time.Now()
+
+	st = &stream{id: id, state: streamOpen, req: req, recvWindow: defaultWindowSize, contentLength: -1}
+	if contentLength, ok := req.Headers.Get("Content-Length"); ok {
+		st.contentLength, err = strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || st.contentLength < 0 {
+			return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "invalid content-length"}
+		}
+		if st.contentLength > sc.opts.MaxBodySize {
+			return StreamError{StreamID: id, Code: ErrCodeCancel, Reason: "body too large"}
+		}
+	}
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+
+	if sc.headerEndStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(frame *Frame) error {
+	id := frame.StreamID
+	if id == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "DATA on stream 0"}
+	}
+
+	// The whole payload counts against the receive windows, padding
+	// included. Request bodies are buffered whole, so the windows are
+	// replenished as soon as the data arrives; the connection's even for
+	// streams that are gone.
+	size := int64(len(frame.Payload))
+	if size > sc.recvWindow {
+		return ConnectionError{Code: ErrCodeFlowControl, Reason: "DATA exceeds the connection window"}
+	}
+	sc.recvWindow -= size
+	if size > 0 {
+		if err := sc.writeFrame(&Frame{Type: FrameWindowUpdate, Payload: uint32Payload(uint32(size))}); err != nil {
+			return err
+		}
+		sc.recvWindow += size
+	}
+
+	sc.mu.Lock()
+	st, exists := sc.streams[id]
+	sc.mu.Unlock()
+	if !exists {
+		if id > sc.lastStreamID {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "DATA on idle stream"}
+		}
+		return StreamError{StreamID: id, Code: ErrCodeStreamClosed, Reason: "DATA on closed stream"}
+	}
+	if st.state != streamOpen {
+		return StreamError{StreamID: id, Code: ErrCodeStreamClosed, Reason: "DATA after END_STREAM"}
+	}
+
+	if size > st.recvWindow {
+		return StreamError{StreamID: id, Code: ErrCodeFlowControl, Reason: "DATA exceeds the stream window"}
+	}
+	st.recvWindow -= size
+	payload, err := stripPadding(frame)
+	if err != nil {
+		return err
+	}
+	if int64(len(st.req.Body)+len(payload)) > sc.opts.MaxBodySize {
+		return StreamError{StreamID: id, Code: ErrCodeCancel, Reason: "body too large"}
+	}
+
+	if size > 0 && !frame.Flags.Has(FlagEndStream) {
+		if err := sc.writeFrame(&Frame{Type: FrameWindowUpdate, StreamID: id, Payload: uint32Payload(uint32(size))}); err != nil {
+			return err
+		}
+		st.recvWindow += size
+	}
+
+	st.req.Body = append(st.req.Body, payload...)
+	if st.contentLength >= 0 && int64(len(st.req.Body)) > st.contentLength {
+		return StreamError{StreamID: id, Code: ErrCodeProtocol, Reason: "body exceeds content-length"}
+	}
+
+	if frame.Flags.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.contentLength >= 0 && int64(len(st.req.Body)) != st.contentLength {
+		return StreamError{StreamID: st.id, Code: ErrCodeProtocol, Reason: "body does not match content-length"}
+	}
+	// An upgraded request was read, body and all, over HTTP/1.1.
+	if st.req.Timing.BodyDone.IsZero() {
+		st.req.Timing.BodyDone = time.Now()
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if sc.opts.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(sc.ctx, sc.opts.RequestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(sc.ctx)
+	}
+	st.req = st.req.WithContext(ctx)
+
+	sc.mu.Lock()
+	st.state = streamHalfClosedRemote
+	st.cancel = cancel
+	sc.running++
+	sc.mu.Unlock()
+
+	go sc.runHandler(st)
+	return nil
+}
+
+func (sc *serverConn) startUpgradedStream() {
+	req := sc.opts.Upgrade
+	req.RequestLine.HttpVersion = "2"
+	for _, name := range []string{"Connection", "Upgrade", "HTTP2-Settings", "Keep-Alive"} {
+		req.Headers.Remove(name)
+	}
+
+	st := &stream{id: 1, req: req, recvWindow: defaultWindowSize, contentLength: -1}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[1] = st
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+
+	sc.endRequest(st)
+}
+
+func (sc *serverConn) runHandler(st *stream) {
+	defer func() {
+		sc.mu.Lock()
+		delete(sc.streams, st.id)
+		sc.running--
+		sc.cond.Broadcast()
+		sc.mu.Unlock()
+	}()
+	defer st.cancel()
+
+	w := &response.Writer{Framer: &streamFramer{sc: sc, stream: st}}
+	w.Timing.Timing = st.req.Timing
+	w.Timing.HandlerStart = time.Now()
+	sc.handler(w, st.req)
+	w.Timing.HandlerEnd = time.Now()
+	if err := w.Finish(); err != nil {
+		log.Printf("Error finishing HTTP/2 stream %d: %v", st.id, err)
+	}
+}
+
+func (sc *serverConn) processWindowUpdate(frame *Frame) error {
+	if len(frame.Payload) != 4 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "WINDOW_UPDATE payload is not 4 bytes"}
+	}
+	increment := int64(uint32(frame.Payload[0]&0x7f)<<24 | uint32(frame.Payload[1])<<16 | uint32(frame.Payload[2])<<8 | uint32(frame.Payload[3]))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if frame.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "zero WINDOW_UPDATE"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return ConnectionError{Code: ErrCodeFlowControl, Reason: "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st, ok := sc.streams[frame.StreamID]
+	if !ok {
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{StreamID: frame.StreamID, Code: ErrCodeProtocol, Reason: "zero WINDOW_UPDATE"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return StreamError{StreamID: frame.StreamID, Code: ErrCodeFlowControl, Reason: "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(frame *Frame) error {
+	if frame.StreamID != 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "PING on a stream"}
+	}
+	if len(frame.Payload) != 8 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "PING payload is not 8 bytes"}
+	}
+	if frame.Flags.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(&Frame{Type: FramePing, Flags: FlagAck, Payload: frame.Payload})
+}
+
+func (sc *serverConn) processRSTStream(frame *Frame) error {
+	if frame.StreamID == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "RST_STREAM on stream 0"}
+	}
+	if len(frame.Payload) != 4 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "RST_STREAM payload is not 4 bytes"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st, ok := sc.streams[frame.StreamID]; ok {
+		sc.closeStream(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) resetStream(streamErr StreamError) error {
+	sc.mu.Lock()
+	if st, ok := sc.streams[streamErr.StreamID]; ok {
+		sc.closeStream(st)
+	}
+	if streamErr.StreamID > sc.lastStreamID {
+		sc.lastStreamID = streamErr.StreamID
+	}
+	sc.mu.Unlock()
+
+	return sc.writeFrame(&Frame{Type: FrameRSTStream, StreamID: streamErr.StreamID, Payload: uint32Payload(uint32(streamErr.Code))})
+}
+
+// closeStream marks a reset stream closed and cancels its handler, with
+// sc.mu held. A stream whose handler has not started is forgotten at once;
+// otherwise runHandler forgets it when the handler returns.
+func (sc *serverConn) closeStream(st *stream) {
+	st.reset = true
+	st.state = streamClosed
+	if st.cancel != nil {
+		st.cancel()
+	} else {
+		delete(sc.streams, st.id)
+	}
+	sc.cond.Broadcast()
+}
+
+func (sc *serverConn) goAway(connErr ConnectionError) error {
+	sc.mu.Lock()
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := uint32Payload(lastStreamID, uint32(connErr.Code))
+	payload = append(payload, connErr.Reason...)
+	sc.writeFrame(&Frame{Type: FrameGoAway, Payload: payload})
+	return connErr
+}
+
+// shutdown stops the connection once its context is done: GOAWAY tells
+// the peer which streams will still be served, later ones are refused,
+// and the connection is closed when the running handlers have returned,
+// which ends the read loop.
+func (sc *serverConn) shutdown() {
+	sc.goAway(ConnectionError{Code: ErrCodeNo, Reason: "server shutting down"})
+
+	sc.mu.Lock()
+	for sc.running > 0 && !sc.closed {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) writeFrame(frame *Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return WriteFrame(sc.conn, frame)
+}
+
+// writeHeaderBlock sends block as a HEADERS frame followed by as many
+// CONTINUATION frames as the peer's frame size requires.
+func (sc *serverConn) writeHeaderBlock(streamID uint32, block []byte, endStream bool) error {
+	sc.mu.Lock()
+	maxFrameSize := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	frameType := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		fragment := block
+		if len(fragment) > maxFrameSize {
+			fragment = fragment[:maxFrameSize]
+		}
+		block = block[len(fragment):]
+
+		var flags Flags
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(sc.conn, &Frame{Type: frameType, Flags: flags, StreamID: streamID, Payload: fragment}); err != nil {
+			return err
+		}
+		frameType = FrameContinuation
+	}
+	return nil
+}
+
+// writeData sends p as DATA frames, waiting for the peer to open the
+// connection and stream flow control windows as needed.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+	for first := true; first || len(p) > 0; first = false {
+		n := 0
+		if len(p) > 0 {
+			var err error
+			n, err = sc.reserveWindow(st, len(p))
+			if err != nil {
+				return err
+			}
+		}
+
+		var flags Flags
+		if endStream && n == len(p) {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(&Frame{Type: FrameData, Flags: flags, StreamID: st.id, Payload: p[:n]}); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (sc *serverConn) reserveWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		if sc.closed {
+			return 0, net.ErrClosed
+		}
+		if st.reset {
+			return 0, StreamError{StreamID: st.id, Code: ErrCodeCancel, Reason: "stream reset by peer"}
+		}
+		available := min(sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize), int64(want))
+		if available > 0 {
+			sc.sendWindow -= available
+			st.sendWindow -= available
+			return int(available), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// requestFromFields builds a request from a decoded header block,
+// validating the pseudo-headers and field names (RFC 9113 section 8).
+func requestFromFields(fields []hpack.HeaderField) (*request.Request, error) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+	}
+
+	var scheme, authority string
+	var cookies []string
+	regular := false
+	for _, field := range fields {
+		if !validFieldValue(field.Value) {
+			return nil, fmt.Errorf("invalid value for %s", field.Name)
+		}
+		if strings.HasPrefix(field.Name, ":") {
+			if regular {
+				return nil, errors.New("pseudo-header after regular header")
+			}
+			switch field.Name {
+			case ":method":
+				req.RequestLine.Method = field.Value
+			case ":path":
+				req.RequestLine.RequestTarget = field.Value
+			case ":scheme":
+				scheme = field.Value
+			case ":authority":
+				authority = field.Value
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", field.Name)
+			}
+			continue
+		}
+
+		regular = true
+		if field.Name != strings.ToLower(field.Name) {
+			return nil, fmt.Errorf("uppercase header name %s", field.Name)
+		}
+		switch field.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection-specific header %s", field.Name)
+		case "te":
+			if field.Value != "trailers" {
+				return nil, errors.New("TE other than trailers")
+			}
+		case "cookie":
+			cookies = append(cookies, field.Value)
+			continue
+		}
+		req.Headers.Set(field.Name, field.Value)
+	}
+
+	if len(cookies) > 0 {
+		req.Headers.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	if req.RequestLine.Method == "" || req.RequestLine.RequestTarget == "" || scheme == "" {
+		return nil, errors.New("missing required pseudo-header")
+	}
+	if _, ok := req.Headers.Get("Host"); !ok && authority != "" {
+		req.Headers.Set("Host", authority)
+	}
+	return req, nil
+}
+
+// validFieldValue reports whether value is free of CR, LF and NUL and of
+// leading and trailing whitespace (RFC 9113 section 8.2.1).
+func validFieldValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00") && strings.Trim(value, " \t") == value
+}
+
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamFramer writes a response.Writer's output as HEADERS and DATA frames
+// on one stream.
+type streamFramer struct {
+	sc         *serverConn
+	stream     *stream
+	statusCode response.StatusCode
+	sentHeader bool
+	ended      bool
+}
+
+func (f *streamFramer) WriteStatusLine(statusCode response.StatusCode) error {
+	f.statusCode = statusCode
+	return nil
+}
+
+func (f *streamFramer) WriteHeaders(h headers.Headers) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(f.statusCode))}}
+	fields = append(fields, responseFields(h)...)
+	f.sentHeader = true
+	return f.sc.writeHeaderBlock(f.stream.id, hpack.Encode(fields), false)
+}
+
+func (f *streamFramer) WriteBody(p []byte) (int, error) {
+	if err := f.sc.writeData(f.stream, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *streamFramer) WriteChunk(p []byte) (int, error) {
+	return f.WriteBody(p)
+}
+
+func (f *streamFramer) WriteChunkedBodyDone() (int, error) {
+	return 0, nil
+}
+
+func (f *streamFramer) WriteTrailers(h headers.Headers) error {
+	f.ended = true
+	fields := responseFields(h)
+	if len(fields) == 0 {
+		return f.sc.writeData(f.stream, nil, true)
+	}
+	return f.sc.writeHeaderBlock(f.stream.id, hpack.Encode(fields), true)
+}
+
+func (f *streamFramer) Close() error {
+	if f.ended {
+		return nil
+	}
+	f.ended = true
+	f.sc.mu.Lock()
+	reset := f.stream.reset
+	f.sc.mu.Unlock()
+	if reset {
+		return nil
+	}
+	if !f.sentHeader {
+		// The handler wrote no response; HTTP/1.1 would close the
+		// connection, so reset the stream instead.
+		return f.sc.writeFrame(&Frame{Type: FrameRSTStream, StreamID: f.stream.id, Payload: uint32Payload(uint32(ErrCodeInternal))})
+	}
+	return f.sc.writeData(f.stream, nil, true)
+}
+
+// responseFields converts response headers to HTTP/2 fields, dropping the
+// connection-specific ones HTTP/2 forbids.
+func responseFields(h headers.Headers) []hpack.HeaderField {
+	fields := make([]hpack.HeaderField, 0, len(h))
+	for name, value := range h {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			continue
+		}
+		for _, line := range headers.SplitLines(name, value) {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: line, Sensitive: name == "set-cookie" || name == "authorization"})
+		}
+	}
+	return fields
+}
+
+// UpgradeResponse is written before switching an "Upgrade: h2c" request to
+// HTTP/2.
+var UpgradeResponse = []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
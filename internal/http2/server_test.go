@@ -0,0 +1,471 @@
+package http2
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/http2/hpack"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+	if req.RequestLine.RequestTarget == "/big" {
+		body = []byte(strings.Repeat("x", 100))
+	}
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *hpack.Decoder
+	// settings are the server's initial settings.
+	settings []Setting
+}
+
+// newTestClient serves one connection with handler and sends the preface
+// followed by settings.
+func newTestClient(t *testing.T, handler Handler, settings ...Setting) *testClient {
+	t.Helper()
+	return newTestClientOptions(t, handler, ConnOptions{MaxConcurrentStreams: 2}, settings...)
+}
+
+// newTestClientOptions is newTestClient with the server's options.
+func newTestClientOptions(t *testing.T, handler Handler, opts ConnOptions, settings ...Setting) *testClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ServeConn(conn, handler, opts)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: conn, decoder: hpack.NewDecoder(headerTableSize)}
+	_, err = conn.Write([]byte(Preface))
+	require.NoError(t, err)
+	c.write(&Frame{Type: FrameSettings, Payload: settingsPayload(settings)})
+
+	// Server settings, then the ack of ours.
+	frame := c.read()
+	require.Equal(t, FrameSettings, frame.Type)
+	assert.False(t, frame.Flags.Has(FlagAck))
+	c.settings, err = parseSettings(frame.Payload)
+	require.NoError(t, err)
+	c.write(&Frame{Type: FrameSettings, Flags: FlagAck})
+	frame = c.read()
+	require.Equal(t, FrameSettings, frame.Type)
+	assert.True(t, frame.Flags.Has(FlagAck))
+	return c
+}
+
+func (c *testClient) write(frame *Frame) {
+	c.t.Helper()
+	require.NoError(c.t, WriteFrame(c.conn, frame))
+}
+
+func (c *testClient) read() *Frame {
+	c.t.Helper()
+	frame, err := ReadFrame(c.conn, maxFrameSizeLimit)
+	require.NoError(c.t, err)
+	return frame
+}
+
+// readSkipping reads the next frame that is not a WINDOW_UPDATE.
+func (c *testClient) readSkipping() *Frame {
+	c.t.Helper()
+	for {
+		frame := c.read()
+		if frame.Type != FrameWindowUpdate {
+			return frame
+		}
+	}
+}
+
+func (c *testClient) request(streamID uint32, method, path string, flags Flags) {
+	c.t.Helper()
+	block := hpack.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost"},
+	})
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndHeaders | flags, StreamID: streamID, Payload: block})
+}
+
+// response reads the headers and body of one stream.
+func (c *testClient) response(streamID uint32) (map[string]string, string) {
+	c.t.Helper()
+	frame := c.readSkipping()
+	require.Equal(c.t, FrameHeaders, frame.Type)
+	require.Equal(c.t, streamID, frame.StreamID)
+	fields, err := c.decoder.Decode(frame.Payload)
+	require.NoError(c.t, err)
+	h := map[string]string{}
+	for _, field := range fields {
+		h[field.Name] = field.Value
+	}
+
+	var body strings.Builder
+	for !frame.Flags.Has(FlagEndStream) {
+		frame = c.readSkipping()
+		require.Equal(c.t, FrameData, frame.Type)
+		body.Write(frame.Payload)
+	}
+	return h, body.String()
+}
+
+func TestServeConn(t *testing.T) {
+	// Test: GET
+	c := newTestClient(t, echoHandler)
+	c.request(1, "GET", "/hello", FlagEndStream)
+	h, body := c.response(1)
+	assert.Equal(t, "200", h[":status"])
+	assert.Equal(t, "text/html", h["content-type"])
+	assert.NotContains(t, h, "connection")
+	assert.Equal(t, "GET /hello ", body)
+
+	// Test: POST body split across DATA frames
+	c.request(3, "POST", "/echo", 0)
+	c.write(&Frame{Type: FrameData, StreamID: 3, Payload: []byte("hello ")})
+	c.write(&Frame{Type: FrameData, Flags: FlagPadded | FlagEndStream, StreamID: 3, Payload: []byte{1, 'h', '2', 0}})
+	_, body = c.response(3)
+	assert.Equal(t, "POST /echo hello h2", body)
+
+	// Test: PING is acknowledged
+	c.write(&Frame{Type: FramePing, Payload: []byte("12345678")})
+	frame := c.readSkipping()
+	assert.Equal(t, FramePing, frame.Type)
+	assert.True(t, frame.Flags.Has(FlagAck))
+	assert.Equal(t, []byte("12345678"), frame.Payload)
+
+	// Test: Header block split with CONTINUATION
+	block := hpack.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/continued"},
+	})
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndStream, StreamID: 5, Payload: block[:3]})
+	c.write(&Frame{Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 5, Payload: block[3:]})
+	_, body = c.response(5)
+	assert.Equal(t, "GET /continued ", body)
+
+	// Test: Malformed request resets the stream
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 7, Payload: hpack.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "connection", Value: "close"},
+	})})
+	frame = c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type)
+	assert.Equal(t, uint32(7), frame.StreamID)
+	assert.Equal(t, uint32Payload(uint32(ErrCodeProtocol)), frame.Payload)
+
+	// Test: Interleaved frames during a header block end the connection
+	c.write(&Frame{Type: FrameHeaders, StreamID: 9, Payload: block[:3]})
+	c.write(&Frame{Type: FramePing, Payload: []byte("12345678")})
+	frame = c.readSkipping()
+	assert.Equal(t, FrameGoAway, frame.Type)
+	assert.Equal(t, uint32Payload(7, uint32(ErrCodeProtocol)), frame.Payload[:8])
+}
+
+func TestFlowControl(t *testing.T) {
+	// Test: Response respects the peer's initial stream window
+	c := newTestClient(t, echoHandler, Setting{ID: SettingInitialWindowSize, Value: 30})
+	c.request(1, "GET", "/big", FlagEndStream)
+	frame := c.readSkipping()
+	require.Equal(t, FrameHeaders, frame.Type)
+	frame = c.readSkipping()
+	require.Equal(t, FrameData, frame.Type)
+	assert.Len(t, frame.Payload, 30)
+
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := ReadFrame(c.conn, maxFrameSizeLimit)
+	require.Error(t, err, "server must wait for WINDOW_UPDATE")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	c.write(&Frame{Type: FrameWindowUpdate, StreamID: 1, Payload: uint32Payload(100)})
+	var body strings.Builder
+	for !frame.Flags.Has(FlagEndStream) {
+		frame = c.readSkipping()
+		require.Equal(t, FrameData, frame.Type)
+		body.Write(frame.Payload)
+	}
+	assert.Equal(t, 70, body.Len())
+
+	// Test: Window updates are validated
+	c.write(&Frame{Type: FrameWindowUpdate, Payload: uint32Payload(maxWindowSize)})
+	frame = c.readSkipping()
+	assert.Equal(t, FrameGoAway, frame.Type)
+	assert.Equal(t, uint32Payload(1, uint32(ErrCodeFlowControl)), frame.Payload[:8])
+}
+
+func TestHeaderListSize(t *testing.T) {
+	opts := ConnOptions{MaxHeaderListSize: 1024}
+	requestBlock := hpack.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "localhost"},
+	})
+
+	// Test: CONTINUATION frames cannot grow a block past the limit
+	c := newTestClientOptions(t, echoHandler, opts)
+	c.write(&Frame{Type: FrameHeaders, StreamID: 1, Payload: make([]byte, 600)})
+	c.write(&Frame{Type: FrameContinuation, StreamID: 1, Payload: make([]byte, 600)})
+	frame := c.readSkipping()
+	assert.Equal(t, FrameGoAway, frame.Type)
+	assert.Equal(t, uint32Payload(0, uint32(ErrCodeEnhanceYourCalm)), frame.Payload[:8])
+
+	// Test: Nor can a small block that decodes to a large list. A 500
+	// byte field is added to the dynamic table, then indexed 10 times.
+	c = newTestClientOptions(t, echoHandler, opts)
+	block := append(requestBlock, 0x40, 0x01, 'x', 0x7f, 0xf5, 0x02)
+	block = append(block, strings.Repeat("a", 500)...)
+	for range 10 {
+		block = append(block, 0xbe)
+	}
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+	frame = c.readSkipping()
+	assert.Equal(t, FrameGoAway, frame.Type)
+	assert.Equal(t, uint32Payload(0, uint32(ErrCodeEnhanceYourCalm)), frame.Payload[:8])
+
+	// Test: The limit is advertised, and requests within it are served
+	c = newTestClientOptions(t, echoHandler, opts)
+	assert.Contains(t, c.settings, Setting{ID: SettingMaxHeaderListSize, Value: 1024})
+	c.request(1, "GET", "/", FlagEndStream)
+	_, body := c.response(1)
+	assert.Equal(t, "GET / ", body)
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-release
+		}
+		echoHandler(w, req)
+	}
+
+	// Test: Streams beyond MAX_CONCURRENT_STREAMS are refused
+	c := newTestClient(t, handler)
+	c.request(1, "GET", "/wait", FlagEndStream)
+	c.request(3, "GET", "/wait", FlagEndStream)
+	c.request(5, "GET", "/wait", FlagEndStream)
+	frame := c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type)
+	assert.Equal(t, uint32(5), frame.StreamID)
+	assert.Equal(t, uint32Payload(uint32(ErrCodeRefusedStream)), frame.Payload)
+
+	// Test: Requests are multiplexed
+	c.request(7, "GET", "/fast", FlagEndStream)
+	frame = c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type, "still at the limit")
+	close(release)
+	seen := map[uint32]bool{}
+	for len(seen) < 2 {
+		frame = c.readSkipping()
+		if frame.Flags.Has(FlagEndStream) {
+			seen[frame.StreamID] = true
+		}
+	}
+	assert.Equal(t, map[uint32]bool{1: true, 3: true}, seen)
+
+	c.request(9, "GET", "/fast", FlagEndStream)
+	_, body := c.response(9)
+	assert.Equal(t, "GET /fast ", body)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	c := newTestClientOptions(t, echoHandler, ConnOptions{MaxBodySize: 10})
+
+	// Test: A body beyond MaxBodySize resets the stream
+	c.request(1, "POST", "/", 0)
+	c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte("0123456789")})
+	c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte("x")})
+	frame := c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type)
+	assert.Equal(t, uint32(1), frame.StreamID)
+	assert.Equal(t, uint32Payload(uint32(ErrCodeCancel)), frame.Payload)
+
+	// Test: So does a Content-Length beyond it
+	block := hpack.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "content-length", Value: "11"},
+	})
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 3, Payload: block})
+	frame = c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type)
+	assert.Equal(t, uint32(3), frame.StreamID)
+
+	// Test: A body within it is served
+	c.request(5, "POST", "/", 0)
+	c.write(&Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 5, Payload: []byte("0123456789")})
+	_, body := c.response(5)
+	assert.Equal(t, "POST / 0123456789", body)
+}
+
+func TestRapidReset(t *testing.T) {
+	var started atomic.Int32
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		started.Add(1)
+		<-release
+		if req.Context().Err() == nil {
+			echoHandler(w, req)
+		}
+	}
+	c := newTestClient(t, handler)
+
+	// Test: Reset streams count until their handlers return
+	for id := uint32(1); id <= 21; id += 2 {
+		c.request(id, "GET", "/", FlagEndStream)
+		c.write(&Frame{Type: FrameRSTStream, StreamID: id, Payload: uint32Payload(uint32(ErrCodeCancel))})
+	}
+	for id := uint32(5); id <= 21; id += 2 {
+		frame := c.readSkipping()
+		assert.Equal(t, FrameRSTStream, frame.Type)
+		assert.Equal(t, id, frame.StreamID)
+		assert.Equal(t, uint32Payload(uint32(ErrCodeRefusedStream)), frame.Payload)
+	}
+	assert.LessOrEqual(t, started.Load(), int32(2))
+
+	// Test: New streams are served once those handlers return
+	close(release)
+	id := uint32(23)
+	assert.Eventually(t, func() bool {
+		c.request(id, "GET", "/", FlagEndStream)
+		frame := c.readSkipping()
+		id += 2
+		if frame.Type != FrameHeaders {
+			return false
+		}
+		c.decoder.Decode(frame.Payload)
+		for !frame.Flags.Has(FlagEndStream) {
+			frame = c.readSkipping()
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Streams reset before their handlers start are forgotten
+	for range 10 {
+		c.request(id, "POST", "/", 0)
+		c.write(&Frame{Type: FrameRSTStream, StreamID: id, Payload: uint32Payload(uint32(ErrCodeCancel))})
+		id += 2
+	}
+	c.request(id, "GET", "/", FlagEndStream)
+	_, body := c.response(id)
+	assert.Equal(t, "GET / ", body)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		echoHandler(w, req)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestClientOptions(t, handler, ConnOptions{Context: ctx})
+	c.request(1, "GET", "/wait", FlagEndStream)
+	<-started
+
+	// Test: A done context sends GOAWAY with the last stream served
+	cancel()
+	frame := c.readSkipping()
+	assert.Equal(t, FrameGoAway, frame.Type)
+	assert.Equal(t, uint32Payload(1, uint32(ErrCodeNo)), frame.Payload[:8])
+
+	// Test: Later streams are refused
+	c.request(3, "GET", "/", FlagEndStream)
+	frame = c.readSkipping()
+	assert.Equal(t, FrameRSTStream, frame.Type)
+	assert.Equal(t, uint32(3), frame.StreamID)
+	assert.Equal(t, uint32Payload(uint32(ErrCodeRefusedStream)), frame.Payload)
+
+	// Test: The running handler finishes, then the connection closes
+	close(release)
+	_, body := c.response(1)
+	assert.Equal(t, "GET /wait ", body)
+	_, err := ReadFrame(c.conn, maxFrameSizeLimit)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestFromFields(t *testing.T) {
+	// Test: Pseudo-headers, host and cookies
+	req, err := requestFromFields([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/a?b"},
+		{Name: "cookie", Value: "a=1"},
+		{Name: "cookie", Value: "b=2"},
+		{Name: "te", Value: "trailers"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, request.RequestLine{Method: "GET", RequestTarget: "/a?b", HttpVersion: "2"}, req.RequestLine)
+	host, _ := req.Headers.Get("Host")
+	assert.Equal(t, "example.com", host)
+	cookie, _ := req.Headers.Get("Cookie")
+	assert.Equal(t, "a=1; b=2", cookie)
+
+	// Test: Malformed requests
+	for _, fields := range [][]hpack.HeaderField{
+		{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: "accept", Value: "*/*"}, {Name: ":path", Value: "/"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "Accept", Value: "*/*"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "te", Value: "gzip"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":status", Value: "200"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/\r\nx"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "accept", Value: "a\nset-cookie: b"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "accept", Value: "a\x00"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "accept", Value: " */*"}},
+	} {
+		_, err := requestFromFields(fields)
+		assert.Error(t, err, "%v", fields)
+	}
+}
+
+func TestResponseFields(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Connection", "close")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Set-Cookie", "id=1")
+	h.Set("Set-Cookie", "theme=dark")
+
+	fields := responseFields(h)
+	assert.ElementsMatch(t, []hpack.HeaderField{
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "set-cookie", Value: "id=1", Sensitive: true},
+		{Name: "set-cookie", Value: "theme=dark", Sensitive: true},
+	}, fields)
+}
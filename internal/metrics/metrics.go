@@ -0,0 +1,359 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+// DefaultBuckets are the latency buckets, in seconds, of the Prometheus
+// client libraries.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text exposition
+// format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []collector
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+type collector interface {
+	write(b *strings.Builder)
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, c)
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec[Counter](name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(name, v)
+	return v
+}
+
+// Gauge registers a gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec[Gauge](name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, v)
+	return v
+}
+
+// Histogram registers a histogram with the given upper bounds, which must
+// be sorted, and label names. DefaultBuckets are used when buckets is nil.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	v := &HistogramVec{newVec[Histogram](name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+	})}
+	r.register(name, v)
+	return v
+}
+
+// WriteText returns every metric in the text exposition format.
+func (r *Registry) WriteText() string {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	return b.String()
+}
+
+// Handler serves the metrics, to be mounted at /metrics.
+func (r *Registry) Handler() server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := []byte(r.WriteText())
+		h := response.GetDefaultHeaders(len(body))
+		h.Override("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		h.Set("Cache-Control", "no-store")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody(body)
+		}
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.value.add(v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.value.load()
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.store(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.value.add(v)
+}
+
+func (g *Gauge) Inc() {
+	g.value.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.load()
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomicFloat
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i].Add(1)
+	}
+	h.sum.add(v)
+	h.count.Add(1)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// With returns the counter for the given label values, in the order of
+// the label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v *CounterVec) write(b *strings.Builder) {
+	v.writeSeries(b, func(b *strings.Builder, labels string, c *Counter) {
+		writeSample(b, v.name, labels, c.Value())
+	})
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+// With returns the gauge for the given label values, in the order of the
+// label names.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v *GaugeVec) write(b *strings.Builder) {
+	v.writeSeries(b, func(b *strings.Builder, labels string, g *Gauge) {
+		writeSample(b, v.name, labels, g.Value())
+	})
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+// With returns the histogram for the given label values, in the order of
+// the label names.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v *HistogramVec) write(b *strings.Builder) {
+	v.writeSeries(b, func(b *strings.Builder, labels string, h *Histogram) {
+		// Buckets are cumulative in the exposition format.
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i].Load()
+			writeSample(b, v.name+"_bucket", joinLabels(labels, `le="`+formatFloat(bound)+`"`), float64(cumulative))
+		}
+		count := h.count.Load()
+		writeSample(b, v.name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(count))
+		writeSample(b, v.name+"_sum", labels, h.sum.load())
+		writeSample(b, v.name+"_count", labels, float64(count))
+	})
+}
+
+// vec is a metric family: one metric of type T per set of label values.
+type vec[T any] struct {
+	name, help, kind string
+	labels           []string
+	newMetric        func() *T
+
+	mu     sync.RWMutex
+	series map[string]*series[T]
+}
+
+type series[T any] struct {
+	labels string
+	metric *T
+}
+
+func newVec[T any](name, help, kind string, labels []string, newMetric func() *T) *vec[T] {
+	return &vec[T]{name: name, help: help, kind: kind, labels: labels, newMetric: newMetric, series: make(map[string]*series[T])}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = v.labels[i] + `="` + escapeLabel(value) + `"`
+	}
+	s = &series[T]{labels: strings.Join(pairs, ","), metric: v.newMetric()}
+	v.series[key] = s
+	return s.metric
+}
+
+// writeSeries writes the HELP and TYPE lines, then each series in label
+// order. A family without labels always has its one series.
+func (v *vec[T]) writeSeries(b *strings.Builder, write func(b *strings.Builder, labels string, metric *T)) {
+	if len(v.labels) == 0 {
+		v.with(nil)
+	}
+	v.mu.RLock()
+	all := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, s)
+	}
+	v.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.kind)
+	for _, s := range all {
+		write(b, s.labels, s.metric)
+	}
+}
+
+func writeSample(b *strings.Builder, name, labels string, value float64) {
+	b.WriteString(name)
+	if labels != "" {
+		b.WriteString("{")
+		b.WriteString(labels)
+		b.WriteString("}")
+	}
+	b.WriteString(" ")
+	b.WriteString(formatFloat(value))
+	b.WriteString("\n")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// atomicFloat is a float64 updated with compare-and-swap.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests.\nAll of them.", "method", "path")
+	requests.With("GET", "/").Add(2)
+	requests.With("POST", `/a"b\c`).Inc()
+	r.Gauge("temperature", "Current temperature.").With().Set(-1.5)
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.1)
+	latency.With().Observe(0.5)
+	latency.With().Observe(7)
+
+	// Test: Text format, with series sorted and values escaped
+	assert.Equal(t, `# HELP requests_total Requests.\nAll of them.
+# TYPE requests_total counter
+requests_total{method="GET",path="/"} 2
+requests_total{method="POST",path="/a\"b\\c"} 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature -1.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 7.65
+latency_seconds_count 4
+`, r.WriteText())
+
+	// Test: Unlabelled metrics are always exposed
+	r = NewRegistry()
+	r.Counter("events_total", "Events.")
+	r.Histogram("size_bytes", "Size.", []float64{10}, "kind")
+	assert.Equal(t, "# HELP events_total Events.\n# TYPE events_total counter\nevents_total 0\n"+
+		"# HELP size_bytes Size.\n# TYPE size_bytes histogram\n", r.WriteText())
+
+	// Test: Misuse panics
+	assert.Panics(t, func() { r.Counter("events_total", "Again.") })
+	assert.Panics(t, func() { requests.With("GET") })
+	assert.Panics(t, func() { requests.With("GET", "/").Add(-1) })
+	assert.Panics(t, func() { r.Histogram("unsorted", "Unsorted.", []float64{1, 0.5}) })
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("hits_total", "Hits.", "worker")
+	gauge := r.Gauge("level", "Level.").With()
+
+	// Test: Updates from many goroutines add up
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.With("shared").Inc()
+				gauge.Add(0.5)
+				r.WriteText()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, float64(8000), counter.With("shared").Value())
+	assert.Equal(t, float64(4000), gauge.Value())
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("events_total", "Events.").With().Inc()
+
+	// Test: Served as Prometheus text
+	var buf bytes.Buffer
+	w := &response.Writer{Writer: &buf}
+	req, err := request.RequestFromReader(strings.NewReader("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	r.Handler()(w, req)
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "events_total 1\n")
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+)
+
+type Options struct {
+	// Route maps a request target to the route label, which must take few
+	// distinct values whatever the clients send. Use Routes with the
+	// server's mounted paths; by default every request is "other".
+	Route func(target string) string
+	// Buckets are the latency histogram buckets in seconds, DefaultBuckets
+	// by default.
+	Buckets []float64
+}
+
+// ServerMetrics keeps the standard metrics of a server. Pass it to
+// server.WithObserver.
+type ServerMetrics struct {
+	opts Options
+
+	connsAccepted *Counter
+	connsActive   *Gauge
+	requests      *CounterVec
+	duration      *HistogramVec
+	requestBytes  *CounterVec
+	responseBytes *CounterVec
+	parseErrors   *CounterVec
+}
+
+// NewServerMetrics registers the server metrics in r.
+func NewServerMetrics(r *Registry, opts Options) *ServerMetrics {
+	if opts.Route == nil {
+		opts.Route = Routes()
+	}
+	return &ServerMetrics{
+		opts:          opts,
+		connsAccepted: r.Counter("http_server_connections_accepted_total", "Connections accepted.").With(),
+		connsActive:   r.Gauge("http_server_connections_active", "Connections being served.").With(),
+		requests:      r.Counter("http_server_requests_total", "Requests served, by method, route and status.", "method", "route", "status"),
+		duration:      r.Histogram("http_server_request_duration_seconds", "Time from reading the request to finishing the response.", opts.Buckets, "method", "route"),
+		requestBytes:  r.Counter("http_server_request_body_bytes_total", "Request body bytes read.", "method", "route"),
+		responseBytes: r.Counter("http_server_response_body_bytes_total", "Response body bytes written.", "method", "route"),
+		parseErrors:   r.Counter("http_server_parse_errors_total", "Requests that could not be parsed, by where parsing failed.", "type"),
+	}
+}
+
+func (m *ServerMetrics) ConnAccepted() {
+	m.connsAccepted.Inc()
+	m.connsActive.Inc()
+}
+
+func (m *ServerMetrics) ConnClosed() {
+	m.connsActive.Dec()
+}
+
+func (m *ServerMetrics) ParseError(kind string) {
+	m.parseErrors.With(kind).Inc()
+}
+
+func (m *ServerMetrics) RequestDone(entry accesslog.Entry) {
+	method := Method(entry.Method)
+	route := m.opts.Route(entry.Target)
+	m.requests.With(method, route, strconv.Itoa(entry.Status)).Inc()
+	m.duration.With(method, route).Observe(entry.Duration.Seconds())
+	m.requestBytes.With(method, route).Add(float64(entry.RequestBytes))
+	m.responseBytes.With(method, route).Add(float64(entry.Bytes))
+}
+
+// Routes returns a route function that maps a target to the longest of
+// prefixes that its path equals or continues with "/", such as "/assets"
+// for "/assets/app.js?v=2", and to "other" when there is none. The route
+// can only take the given values, so clients cannot create new series.
+func Routes(prefixes ...string) func(target string) string {
+	return func(target string) string {
+		path, _, _ := strings.Cut(target, "?")
+		route := ""
+		for _, prefix := range prefixes {
+			if len(prefix) > len(route) && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+				route = prefix
+			}
+		}
+		if route == "" {
+			return "other"
+		}
+		return route
+	}
+}
+
+// Method returns method if it is a standard one and "OTHER" otherwise, so
+// that clients cannot create new series at will.
+func Method(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewServerMetrics(r, Options{Route: Routes("/assets", "/upload"), Buckets: []float64{60}})
+	handler := func(w *response.Writer, req *request.Request) {
+		status := response.StatusOK
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/missing") {
+			status = response.StatusNotFound
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	}
+	s, err := server.Serve(0, handler, server.WithObserver(m))
+	require.NoError(t, err)
+	defer s.Close()
+	url := fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	for _, path := range []string{"/assets/a.js", "/assets/b.js?v=1", "/missing"} {
+		resp, err := http.Get(url + path)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := http.Post(url+"/upload", "text/plain", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nBad Header\r\n\r\n")
+	io.ReadAll(conn)
+	conn.Close()
+
+	// Test: Requests by method, route and status, with sizes and latency
+	assert.Eventually(t, func() bool {
+		return m.connsActive.Value() == 0 && m.connsAccepted.Value() == 5
+	}, time.Second, 10*time.Millisecond)
+	text := r.WriteText()
+	for _, line := range []string{
+		"http_server_connections_accepted_total 5",
+		"http_server_connections_active 0",
+		`http_server_requests_total{method="GET",route="/assets",status="200"} 2`,
+		`http_server_requests_total{method="GET",route="other",status="404"} 1`,
+		`http_server_requests_total{method="POST",route="/upload",status="200"} 1`,
+		`http_server_request_duration_seconds_bucket{method="GET",route="/assets",le="60"} 2`,
+		`http_server_request_duration_seconds_count{method="GET",route="/assets"} 2`,
+		`http_server_request_body_bytes_total{method="POST",route="/upload"} 10`,
+		`http_server_response_body_bytes_total{method="GET",route="/assets"} 10`,
+		`http_server_parse_errors_total{type="header"} 1`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	// Test: Routes
+	route := Routes("/", "/api", "/api/v2")
+	assert.Equal(t, "/", route("/"))
+	assert.Equal(t, "/", route("/?q=1"))
+	assert.Equal(t, "/api", route("/api"))
+	assert.Equal(t, "/api", route("/api/v1/users"))
+	assert.Equal(t, "/api/v2", route("/api/v2/users"), "the longest prefix")
+	assert.Equal(t, "other", route("/apis"))
+	assert.Equal(t, "other", route("/random-path"))
+	assert.Equal(t, "other", route("example.com:443"))
+	assert.Equal(t, "other", route("*"))
+
+	// Test: Every route is "other" by default
+	assert.Equal(t, "other", Routes()("/api"))
+
+	// Test: Methods
+	assert.Equal(t, "PATCH", Method("PATCH"))
+	assert.Equal(t, "OTHER", Method("BREW"))
+}
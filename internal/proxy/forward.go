@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+type ForwardOptions struct {
+	// Transport fetches absolute-form requests, the shared transport by
+	// default. Timeout bounds each fetch as in Options.
+	Transport http.RoundTripper
+	Timeout   time.Duration
+	// DialTimeout bounds connecting a CONNECT tunnel, 10 seconds by default.
+	DialTimeout time.Duration
+	// Authenticate checks the Basic credentials of Proxy-Authorization.
+	// Requests without valid credentials are answered with 407. When nil,
+	// no credentials are required.
+	Authenticate func(user, password string) bool
+	// Realm is announced in Proxy-Authenticate, "proxy" by default.
+	Realm string
+	// AllowedHosts lists the destinations that may be reached, as "host"
+	// or "host:port". A host of "*" matches any host and "*.example.com"
+	// any subdomain of example.com; a port of "*" matches any port, as does
+	// leaving it out. An empty list allows every destination.
+	AllowedHosts []string
+}
+
+// ForwardHandler is a forward proxy: it fetches absolute-form requests
+// such as "GET http://example.com/ HTTP/1.1" and tunnels CONNECT requests
+// by splicing bytes between the client and the destination. Tunnels need
+// an HTTP/1.1 connection that can be hijacked.
+func ForwardHandler(opts ForwardOptions) server.Handler {
+	if opts.Transport == nil {
+		opts.Transport = defaultTransport
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.Realm == "" {
+		opts.Realm = "proxy"
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		if !authorized(req, opts) {
+			writeProxyAuthRequired(w, opts.Realm)
+			return
+		}
+		if req.RequestLine.Method == "CONNECT" {
+			tunnel(w, req, opts)
+			return
+		}
+
+		target, err := url.Parse(req.RequestLine.RequestTarget)
+		if err != nil || !target.IsAbs() || target.Host == "" || target.Scheme != "http" && target.Scheme != "https" {
+			writeError(w, response.StatusBadrequest, fmt.Errorf("not an absolute-form request: %s", req.RequestLine.RequestTarget))
+			return
+		}
+		if !allowed(opts.AllowedHosts, target.Hostname(), portOf(target)) {
+			writeError(w, response.StatusForbidden, fmt.Errorf("destination %s not allowed", target.Host))
+			return
+		}
+
+		// The upstream sees the origin-form of the target.
+		outReq := req.WithContext(req.Context())
+		outReq.RequestLine.RequestTarget = target.RequestURI()
+		origin := &url.URL{Scheme: target.Scheme, Host: target.Host}
+		resp, cancel, err := roundTrip(outReq, origin, Options{Transport: opts.Transport, Timeout: opts.Timeout})
+		defer cancel()
+		if err != nil {
+			writeUpstreamError(w, req, err)
+			return
+		}
+		defer resp.Body.Close()
+		if err := CopyResponse(w, req, resp); err != nil {
+			log.Printf("Error proxying response from %s: %v", target.Host, err)
+		}
+	}
+}
+
+// IsForwardRequest reports whether req is meant for a forward proxy: a
+// CONNECT or a request with an absolute-form target.
+func IsForwardRequest(req *request.Request) bool {
+	if req.RequestLine.Method == "CONNECT" {
+		return true
+	}
+	target := req.RequestLine.RequestTarget
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+func tunnel(w *response.Writer, req *request.Request, opts ForwardOptions) {
+	host, port, err := net.SplitHostPort(req.RequestLine.RequestTarget)
+	if err != nil || host == "" || port == "" {
+		writeError(w, response.StatusBadrequest, fmt.Errorf("not an authority-form target: %s", req.RequestLine.RequestTarget))
+		return
+	}
+	if !allowed(opts.AllowedHosts, host, port) {
+		writeError(w, response.StatusForbidden, fmt.Errorf("destination %s not allowed", req.RequestLine.RequestTarget))
+		return
+	}
+	if w.Hijacker == nil {
+		writeError(w, response.StatusBadrequest, errors.New("CONNECT needs an HTTP/1.1 connection"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), opts.DialTimeout)
+	upstream, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	cancel()
+	if err != nil {
+		writeUpstreamError(w, req, err)
+		return
+	}
+	defer upstream.Close()
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+		return
+	}
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection for tunnel to %s: %v", req.RequestLine.RequestTarget, err)
+		return
+	}
+	defer client.Close()
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	// Closing both ends stops the copies when the server shuts down.
+	stop := context.AfterFunc(req.Context(), func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer stop()
+	splice(client, upstream)
+}
+
+// splice copies bytes both ways until both directions are done, passing
+// each half-close on to the other side.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+// authorized checks Basic credentials in Proxy-Authorization (RFC 9110
+// section 11.7.4).
+func authorized(req *request.Request, opts ForwardOptions) bool {
+	if opts.Authenticate == nil {
+		return true
+	}
+	credentials, ok := req.Headers.Get("Proxy-Authorization")
+	if !ok {
+		return false
+	}
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(credentials), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && opts.Authenticate(user, password)
+}
+
+func writeProxyAuthRequired(w *response.Writer, realm string) {
+	body := []byte(fmt.Sprintf("%d %s", response.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired)))
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/plain")
+	h.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	w.WriteStatusLine(response.StatusProxyAuthRequired)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// allowed matches a destination against an allowlist as described on
+// ForwardOptions.AllowedHosts.
+func allowed(allowlist []string, host, port string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, entry := range allowlist {
+		hostPattern, portPattern, err := net.SplitHostPort(entry)
+		if err != nil {
+			hostPattern, portPattern = strings.Trim(entry, "[]"), "*"
+		}
+		if portPattern != "*" && portPattern != port {
+			continue
+		}
+		hostPattern = strings.ToLower(hostPattern)
+		switch {
+		case hostPattern == "*" || hostPattern == host:
+			return true
+		case strings.HasPrefix(hostPattern, "*.") && strings.HasSuffix(host, hostPattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveForward(t *testing.T, opts ForwardOptions) *url.URL {
+	t.Helper()
+	s, err := server.Serve(0, ForwardHandler(opts))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)}
+}
+
+func proxiedClient(proxyURL *url.URL, base *http.Client) *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	if base != nil {
+		transport.TLSClientConfig = base.Transport.(*http.Transport).TLSClientConfig
+	}
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func originHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s host=%s proxy-auth=%q", r.Method, r.RequestURI, r.Host, r.Header.Get("Proxy-Authorization"))
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(originHandler))
+	t.Cleanup(origin.Close)
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	// Test: Absolute-form requests are fetched in origin-form
+	client := proxiedClient(serveForward(t, ForwardOptions{}), nil)
+	resp, err := client.Get(origin.URL + "/path?q=1")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf(`GET /path?q=1 host=%s proxy-auth=""`, originURL.Host), string(body))
+
+	// Test: Escapes in the path are sent on once
+	resp, err = client.Get(origin.URL + "/a%20b%2Fc?q=1")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, fmt.Sprintf(`GET /a%%20b%%2Fc?q=1 host=%s proxy-auth=""`, originURL.Host), string(body))
+
+	// Test: Origin-form requests are refused
+	resp, err = http.Get(serveForward(t, ForwardOptions{}).String() + "/path")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Test: Unreachable destinations are a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := listener.Addr().String()
+	listener.Close()
+	resp, err = client.Get("http://" + dead + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestConnectTunnel(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(originHandler))
+	t.Cleanup(origin.Close)
+
+	// Test: HTTPS goes through a CONNECT tunnel
+	client := proxiedClient(serveForward(t, ForwardOptions{}), origin.Client())
+	for range 2 {
+		resp, err := client.Get(origin.URL + "/secure")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, string(body), "GET /secure")
+	}
+}
+
+func TestConnectRaw(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	proxyURL := serveForward(t, ForwardOptions{})
+
+	// Test: Bytes sent with the CONNECT request reach the destination
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	target := echo.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nearly bytes|", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Test: The tunnel splices both ways and passes on the half-close
+	io.WriteString(conn, "later bytes")
+	conn.(*net.TCPConn).CloseWrite()
+	echoed, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early bytes|later bytes", string(echoed))
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(originHandler))
+	t.Cleanup(origin.Close)
+	proxyURL := serveForward(t, ForwardOptions{
+		Authenticate: func(user, password string) bool { return user == "dev" && password == "secret" },
+		Realm:        "dev tools",
+	})
+
+	// Test: Missing credentials get a 407 challenge
+	resp, err := proxiedClient(proxyURL, nil).Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="dev tools"`, resp.Header.Get("Proxy-Authenticate"))
+
+	// Test: Wrong credentials
+	withAuth := *proxyURL
+	withAuth.User = url.UserPassword("dev", "wrong")
+	resp, err = proxiedClient(&withAuth, nil).Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// Test: Valid credentials are checked and not forwarded
+	withAuth.User = url.UserPassword("dev", "secret")
+	resp, err = proxiedClient(&withAuth, nil).Get(origin.URL)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `proxy-auth=""`)
+
+	// Test: CONNECT is authenticated too
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(originHandler))
+	t.Cleanup(tlsOrigin.Close)
+	_, err = proxiedClient(proxyURL, tlsOrigin.Client()).Get(tlsOrigin.URL)
+	assert.ErrorContains(t, err, "Proxy Authentication Required")
+	resp, err = proxiedClient(&withAuth, tlsOrigin.Client()).Get(tlsOrigin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestForwardAllowlist(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(originHandler))
+	t.Cleanup(origin.Close)
+	originURL, err := url.Parse(origin.URL)
+	require.NoError(t, err)
+
+	// Test: Destinations off the list are forbidden
+	client := proxiedClient(serveForward(t, ForwardOptions{AllowedHosts: []string{"127.0.0.1:1"}}), nil)
+	resp, err := client.Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Test: Listed destinations are reached
+	client = proxiedClient(serveForward(t, ForwardOptions{AllowedHosts: []string{"127.0.0.1:" + originURL.Port()}}), nil)
+	resp, err = client.Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Test: CONNECT is checked against the list
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(originHandler))
+	t.Cleanup(tlsOrigin.Close)
+	_, err = proxiedClient(serveForward(t, ForwardOptions{AllowedHosts: []string{"example.com"}}), tlsOrigin.Client()).Get(tlsOrigin.URL)
+	assert.ErrorContains(t, err, "Forbidden")
+}
+
+func TestAllowed(t *testing.T) {
+	list := []string{"example.com", "*.internal:8080", "api.test:443", "[::1]:22"}
+
+	// Test: Host and port patterns
+	assert.True(t, allowed(list, "example.com", "80"))
+	assert.True(t, allowed(list, "Example.COM.", "443"))
+	assert.True(t, allowed(list, "db.internal", "8080"))
+	assert.False(t, allowed(list, "internal", "8080"))
+	assert.False(t, allowed(list, "db.internal", "80"))
+	assert.True(t, allowed(list, "api.test", "443"))
+	assert.False(t, allowed(list, "api.test", "80"))
+	assert.True(t, allowed(list, "::1", "22"))
+	assert.False(t, allowed(list, "evil.com", "80"))
+	assert.False(t, allowed(list, "notexample.com", "80"))
+
+	// Test: Wildcards and the empty list
+	assert.True(t, allowed([]string{"*:443"}, "anything", "443"))
+	assert.False(t, allowed([]string{"*:443"}, "anything", "80"))
+	assert.True(t, allowed(nil, "anything", "1"))
+}
+
+func TestIsForwardRequest(t *testing.T) {
+	forward := func(method, target string) bool {
+		return IsForwardRequest(&request.Request{RequestLine: request.RequestLine{Method: method, RequestTarget: target}})
+	}
+
+	// Test: CONNECT and absolute-form
+	assert.True(t, forward("CONNECT", "example.com:443"))
+	assert.True(t, forward("GET", "http://example.com/"))
+	assert.True(t, forward("GET", "https://example.com/"))
+
+	// Test: Origin-form
+	assert.False(t, forward("GET", "/http://example.com/"))
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 2 * time.Second
+	defaultHealthThreshold = 2
+)
+
+// HealthCheck configures active health checks: a GET of Path on every
+// backend each Interval, where any status below 400 counts as a pass.
+// Each backend is probed on its own, so a slow one does not hold up the
+// checks of the others.
+type HealthCheck struct {
+	Path string
+	// Interval defaults to 10 seconds and Timeout to 2 seconds. Timeout
+	// is capped at half the Interval, so a probe ends well before the
+	// next one is due.
+	Interval time.Duration
+	Timeout  time.Duration
+	// UnhealthyThreshold consecutive failures take a backend out of
+	// rotation and HealthyThreshold consecutive passes bring it back. Both
+	// default to 2.
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	// Transport sends the checks, the proxy's shared transport by default.
+	Transport http.RoundTripper
+}
+
+type healthState struct {
+	passes int
+	fails  int
+}
+
+func (p *Pool) startHealthChecks() {
+	check := p.opts.HealthCheck
+	if check.Interval == 0 {
+		check.Interval = defaultHealthInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthTimeout
+	}
+	check.Timeout = min(check.Timeout, check.Interval/2)
+	if check.UnhealthyThreshold == 0 {
+		check.UnhealthyThreshold = defaultHealthThreshold
+	}
+	if check.HealthyThreshold == 0 {
+		check.HealthyThreshold = defaultHealthThreshold
+	}
+	if check.Transport == nil {
+		check.Transport = defaultTransport
+	}
+
+	for _, backend := range p.backends {
+		go p.checkHealth(backend, check)
+	}
+}
+
+// checkHealth probes backend each Interval until the pool is closed.
+func (p *Pool) checkHealth(backend *Backend, check HealthCheck) {
+	var state healthState
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.recordHealth(backend, &state, check, probe(backend, check))
+		}
+	}
+}
+
+func (p *Pool) recordHealth(backend *Backend, state *healthState, check HealthCheck, passed bool) {
+	if passed {
+		state.fails = 0
+		state.passes++
+		if backend.failing.Load() && state.passes >= check.HealthyThreshold {
+			backend.failing.Store(false)
+			log.Printf("Backend %s passed health checks", backend.URL)
+		}
+		return
+	}
+
+	state.passes = 0
+	state.fails++
+	if !backend.failing.Load() && state.fails >= check.UnhealthyThreshold {
+		backend.failing.Store(true)
+		log.Printf("Backend %s failed health checks", backend.URL)
+	}
+}
+
+func probe(backend *Backend, check HealthCheck) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	target := *backend.URL
+	target.Path = joinPath(backend.URL.Path, check.Path)
+	target.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := check.Transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
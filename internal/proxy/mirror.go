@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+)
+
+const (
+	defaultMirrorTimeout = 10 * time.Second
+	// maxMirrorsInFlight bounds the shadow traffic; requests beyond it are
+	// not mirrored rather than queued.
+	maxMirrorsInFlight = 64
+)
+
+type MirrorOptions struct {
+	// Target receives copies of the sampled requests; mirroring is off
+	// while it is nil. Its responses are discarded.
+	Target *url.URL
+	// Fraction of requests mirrored, from 0 to 1. Zero mirrors none of
+	// them, so all traffic is only copied when asked for with 1.
+	Fraction float64
+	// Timeout bounds each mirrored exchange, 10 seconds by default.
+	Timeout time.Duration
+}
+
+var mirrorSlots = make(chan struct{}, maxMirrorsInFlight)
+
+// startMirror sends a copy of req to the shadow upstream in the
+// background. The copy outlives the client's request and its deadline,
+// and is bounded by the mirror's own Timeout instead.
+func startMirror(req *request.Request, opts Options) {
+	mirror := opts.Mirror
+	if mirror.Target == nil || rand.Float64() >= mirror.Fraction {
+		return
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		return
+	}
+
+	timeout := mirror.Timeout
+	if timeout == 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), timeout)
+	outReq, err := NewUpstreamRequest(ctx, req, mirror.Target, opts.PreserveHost)
+	if err != nil {
+		cancel()
+		<-mirrorSlots
+		log.Printf("Error mirroring request to %s: %v", mirror.Target.Host, err)
+		return
+	}
+
+	go func() {
+		defer func() { <-mirrorSlots }()
+		defer cancel()
+		resp, err := opts.Transport.RoundTrip(outReq)
+		if err != nil {
+			log.Printf("Error mirroring request to %s: %v", mirror.Target.Host, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
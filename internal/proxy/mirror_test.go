@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "shadow")
+	}))
+	t.Cleanup(shadow.Close)
+	shadowURL, err := url.Parse(shadow.URL)
+	require.NoError(t, err)
+
+	target, calls := flakyUpstream(t, 0, 0)
+
+	// Test: Requests are copied to the shadow and its response is discarded
+	addr := serveProxy(t, target, Options{Mirror: MirrorOptions{Target: shadowURL, Fraction: 1}})
+	status, body := fetch(t, addr+"/copied", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int32(1), calls.Load())
+	select {
+	case got := <-mirrored:
+		assert.Equal(t, "GET /copied ", got)
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	// Test: Only the sampled fraction is mirrored
+	addr = serveProxy(t, target, Options{Mirror: MirrorOptions{Target: shadowURL, Fraction: 0.000001}})
+	for range 5 {
+		fetch(t, addr, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mirrored)
+
+	// Test: Zero mirrors nothing
+	addr = serveProxy(t, target, Options{Mirror: MirrorOptions{Target: shadowURL}})
+	for range 5 {
+		fetch(t, addr, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mirrored)
+}
+
+func TestMirrorOutlivesRequest(t *testing.T) {
+	var finished atomic.Bool
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		finished.Store(true)
+	}))
+	t.Cleanup(shadow.Close)
+	shadowURL, err := url.Parse(shadow.URL)
+	require.NoError(t, err)
+	target, _ := flakyUpstream(t, 0, 0)
+
+	// Test: A slow shadow does not delay the client
+	addr := serveProxy(t, target, Options{Mirror: MirrorOptions{Target: shadowURL, Fraction: 1}})
+	start := time.Now()
+	status, _ := fetch(t, addr, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Eventually(t, finished.Load, time.Second, 10*time.Millisecond)
+}
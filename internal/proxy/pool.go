@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const (
+	defaultMaxFails      = 5
+	defaultEjectDuration = 30 * time.Second
+	// virtualNodes is the number of points each unit of weight gets on the
+	// consistent hash ring.
+	virtualNodes = 100
+)
+
+var ErrNoBackend = errors.New("proxy: no healthy backend")
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	ConsistentHash
+)
+
+// Backend is one upstream in a Pool.
+type Backend struct {
+	URL *url.URL
+	// Weight scales the backend's share of traffic, 1 by default.
+	Weight int
+
+	active       atomic.Int64
+	failing      atomic.Bool // set by active health checks
+	ejectedUntil atomic.Int64
+	fails        atomic.Int32
+
+	current int // smooth weighted round-robin state, guarded by Pool.mu
+}
+
+// Healthy reports whether the backend passes health checks and is not
+// ejected.
+func (b *Backend) Healthy() bool {
+	return !b.failing.Load() && time.Now().UnixNano() >= b.ejectedUntil.Load()
+}
+
+// Active returns the number of requests in flight to the backend.
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+type PoolOptions struct {
+	Strategy Strategy
+	// HashHeader is hashed by ConsistentHash; the client IP is used when it
+	// is empty or the request lacks the header.
+	HashHeader string
+	// HealthCheck enables active health checks when its Path is set.
+	HealthCheck HealthCheck
+	// MaxFails consecutive 5xx responses or connection errors eject a
+	// backend for EjectDuration. Defaults are 5 and 30 seconds; a negative
+	// MaxFails disables passive ejection.
+	MaxFails      int
+	EjectDuration time.Duration
+}
+
+// Pool spreads requests across backends.
+type Pool struct {
+	backends []*Backend
+	opts     PoolOptions
+
+	mu   sync.Mutex
+	ring []ringPoint
+	done chan struct{}
+	once sync.Once
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+func NewPool(backends []*Backend, opts PoolOptions) (*Pool, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("proxy: pool needs at least one backend")
+	}
+	for _, backend := range backends {
+		if backend.URL == nil {
+			return nil, errors.New("proxy: backend without URL")
+		}
+		if backend.Weight < 0 {
+			return nil, fmt.Errorf("proxy: negative weight for %s", backend.URL)
+		}
+		if backend.Weight == 0 {
+			backend.Weight = 1
+		}
+	}
+	if opts.MaxFails == 0 {
+		opts.MaxFails = defaultMaxFails
+	}
+	if opts.EjectDuration == 0 {
+		opts.EjectDuration = defaultEjectDuration
+	}
+
+	p := &Pool{backends: backends, opts: opts, done: make(chan struct{})}
+	if opts.Strategy == ConsistentHash {
+		p.buildRing()
+	}
+	if opts.HealthCheck.Path != "" {
+		p.startHealthChecks()
+	}
+	return p, nil
+}
+
+// Backends returns the pool's backends.
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// Close stops the health checks.
+func (p *Pool) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+// Pick chooses a healthy backend for req.
+func (p *Pool) Pick(req *request.Request) (*Backend, error) {
+	switch p.opts.Strategy {
+	case LeastConnections:
+		return p.pickLeastConnections()
+	case ConsistentHash:
+		return p.pickConsistentHash(req)
+	default:
+		return p.pickRoundRobin()
+	}
+}
+
+// pickRoundRobin implements smooth weighted round-robin: every healthy
+// backend gains its weight, the leader is picked and pays back the total.
+func (p *Pool) pickRoundRobin() (*Backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, backend := range p.backends {
+		if !backend.Healthy() {
+			continue
+		}
+		backend.current += backend.Weight
+		total += backend.Weight
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBackend
+	}
+	best.current -= total
+	return best, nil
+}
+
+func (p *Pool) pickLeastConnections() (*Backend, error) {
+	var best *Backend
+	for _, backend := range p.backends {
+		if !backend.Healthy() {
+			continue
+		}
+		// Compare active/weight without dividing.
+		if best == nil || backend.Active()*int64(best.Weight) < best.Active()*int64(backend.Weight) {
+			best = backend
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBackend
+	}
+	return best, nil
+}
+
+func (p *Pool) buildRing() {
+	for _, backend := range p.backends {
+		for i := 0; i < backend.Weight*virtualNodes; i++ {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(backend.URL.String() + "#" + strconv.Itoa(i)), backend: backend})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+}
+
+// pickConsistentHash walks the ring clockwise from the key's hash to the
+// first healthy backend, so a key only moves when its backend goes away.
+func (p *Pool) pickConsistentHash(req *request.Request) (*Backend, error) {
+	key := ""
+	if p.opts.HashHeader != "" {
+		key, _ = req.Headers.Get(p.opts.HashHeader)
+	}
+	if key == "" {
+		key = clientIP(req)
+	}
+
+	hash := hashKey(key)
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	for i := range p.ring {
+		point := p.ring[(start+i)%len(p.ring)]
+		if point.backend.Healthy() {
+			return point.backend, nil
+		}
+	}
+	return nil, ErrNoBackend
+}
+
+// hashKey hashes with FNV-1a and a splitmix64 finalizer; FNV alone leaves
+// keys that differ only in their last bytes clustered on the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func clientIP(req *request.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// report feeds the outcome of a request into passive ejection.
+func (p *Pool) report(backend *Backend, failed bool) {
+	if p.opts.MaxFails < 0 {
+		return
+	}
+	if !failed {
+		backend.fails.Store(0)
+		return
+	}
+	if backend.fails.Add(1) >= int32(p.opts.MaxFails) {
+		backend.fails.Store(0)
+		backend.ejectedUntil.Store(time.Now().Add(p.opts.EjectDuration).UnixNano())
+		log.Printf("Ejected backend %s for %s after %d consecutive failures", backend.URL, p.opts.EjectDuration, p.opts.MaxFails)
+	}
+}
+
+// PoolHandler proxies every request to a backend picked from pool, with a
+// fresh pick for each retry. Requests are answered with 503 while no
+// backend is healthy.
+func PoolHandler(pool *Pool, opts Options) server.Handler {
+	if opts.Transport == nil {
+		opts.Transport = defaultTransport
+	}
+	breakers := newBreakers(opts.Breaker)
+	return func(w *response.Writer, req *request.Request) {
+		forward(w, req, opts, func() (upstream, error) {
+			backend, err := pool.Pick(req)
+			if err != nil {
+				return upstream{}, err
+			}
+			up, err := breakers.upstream(backend.URL)
+			if err != nil {
+				return upstream{}, err
+			}
+
+			backend.active.Add(1)
+			done := up.done
+			up.done = func(failed bool) {
+				done(failed)
+				pool.report(backend, failed)
+			}
+			up.release = func() {
+				backend.active.Add(-1)
+			}
+			return up, nil
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend answers with its name, or with 500 while failing is set.
+type testBackend struct {
+	name    string
+	url     *url.URL
+	failing atomic.Bool
+	release chan struct{}
+}
+
+func newBackend(t *testing.T, name string) *testBackend {
+	t.Helper()
+	b := &testBackend{name: name}
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/wait" && b.release != nil {
+			<-b.release
+		}
+		status := response.StatusOK
+		if b.failing.Load() {
+			status = response.StatusInternalServerError
+		}
+		body := []byte(b.name)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	b.url = &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)}
+	return b
+}
+
+func newPool(t *testing.T, opts PoolOptions, weights map[*testBackend]int, backends ...*testBackend) *Pool {
+	t.Helper()
+	var members []*Backend
+	for _, b := range backends {
+		members = append(members, &Backend{URL: b.url, Weight: weights[b]})
+	}
+	pool, err := NewPool(members, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func fetch(t *testing.T, addr string, header map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", addr, nil)
+	require.NoError(t, err)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func servePool(t *testing.T, pool *Pool) string {
+	t.Helper()
+	return servePoolWith(t, pool, Options{})
+}
+
+func servePoolWith(t *testing.T, pool *Pool, opts Options) string {
+	t.Helper()
+	s, err := server.Serve(0, PoolHandler(pool, opts))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func pickedNames(t *testing.T, pool *Pool, n int, req *request.Request) []string {
+	t.Helper()
+	names := make([]string, n)
+	for i := range names {
+		backend, err := pool.Pick(req)
+		require.NoError(t, err)
+		names[i] = backend.URL.Host
+	}
+	return names
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := newBackend(t, "a"), newBackend(t, "b"), newBackend(t, "c")
+
+	// Test: Backends take turns
+	addr := servePool(t, newPool(t, PoolOptions{}, nil, a, b, c))
+	var got []string
+	for range 6 {
+		_, body := fetch(t, addr, nil)
+		got = append(got, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+
+	// Test: Weights are interleaved smoothly
+	pool := newPool(t, PoolOptions{}, map[*testBackend]int{a: 5, b: 1, c: 1}, a, b, c)
+	names := pickedNames(t, pool, 7, &request.Request{})
+	ha, hb, hc := a.url.Host, b.url.Host, c.url.Host
+	assert.Equal(t, []string{ha, ha, hb, ha, hc, ha, ha}, names)
+}
+
+func TestLeastConnections(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	a.release = make(chan struct{})
+	pool := newPool(t, PoolOptions{Strategy: LeastConnections}, nil, a, b)
+	addr := servePool(t, pool)
+
+	// Test: A busy backend is avoided
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fetch(t, addr+"/wait", nil)
+	}()
+	require.Eventually(t, func() bool { return pool.Backends()[0].Active() == 1 }, time.Second, time.Millisecond)
+	for range 3 {
+		_, body := fetch(t, addr, nil)
+		assert.Equal(t, "b", body)
+	}
+	close(a.release)
+	wg.Wait()
+	assert.Eventually(t, func() bool { return pool.Backends()[0].Active() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []*testBackend{newBackend(t, "a"), newBackend(t, "b"), newBackend(t, "c")}
+
+	// Test: The same key always lands on the same backend
+	pool := newPool(t, PoolOptions{Strategy: ConsistentHash, HashHeader: "X-User"}, nil, backends...)
+	owners := map[string]string{}
+	for i := range 50 {
+		req := &request.Request{Headers: headers.NewHeaders()}
+		req.Headers.Set("X-User", fmt.Sprintf("user-%d", i))
+		names := pickedNames(t, pool, 3, req)
+		assert.Equal(t, names[0], names[1])
+		assert.Equal(t, names[0], names[2])
+		owners[req.Headers["x-user"]] = names[0]
+	}
+	assert.Len(t, uniqueValues(owners), 3, "keys spread over every backend")
+
+	// Test: Only keys of a removed backend move
+	removed := pool.Backends()[0]
+	removed.failing.Store(true)
+	for key, owner := range owners {
+		req := &request.Request{Headers: headers.NewHeaders()}
+		req.Headers.Set("X-User", key)
+		backend, err := pool.Pick(req)
+		require.NoError(t, err)
+		if owner != removed.URL.Host {
+			assert.Equal(t, owner, backend.URL.Host)
+		} else {
+			assert.NotEqual(t, owner, backend.URL.Host)
+		}
+	}
+	removed.failing.Store(false)
+
+	// Test: Client IP when the header is missing
+	req := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: "198.51.100.4:5555"}
+	first, err := pool.Pick(req)
+	require.NoError(t, err)
+	req.RemoteAddr = "198.51.100.4:6666"
+	second, err := pool.Pick(req)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+}
+
+func uniqueValues(m map[string]string) map[string]bool {
+	values := map[string]bool{}
+	for _, value := range m {
+		values[value] = true
+	}
+	return values
+}
+
+func TestHealthChecks(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	pool := newPool(t, PoolOptions{HealthCheck: HealthCheck{
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+	}}, nil, a, b)
+	addr := servePool(t, pool)
+
+	// Test: A failing backend leaves the rotation
+	a.failing.Store(true)
+	require.Eventually(t, func() bool { return !pool.Backends()[0].Healthy() }, time.Second, 5*time.Millisecond)
+	for range 4 {
+		_, body := fetch(t, addr, nil)
+		assert.Equal(t, "b", body)
+	}
+
+	// Test: It returns once it passes again
+	a.failing.Store(false)
+	require.Eventually(t, func() bool { return pool.Backends()[0].Healthy() }, time.Second, 5*time.Millisecond)
+
+	// Test: No healthy backend is a 503
+	a.failing.Store(true)
+	b.failing.Store(true)
+	require.Eventually(t, func() bool { return !pool.Backends()[0].Healthy() && !pool.Backends()[1].Healthy() }, time.Second, 5*time.Millisecond)
+	status, _ := fetch(t, addr, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestHealthChecksHanging(t *testing.T) {
+	// A backend that accepts connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	hanging := &Backend{URL: &url.URL{Scheme: "http", Host: listener.Addr().String()}}
+	b := newBackend(t, "b")
+	pool, err := NewPool([]*Backend{hanging, {URL: b.url}}, PoolOptions{HealthCheck: HealthCheck{
+		Path:               "/health",
+		Interval:           20 * time.Millisecond,
+		Timeout:            time.Minute,
+		UnhealthyThreshold: 1,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+
+	// Test: Probes time out within the interval
+	require.Eventually(t, func() bool { return !hanging.Healthy() }, time.Second, 5*time.Millisecond)
+
+	// Test: A hanging backend does not hold up the checks of the others
+	b.failing.Store(true)
+	require.Eventually(t, func() bool { return !pool.Backends()[1].Healthy() }, time.Second, 5*time.Millisecond)
+}
+
+func TestPassiveEjection(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	pool := newPool(t, PoolOptions{MaxFails: 2, EjectDuration: 100 * time.Millisecond}, nil, a, b)
+	addr := servePool(t, pool)
+
+	// Test: Consecutive 5xx responses eject a backend
+	a.failing.Store(true)
+	statuses := map[int]int{}
+	for range 4 {
+		status, _ := fetch(t, addr, nil)
+		statuses[status]++
+	}
+	assert.Equal(t, map[int]int{500: 2, 200: 2}, statuses)
+	assert.False(t, pool.Backends()[0].Healthy())
+	for range 3 {
+		_, body := fetch(t, addr, nil)
+		assert.Equal(t, "b", body)
+	}
+
+	// Test: Ejection expires
+	a.failing.Store(false)
+	time.Sleep(120 * time.Millisecond)
+	assert.True(t, pool.Backends()[0].Healthy())
+
+	// Test: Connection errors count as failures
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := &Backend{URL: &url.URL{Scheme: "http", Host: listener.Addr().String()}}
+	listener.Close()
+	pool, err = NewPool([]*Backend{dead, {URL: b.url}}, PoolOptions{MaxFails: 1})
+	require.NoError(t, err)
+	addr = servePool(t, pool)
+	status, _ := fetch(t, addr, nil)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.False(t, dead.Healthy())
+	_, body := fetch(t, addr, nil)
+	assert.Equal(t, "b", body)
+}
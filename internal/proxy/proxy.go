@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/pderyuga/httpfromtcp/internal/tracing"
+)
+
+// hopByHop lists the headers that describe a single connection and are
+// never forwarded (RFC 9110 section 7.6.1).
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var defaultTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	// Bodies pass through in whatever encoding the upstream chose.
+	DisableCompression: true,
+}
+
+type Options struct {
+	// Transport sends the upstream requests. A shared transport with
+	// connection pooling is used when nil.
+	Transport http.RoundTripper
+	// Timeout bounds each upstream exchange, answered with 504 when it
+	// passes. Zero leaves only the request context's deadline.
+	Timeout time.Duration
+	// PreserveHost forwards the client's Host header instead of the
+	// upstream's host.
+	PreserveHost bool
+	Retry        RetryOptions
+	Breaker      BreakerOptions
+	Mirror       MirrorOptions
+}
+
+// Handler proxies every request to target, appending the request path to
+// target's path.
+func Handler(target *url.URL, opts Options) server.Handler {
+	if opts.Transport == nil {
+		opts.Transport = defaultTransport
+	}
+	breakers := newBreakers(opts.Breaker)
+	return func(w *response.Writer, req *request.Request) {
+		forward(w, req, opts, func() (upstream, error) {
+			return breakers.upstream(target)
+		})
+	}
+}
+
+// roundTrip sends req to target. The returned cancel func releases the
+// timeout and must be called once the response body has been read.
+func roundTrip(req *request.Request, target *url.URL, opts Options) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	if opts.Timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(req.Context(), opts.Timeout)
+	}
+
+	outReq, err := NewUpstreamRequest(ctx, req, target, opts.PreserveHost)
+	if err != nil {
+		return nil, cancel, err
+	}
+
+	// The try timeout only covers waiting for the response headers. Its
+	// timer cancels the request only while that wait lasts, so it never
+	// aborts the body, and records when it did so that only then is the
+	// failure a timeout.
+	var (
+		mu       sync.Mutex
+		answered bool
+		timedOut bool
+	)
+	if opts.Retry.TryTimeout > 0 {
+		timer := time.AfterFunc(opts.Retry.TryTimeout, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !answered {
+				timedOut = true
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+	span := startClientSpan(req, outReq)
+	resp, err := opts.Transport.RoundTrip(outReq)
+	mu.Lock()
+	answered = true
+	mu.Unlock()
+	if timedOut {
+		if err == nil {
+			// The headers raced the timer, but the body is already cancelled.
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("proxy: no response from %s within %s: %w", target.Host, opts.Retry.TryTimeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		span.SetError()
+		span.SetAttribute("error.message", err.Error())
+		span.End()
+		return nil, cancel, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError()
+	}
+	span.End()
+	return resp, cancel, nil
+}
+
+// startClientSpan starts a span for the upstream exchange when req is
+// traced, and passes its context on in outReq's headers. The span ends
+// with the response headers; the body is not timed.
+func startClientSpan(req *request.Request, outReq *http.Request) *tracing.Span {
+	_, span := tracing.StartSpan(req.Context(), outReq.Method, tracing.KindClient)
+	if span == nil {
+		return nil
+	}
+	tracing.Inject(outReq.Header, span.Context())
+	span.SetAttribute("http.request.method", outReq.Method)
+	span.SetAttribute("server.address", outReq.URL.Host)
+	// The query is left out, as it may carry tokens.
+	full := *outReq.URL
+	full.RawQuery = ""
+	span.SetAttribute("url.full", full.String())
+	return span
+}
+
+// writeUpstreamError answers a failed upstream exchange, unless the client
+// has gone away and nobody is left to answer.
+func writeUpstreamError(w *response.Writer, req *request.Request, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+	writeError(w, ErrorStatus(err), err)
+}
+
+// NewUpstreamRequest builds the request sent to target: the client's
+// method, body and end-to-end headers plus the X-Forwarded-* and Forwarded
+// headers describing the client.
+func NewUpstreamRequest(ctx context.Context, req *request.Request, target *url.URL, preserveHost bool) (*http.Request, error) {
+	outURL := *target
+	path, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	// The target is still escaped; keeping the escaped form as RawPath
+	// sends an escaped "/" on as "%2F".
+	rawPath := joinPath(target.EscapedPath(), path)
+	unescaped, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	outURL.Path, outURL.RawPath = unescaped, rawPath
+	switch {
+	case target.RawQuery == "":
+		outURL.RawQuery = query
+	case query != "":
+		outURL.RawQuery = target.RawQuery + "&" + query
+	}
+
+	var body io.Reader
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	outReq, err := http.NewRequestWithContext(ctx, req.RequestLine.Method, outURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := copyHeaders(req.Headers)
+	for name, value := range h {
+		outReq.Header[http.CanonicalHeaderKey(name)] = []string{value}
+	}
+	// The transport sets these itself.
+	outReq.Header.Del("Host")
+	outReq.Header.Del("Content-Length")
+	if te, _ := req.Headers.Get("TE"); hasToken(te, "trailers") {
+		outReq.Header.Set("Te", "trailers")
+	}
+
+	clientHost, _ := req.Headers.Get("Host")
+	if preserveHost && clientHost != "" {
+		outReq.Host = clientHost
+	}
+	addForwarded(outReq.Header, req, clientHost)
+	return outReq, nil
+}
+
+func addForwarded(h http.Header, req *request.Request, clientHost string) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	if clientIP != "" {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			h.Set("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	if clientHost != "" {
+		h.Set("X-Forwarded-Host", clientHost)
+	}
+
+	// Forwarded (RFC 7239) quotes IPv6 addresses and anything that is not a
+	// token.
+	var elements []string
+	if clientIP != "" {
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = "[" + node + "]"
+		}
+		elements = append(elements, "for="+quoteForwarded(node))
+	}
+	if clientHost != "" {
+		elements = append(elements, "host="+quoteForwarded(clientHost))
+	}
+	elements = append(elements, "proto="+proto)
+	forwarded := strings.Join(elements, ";")
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// CopyResponse writes the upstream response to w unchanged apart from the
+// hop-by-hop headers, streaming the body and passing trailers through.
+func CopyResponse(w *response.Writer, req *request.Request, resp *http.Response) error {
+	h := headers.NewHeaders()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			h.Set(name, value)
+		}
+	}
+	h = copyHeaders(h)
+
+	noBody := req.RequestLine.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 || resp.StatusCode < 200
+	chunked := !noBody && (resp.ContentLength < 0 || len(resp.Trailer) > 0)
+	if chunked {
+		h.Remove("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		if len(resp.Trailer) > 0 {
+			names := make([]string, 0, len(resp.Trailer))
+			for name := range resp.Trailer {
+				names = append(names, name)
+			}
+			h.Set("Trailer", strings.Join(names, ", "))
+		}
+	} else if !noBody {
+		h.Override("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if noBody {
+		return nil
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			var writeErr error
+			if chunked {
+				_, writeErr = w.WriteChunkedBody(buf[:n])
+			} else {
+				_, writeErr = w.WriteBody(buf[:n])
+			}
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !chunked {
+		return nil
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	trailers := headers.NewHeaders()
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			trailers.Set(name, value)
+		}
+	}
+	return w.WriteTrailers(trailers)
+}
+
+// ErrorStatus maps an upstream failure to 504 for timeouts and 502 for
+// everything else.
+func ErrorStatus(err error) response.StatusCode {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return response.StatusGatewayTimeout
+	}
+	return response.StatusBadGateway
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, err error) {
+	log.Printf("Upstream error: %v", err)
+	body := []byte(fmt.Sprintf("%d %s", statusCode, http.StatusText(int(statusCode))))
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/plain")
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// copyHeaders returns h without hop-by-hop headers, including any named in
+// its Connection header.
+func copyHeaders(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for name, value := range h {
+		out.Override(name, value)
+	}
+	if connection, ok := h.Get("Connection"); ok {
+		for _, name := range strings.Split(connection, ",") {
+			out.Remove(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHop {
+		out.Remove(name)
+	}
+	return out
+}
+
+func joinPath(base, path string) string {
+	switch {
+	case base == "" || base == "/":
+		return path
+	case path == "" || path == "/":
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
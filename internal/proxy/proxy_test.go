@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/pderyuga/httpfromtcp/internal/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type echoed struct {
+	Method string
+	URI    string
+	Host   string
+	Body   string
+	Header http.Header
+}
+
+func newUpstream(t *testing.T) *url.URL {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/teapot":
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "short and stout")
+		case "/api/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			io.WriteString(w, "streamed")
+			w.(http.Flusher).Flush()
+			w.Header().Set("X-Checksum", "abc123")
+		case "/api/cookies":
+			w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+			w.Header().Add("Set-Cookie", "b=2")
+		case "/api/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			json.NewEncoder(w).Encode(echoed{Method: r.Method, URI: r.RequestURI, Host: r.Host, Body: string(body), Header: r.Header})
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	target, err := url.Parse(upstream.URL + "/api?from=proxy")
+	require.NoError(t, err)
+	return target
+}
+
+func serveProxy(t *testing.T, target *url.URL, opts Options) string {
+	t.Helper()
+	s, err := server.Serve(0, Handler(target, opts))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func TestForwardRequest(t *testing.T) {
+	addr := serveProxy(t, newUpstream(t), Options{})
+
+	// Test: Method, path, query, body and end-to-end headers are forwarded
+	req, err := http.NewRequest("POST", addr+"/echo?q=1", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-Custom", "kept")
+	req.Header.Set("X-Conn-Scoped", "dropped")
+	req.Header.Set("Connection", "X-Conn-Scoped")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var got echoed
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/api/echo?from=proxy&q=1", got.URI)
+	assert.Equal(t, "payload", got.Body)
+	assert.Equal(t, "kept", got.Header.Get("X-Custom"))
+	for _, name := range []string{"X-Conn-Scoped", "Keep-Alive", "Proxy-Authorization"} {
+		assert.Empty(t, got.Header.Get(name), name)
+	}
+
+	// Test: Forwarding headers describe the client
+	assert.Equal(t, "203.0.113.7, 127.0.0.1", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, strings.TrimPrefix(addr, "http://"), got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, fmt.Sprintf(`for=127.0.0.1;host=%q;proto=http`, strings.TrimPrefix(addr, "http://")), got.Header.Get("Forwarded"))
+	assert.NotEqual(t, strings.TrimPrefix(addr, "http://"), got.Host, "upstream host is used by default")
+
+	// Test: Escapes in the path are sent on once, "%2F" included
+	resp, err = http.Get(addr + "/a%20b%2Fc?x=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got = echoed{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, "/api/a%20b%2Fc?from=proxy&x=1", got.URI)
+}
+
+func TestForwardResponse(t *testing.T) {
+	addr := serveProxy(t, newUpstream(t), Options{})
+
+	// Test: Status, headers and body pass through unchanged
+	resp, err := http.Get(addr + "/teapot")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Equal(t, "short and stout", string(body))
+
+	// Test: Trailers pass through
+	resp, err = http.Get(addr + "/trailers")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "streamed", string(body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+
+	// Test: Each Set-Cookie stays a separate field
+	resp, err = http.Get(addr + "/cookies")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, resp.Header.Values("Set-Cookie"))
+
+	// Test: HEAD keeps the upstream Content-Length
+	resp, err = http.Head(addr + "/teapot")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(15), resp.ContentLength)
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	// Test: Unreachable upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := listener.Addr().String()
+	listener.Close()
+	addr := serveProxy(t, &url.URL{Scheme: "http", Host: deadAddr}, Options{})
+	resp, err := http.Get(addr + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Test: Slow upstream is a 504
+	addr = serveProxy(t, newUpstream(t), Options{Timeout: 50 * time.Millisecond})
+	resp, err = http.Get(addr + "/slow")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+}
+
+func TestPreserveHost(t *testing.T) {
+	addr := serveProxy(t, newUpstream(t), Options{PreserveHost: true})
+
+	// Test: Client Host is sent upstream
+	resp, err := http.Get(addr + "/echo")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var got echoed
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, strings.TrimPrefix(addr, "http://"), got.Host)
+}
+
+func TestAddForwarded(t *testing.T) {
+	// Test: IPv6 clients are bracketed and quoted, prior values are kept
+	h := http.Header{}
+	h.Set("Forwarded", "for=192.0.2.60")
+	addForwarded(h, &request.Request{RemoteAddr: "[2001:db8::1]:4711"}, "example.com")
+	assert.Equal(t, `for=192.0.2.60, for="[2001:db8::1]";host=example.com;proto=http`, h.Get("Forwarded"))
+	assert.Equal(t, "2001:db8::1", h.Get("X-Forwarded-For"))
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.SpanData
+}
+
+func (r *spanRecorder) Export(span *tracing.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder := &spanRecorder{}
+	s, err := server.Serve(0, tracing.Handler(Handler(newUpstream(t), Options{}), tracing.Options{Exporter: recorder}))
+	require.NoError(t, err)
+	defer s.Close()
+	addr := fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	req, err := http.NewRequest("GET", addr+"/echo", nil)
+	require.NoError(t, err)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "rojo=00f067aa0ba902b7")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var got echoed
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	resp.Body.Close()
+
+	// Test: The upstream sees the proxy's client span as its parent
+	assert.Eventually(t, func() bool {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return len(recorder.spans) == 2
+	}, time.Second, 10*time.Millisecond)
+	client, serverSpan := recorder.spans[0], recorder.spans[1]
+	assert.Equal(t, tracing.KindClient, client.Kind)
+	assert.Equal(t, serverSpan.Context.SpanID, client.Parent)
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.Parent.String())
+	assert.Equal(t, client.Context.Traceparent(), got.Header.Get("Traceparent"))
+	assert.Contains(t, got.Header.Get("Traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, "rojo=00f067aa0ba902b7", got.Header.Get("Tracestate"))
+	assert.Equal(t, 200, client.Attributes["http.response.status_code"])
+	assert.NotContains(t, client.Attributes["url.full"], "?")
+}
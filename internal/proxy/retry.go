@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+const (
+	defaultBackoff    = 50 * time.Millisecond
+	defaultMaxBackoff = time.Second
+	defaultCooldown   = 30 * time.Second
+)
+
+type RetryOptions struct {
+	// Attempts is the total number of tries for idempotent requests; zero
+	// or one disables retries. Failed connections, timeouts and 502, 503
+	// and 504 responses are retried.
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for each
+	// further one up to MaxBackoff and jittered. Defaults are 50
+	// milliseconds and one second.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// TryTimeout bounds how long each attempt waits for response headers.
+	// Zero leaves only Options.Timeout.
+	TryTimeout time.Duration
+}
+
+type BreakerOptions struct {
+	// Failures consecutive failed attempts open an upstream's breaker; zero
+	// disables circuit breaking.
+	Failures int
+	// Cooldown is how long an open breaker answers 503, 30 seconds by
+	// default. Afterwards one trial request is let through, and its outcome
+	// closes the breaker or opens it again.
+	Cooldown time.Duration
+}
+
+// CircuitOpenError is returned for requests to an upstream whose breaker
+// is open.
+type CircuitOpenError struct {
+	Upstream   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("proxy: circuit open for %s", e.Upstream)
+}
+
+// upstream is where a single attempt is sent.
+type upstream struct {
+	url *url.URL
+	// done reports the outcome of the attempt once the response headers
+	// have arrived or the exchange has failed.
+	done func(failed bool)
+	// release runs once the attempt's response has been copied or dropped.
+	release func()
+}
+
+// forward sends req to the upstreams returned by next, retrying idempotent
+// requests as opts.Retry allows, and writes the final response to w.
+func forward(w *response.Writer, req *request.Request, opts Options, next func() (upstream, error)) {
+	startMirror(req, opts)
+
+	attempts := 1
+	if opts.Retry.Attempts > 1 && idempotent(req.RequestLine.Method) {
+		attempts = opts.Retry.Attempts
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 && !sleep(req.Context(), backoff(opts.Retry, attempt-1)) {
+			break
+		}
+
+		up, err := next()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, cancel, err := roundTrip(req, up.url, opts)
+		if err != nil {
+			cancel()
+			if req.Context().Err() == nil {
+				up.done(true)
+			}
+			up.release()
+			lastErr = err
+			if req.Context().Err() != nil {
+				break
+			}
+			continue
+		}
+
+		up.done(resp.StatusCode >= 500)
+		if attempt < attempts && retryableStatus(resp.StatusCode) {
+			// Drain the body so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			cancel()
+			up.release()
+			lastErr = fmt.Errorf("proxy: %s answered %d", up.url.Host, resp.StatusCode)
+			continue
+		}
+
+		err = CopyResponse(w, req, resp)
+		resp.Body.Close()
+		cancel()
+		up.release()
+		if err != nil {
+			log.Printf("Error proxying response from %s: %v", up.url.Host, err)
+		}
+		return
+	}
+
+	var circuitErr *CircuitOpenError
+	switch {
+	case errors.As(lastErr, &circuitErr):
+		writeCircuitOpen(w, circuitErr)
+	case errors.Is(lastErr, ErrNoBackend):
+		writeError(w, response.StatusServiceUnavailable, lastErr)
+	default:
+		writeUpstreamError(w, req, lastErr)
+	}
+}
+
+// idempotent reports whether a request with method may be sent twice
+// (RFC 9110 section 9.2.2).
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// backoff returns the delay before the given retry: exponential, capped
+// and jittered over its upper half so retrying clients spread out.
+func backoff(opts RetryOptions, retry int) time.Duration {
+	base, limit := opts.Backoff, opts.MaxBackoff
+	if base <= 0 {
+		base = defaultBackoff
+	}
+	if limit <= 0 {
+		limit = defaultMaxBackoff
+	}
+	d := base
+	for i := 1; i < retry && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	return d/2 + rand.N(d/2+1)
+}
+
+// sleep waits for d, returning false if ctx ends first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func writeCircuitOpen(w *response.Writer, err *CircuitOpenError) {
+	log.Printf("Upstream error: %v", err)
+	seconds := int((err.RetryAfter + time.Second - 1) / time.Second)
+	body := []byte(fmt.Sprintf("%d %s", response.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)))
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "text/plain")
+	h.Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	w.WriteStatusLine(response.StatusServiceUnavailable)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// breakers holds a circuit breaker per upstream host.
+type breakers struct {
+	opts BreakerOptions
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakers(opts BreakerOptions) *breakers {
+	if opts.Cooldown == 0 {
+		opts.Cooldown = defaultCooldown
+	}
+	return &breakers{opts: opts, m: make(map[string]*breaker)}
+}
+
+// upstream returns the attempt for u, or a *CircuitOpenError while its
+// breaker is open.
+func (bs *breakers) upstream(u *url.URL) (upstream, error) {
+	up := upstream{url: u, done: func(bool) {}, release: func() {}}
+	if bs.opts.Failures <= 0 {
+		return up, nil
+	}
+
+	bs.mu.Lock()
+	b, ok := bs.m[u.Host]
+	if !ok {
+		b = &breaker{host: u.Host, opts: bs.opts}
+		bs.m[u.Host] = b
+	}
+	bs.mu.Unlock()
+
+	if retryAfter, ok := b.allow(); !ok {
+		return upstream{}, &CircuitOpenError{Upstream: u.Host, RetryAfter: retryAfter}
+	}
+	up.done = b.record
+	return up, nil
+}
+
+type breaker struct {
+	host string
+	opts BreakerOptions
+
+	mu        sync.Mutex
+	fails     int
+	openUntil time.Time // zero while closed
+}
+
+func (b *breaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return 0, true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now), false
+	}
+	// Half-open: let this request through as the trial and hold others back
+	// for another cooldown, or until the trial reports.
+	b.openUntil = now.Add(b.opts.Cooldown)
+	return 0, true
+}
+
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.fails = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.fails++
+	if b.fails >= b.opts.Failures || !b.openUntil.IsZero() {
+		if b.openUntil.IsZero() {
+			log.Printf("Circuit opened for %s after %d consecutive failures", b.host, b.fails)
+		}
+		b.fails = 0
+		b.openUntil = time.Now().Add(b.opts.Cooldown)
+	}
+}
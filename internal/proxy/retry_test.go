@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyUpstream fails the first failures requests with status, or by
+// stalling when status is zero, and then answers "ok".
+func flakyUpstream(t *testing.T, failures int32, status int) (*url.URL, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			if status == 0 {
+				time.Sleep(200 * time.Millisecond)
+			} else {
+				w.WriteHeader(status)
+			}
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	return target, &calls
+}
+
+func TestRetries(t *testing.T) {
+	retry := RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+
+	// Test: Idempotent requests are retried after 5xx responses
+	target, calls := flakyUpstream(t, 2, http.StatusServiceUnavailable)
+	addr := serveProxy(t, target, Options{Retry: retry})
+	status, body := fetch(t, addr, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Test: The last failure is passed on once attempts run out
+	target, calls = flakyUpstream(t, 5, http.StatusBadGateway)
+	addr = serveProxy(t, target, Options{Retry: retry})
+	status, _ = fetch(t, addr, nil)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Test: 500 is not retried
+	target, calls = flakyUpstream(t, 1, http.StatusInternalServerError)
+	addr = serveProxy(t, target, Options{Retry: retry})
+	status, _ = fetch(t, addr, nil)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Test: POST is not retried
+	target, calls = flakyUpstream(t, 1, http.StatusServiceUnavailable)
+	addr = serveProxy(t, target, Options{Retry: retry})
+	resp, err := http.Post(addr, "text/plain", strings.NewReader("once"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Test: A stalled attempt times out and the retry succeeds
+	target, calls = flakyUpstream(t, 1, 0)
+	addr = serveProxy(t, target, Options{Retry: RetryOptions{Attempts: 2, Backoff: time.Millisecond, TryTimeout: 50 * time.Millisecond}})
+	start := time.Now()
+	status, body = fetch(t, addr, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	// Test: A try timeout without retries is a 504
+	target, _ = flakyUpstream(t, 1, 0)
+	addr = serveProxy(t, target, Options{Retry: RetryOptions{TryTimeout: 50 * time.Millisecond}})
+	status, _ = fetch(t, addr, nil)
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+}
+
+func TestBackoff(t *testing.T) {
+	opts := RetryOptions{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for retry, limit := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 10: 300} {
+		limit *= time.Millisecond
+		for range 20 {
+			d := backoff(opts, retry)
+			assert.GreaterOrEqual(t, d, limit/2)
+			assert.LessOrEqual(t, d, limit)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	target, calls := flakyUpstream(t, 3, http.StatusInternalServerError)
+	addr := serveProxy(t, target, Options{Breaker: BreakerOptions{Failures: 3, Cooldown: 100 * time.Millisecond}})
+
+	// Test: Consecutive failures open the breaker
+	for range 3 {
+		status, _ := fetch(t, addr, nil)
+		assert.Equal(t, http.StatusInternalServerError, status)
+	}
+	resp, err := http.Get(addr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, int32(3), calls.Load(), "the upstream is spared while open")
+
+	// Test: A successful trial after the cooldown closes it
+	time.Sleep(120 * time.Millisecond)
+	status, body := fetch(t, addr, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	status, _ = fetch(t, addr, nil)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := &breaker{host: "upstream", opts: BreakerOptions{Failures: 2, Cooldown: 50 * time.Millisecond}}
+
+	// Test: Opens after the configured failures
+	b.record(true)
+	_, ok := b.allow()
+	assert.True(t, ok)
+	b.record(true)
+	retryAfter, ok := b.allow()
+	assert.False(t, ok)
+	assert.InDelta(t, 50*time.Millisecond, retryAfter, float64(10*time.Millisecond))
+
+	// Test: Only one trial is let through and its failure reopens
+	time.Sleep(60 * time.Millisecond)
+	_, ok = b.allow()
+	assert.True(t, ok)
+	_, ok = b.allow()
+	assert.False(t, ok)
+	b.record(true)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// Test: A successful trial closes
+	time.Sleep(60 * time.Millisecond)
+	_, ok = b.allow()
+	assert.True(t, ok)
+	b.record(false)
+	_, ok = b.allow()
+	assert.True(t, ok)
+}
+
+func TestPoolRetries(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	a.failing.Store(true)
+	pool := newPool(t, PoolOptions{MaxFails: -1}, nil, a, b)
+	s := servePoolWith(t, pool, Options{
+		Retry:   RetryOptions{Attempts: 2, Backoff: time.Millisecond},
+		Breaker: BreakerOptions{Failures: 1, Cooldown: time.Minute},
+	})
+
+	// Test: A 500 is passed on and opens the backend's breaker
+	status, _ := fetch(t, s, nil)
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	// Test: An open breaker makes the retry pick another backend
+	for range 4 {
+		status, body := fetch(t, s, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "b", body)
+	}
+}
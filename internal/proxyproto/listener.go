@@ -0,0 +1,177 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReadHeaderTimeout = 5 * time.Second
+
+var (
+	ErrUntrusted     = errors.New("proxyproto: header from untrusted source")
+	ErrMissingHeader = errors.New("proxyproto: missing header")
+)
+
+type Options struct {
+	// Trusted lists the addresses or CIDR ranges of the proxies allowed to
+	// send headers. Connections from anywhere else that start with a header
+	// are rejected.
+	Trusted []string
+	// Required rejects connections from trusted sources that do not start
+	// with a header. Otherwise they keep their own addresses.
+	Required bool
+	// ReadHeaderTimeout bounds reading the header, 5 seconds by default.
+	ReadHeaderTimeout time.Duration
+}
+
+// Listener wraps accepted connections in Conns that read a PROXY protocol
+// header before anything else.
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+	opts    Options
+}
+
+// NewListener returns a Listener accepting from l.
+func NewListener(l net.Listener, opts Options) (*Listener, error) {
+	if len(opts.Trusted) == 0 {
+		return nil, errors.New("proxyproto: no trusted sources")
+	}
+	if opts.ReadHeaderTimeout == 0 {
+		opts.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+
+	trusted := make([]netip.Prefix, 0, len(opts.Trusted))
+	for _, source := range opts.Trusted {
+		if !strings.Contains(source, "/") {
+			addr, err := netip.ParseAddr(source)
+			if err != nil {
+				return nil, fmt.Errorf("proxyproto: bad trusted source %q: %w", source, err)
+			}
+			source = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(source)
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: bad trusted source %q: %w", source, err)
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return &Listener{Listener: l, trusted: trusted, opts: opts}, nil
+}
+
+// Accept returns the next connection without reading from it, so a slow
+// client cannot hold up the accept loop. The header is read on first use.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, br: bufio.NewReader(conn), listener: l}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose addresses come from its PROXY protocol
+// header, when it has one.
+type Conn struct {
+	net.Conn
+	br       *bufio.Reader
+	listener *Listener
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// Header reads the header on first use and returns it, or nil when the
+// connection has none. An error means the connection must be closed.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.listener.opts.ReadHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	trusted := c.listener.isTrusted(c.Conn.RemoteAddr())
+	if !trusted {
+		// Only look for a signature, so an untrusted client cannot spoof
+		// its address by sending one.
+		if version, _ := hasSignature(c.br); version != 0 {
+			c.err = ErrUntrusted
+		}
+		return
+	}
+	c.header, c.err = Read(c.br)
+	if c.err == nil && c.header == nil && c.listener.opts.Required {
+		c.err = ErrMissingHeader
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the
+// connection's own address.
+func (c *Conn) RemoteAddr() net.Addr {
+	if header, err := c.Header(); err == nil && header != nil && header.Command == Proxy && header.Source != nil {
+		return header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to from the header,
+// or the connection's own address.
+func (c *Conn) LocalAddr() net.Addr {
+	if header, err := c.Header(); err == nil && header != nil && header.Command == Proxy && header.Destination != nil {
+		return header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr returns the address of the proxy that opened the connection.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying h.
+func NewContext(ctx context.Context, h *Header) context.Context {
+	return context.WithValue(ctx, contextKey{}, h)
+}
+
+// FromContext returns the header of the connection a request arrived on,
+// as stored by the server.
+func FromContext(ctx context.Context) (*Header, bool) {
+	h, ok := ctx.Value(contextKey{}).(*Header)
+	return h, ok
+}
@@ -0,0 +1,424 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The two signatures that open a header (HAProxy PROXY protocol, sections
+// 2.1 and 2.2).
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest v1 line, CRLF included.
+const v1MaxLength = 107
+
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+type Command int
+
+const (
+	// Local connections were opened by the proxy itself, such as health
+	// checks; the connection's own addresses apply.
+	Local Command = iota
+	// Proxy connections are relayed for the client in Source.
+	Proxy
+)
+
+// TLV types of v2 headers (section 2.2.7).
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// Sub-TLV types inside a TypeSSL value.
+const (
+	SubtypeSSLVersion byte = 0x21
+	SubtypeSSLCN      byte = 0x22
+	SubtypeSSLCipher  byte = 0x23
+	SubtypeSSLSigAlg  byte = 0x24
+	SubtypeSSLKeyAlg  byte = 0x25
+)
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version int
+	Command Command
+	// Source and Destination are the client's address and the address it
+	// connected to, or nil when the proxy did not convey them.
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs are the type-length-value extensions of a v2 header.
+	TLVs []TLV
+}
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first extension of type t.
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name the client asked for, typically its SNI.
+func (h *Header) Authority() string {
+	value, _ := h.TLV(TypeAuthority)
+	return string(value)
+}
+
+// ALPN returns the application protocol the client negotiated.
+func (h *Header) ALPN() string {
+	value, _ := h.TLV(TypeALPN)
+	return string(value)
+}
+
+// UniqueID returns the proxy's opaque identifier for the connection.
+func (h *Header) UniqueID() []byte {
+	value, _ := h.TLV(TypeUniqueID)
+	return value
+}
+
+// SSL describes the TLS connection the proxy terminated.
+type SSL struct {
+	// Client holds the PP2_CLIENT_* flags; bit 0 means the client used TLS.
+	Client byte
+	// Verified reports whether the client presented a certificate that
+	// the proxy verified.
+	Verified bool
+	// TLVs are the SSL sub-extensions, such as SubtypeSSLVersion.
+	TLVs []TLV
+}
+
+// SSL parses the TypeSSL extension.
+func (h *Header) SSL() (*SSL, bool) {
+	value, ok := h.TLV(TypeSSL)
+	if !ok || len(value) < 5 {
+		return nil, false
+	}
+	tlvs, err := parseTLVs(value[5:])
+	if err != nil {
+		return nil, false
+	}
+	return &SSL{
+		Client:   value[0],
+		Verified: binary.BigEndian.Uint32(value[1:5]) == 0,
+		TLVs:     tlvs,
+	}, true
+}
+
+// Value returns the value of the first sub-extension of type t.
+func (s *SSL) Value(t byte) string {
+	for _, tlv := range s.TLVs {
+		if tlv.Type == t {
+			return string(tlv.Value)
+		}
+	}
+	return ""
+}
+
+// hasSignature reports whether br starts with a v1 or v2 signature and
+// which. It peeks no further than the signatures allow, so other protocols
+// are left untouched.
+func hasSignature(br *bufio.Reader) (int, error) {
+	for n := 1; n <= len(v2Signature); n++ {
+		peeked, err := br.Peek(n)
+		if err != nil {
+			// A connection too short for a signature is not a header.
+			return 0, nil
+		}
+		switch {
+		case bytes.Equal(peeked, v1Signature):
+			return 1, nil
+		case bytes.Equal(peeked, v2Signature):
+			return 2, nil
+		case !bytes.HasPrefix(v1Signature, peeked) && !bytes.HasPrefix(v2Signature, peeked):
+			return 0, nil
+		}
+	}
+	return 0, nil
+}
+
+// Read parses a header of either version from br. It returns nil without
+// consuming anything when br does not start with a header.
+func Read(br *bufio.Reader) (*Header, error) {
+	version, err := hasSignature(br)
+	if err != nil || version == 0 {
+		return nil, err
+	}
+	if version == 1 {
+		return readV1(br)
+	}
+	return readV2(br)
+}
+
+func readV1(br *bufio.Reader) (*Header, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("%w: v1 line too long", ErrInvalidHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line not terminated by CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{Version: 1, Command: Proxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The receiver must ignore everything past UNKNOWN.
+		header.Command = Local
+		return header, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("%w: malformed v1 line %q", ErrInvalidHeader, line)
+	}
+
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func v1Addr(family, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (family == "TCP4") == strings.Contains(ip, ":") {
+		return nil, fmt.Errorf("%w: bad %s address %q", ErrInvalidHeader, family, ip)
+	}
+	// Ports are decimal without leading zeros.
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || port != strconv.FormatUint(p, 10) {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(br *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version %d", ErrInvalidHeader, verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case 0x0:
+		header.Command = Local
+	case 0x1:
+		header.Command = Proxy
+	default:
+		return nil, fmt.Errorf("%w: v2 command %d", ErrInvalidHeader, verCmd&0x0f)
+	}
+
+	var addrLen int
+	switch family >> 4 {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("%w: v2 address family %d", ErrInvalidHeader, family>>4)
+	}
+	if length < addrLen {
+		return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidHeader)
+	}
+
+	// Addresses are ignored for LOCAL, but the TLVs still follow them.
+	if header.Command == Proxy {
+		header.Source, header.Destination = v2Addrs(family, payload[:addrLen])
+	}
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+
+	if _, ok := header.TLV(TypeCRC32C); ok {
+		if err := verifyCRC32C(fixed, payload, addrLen); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+func v2Addrs(family byte, block []byte) (net.Addr, net.Addr) {
+	transport := family & 0x0f
+	ipAddr := func(ip net.IP, port uint16) net.Addr {
+		if transport == 0x2 { // DGRAM
+			return &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	switch family >> 4 {
+	case 0x1:
+		return ipAddr(net.IP(block[0:4]), binary.BigEndian.Uint16(block[8:10])),
+			ipAddr(net.IP(block[4:8]), binary.BigEndian.Uint16(block[10:12]))
+	case 0x2:
+		return ipAddr(net.IP(block[0:16]), binary.BigEndian.Uint16(block[32:34])),
+			ipAddr(net.IP(block[16:32]), binary.BigEndian.Uint16(block[34:36]))
+	case 0x3:
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: cString(block[:108]), Net: network},
+			&net.UnixAddr{Name: cString(block[108:216]), Net: network}
+	}
+	return nil, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		length := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return nil, fmt.Errorf("%w: TLV of type %#x overruns the header", ErrInvalidHeader, b[0])
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+length]})
+		b = b[3+length:]
+	}
+	return tlvs, nil
+}
+
+// verifyCRC32C checks the checksum TLV, computed over the whole header with
+// the checksum itself zeroed (section 2.2.7). The TLVs start at offset in
+// payload and have already been parsed.
+func verifyCRC32C(fixed, payload []byte, offset int) error {
+	zeroed := append([]byte{}, payload...)
+	var want uint32
+	for offset < len(zeroed) {
+		length := int(binary.BigEndian.Uint16(zeroed[offset+1 : offset+3]))
+		if zeroed[offset] == TypeCRC32C {
+			if length != 4 {
+				return fmt.Errorf("%w: CRC32C TLV of %d bytes", ErrInvalidHeader, length)
+			}
+			want = binary.BigEndian.Uint32(zeroed[offset+3 : offset+7])
+			clear(zeroed[offset+3 : offset+7])
+			break
+		}
+		offset += 3 + length
+	}
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc.Write(fixed)
+	crc.Write(zeroed)
+	if crc.Sum32() != want {
+		return fmt.Errorf("%w: CRC32C mismatch", ErrInvalidHeader)
+	}
+	return nil
+}
+
+// Format encodes h as a header of its Version, for sending to a backend
+// that expects the PROXY protocol. A v1 header carries no TLVs.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("proxyproto: unknown version %d", h.Version)
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	if h.Command == Local || !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	family := "TCP6"
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var family byte
+	var block []byte
+	if h.Command == Proxy {
+		src, srcOK := h.Source.(*net.TCPAddr)
+		dst, dstOK := h.Destination.(*net.TCPAddr)
+		if !srcOK || !dstOK {
+			return nil, errors.New("proxyproto: v2 formatting needs TCP addresses")
+		}
+		if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+			family = 0x11
+			block = append(append(block, src4...), dst4...)
+		} else {
+			family = 0x21
+			block = append(append(block, src.IP.To16()...), dst.IP.To16()...)
+		}
+		block = binary.BigEndian.AppendUint16(block, uint16(src.Port))
+		block = binary.BigEndian.AppendUint16(block, uint16(dst.Port))
+	}
+	for _, tlv := range h.TLVs {
+		block = append(block, tlv.Type)
+		block = binary.BigEndian.AppendUint16(block, uint16(len(tlv.Value)))
+		block = append(block, tlv.Value...)
+	}
+	if len(block) > 0xffff {
+		return nil, errors.New("proxyproto: v2 header too long")
+	}
+
+	out := append([]byte{}, v2Signature...)
+	out = append(out, 0x20|byte(h.Command), family)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(block)))
+	return append(out, block...), nil
+}
@@ -0,0 +1,317 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func read(t *testing.T, data []byte) (*Header, string, error) {
+	t.Helper()
+	br := bufio.NewReader(bytes.NewReader(data))
+	header, err := Read(br)
+	rest, _ := io.ReadAll(br)
+	return header, string(rest), err
+}
+
+func TestReadV1(t *testing.T) {
+	// Test: TCP4
+	header, rest, err := read(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, header.Version)
+	assert.Equal(t, Proxy, header.Command)
+	assert.Equal(t, "192.0.2.1:56324", header.Source.String())
+	assert.Equal(t, "198.51.100.2:443", header.Destination.String())
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	// Test: TCP6
+	header, _, err = read(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4242 80\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4242", header.Source.String())
+
+	// Test: UNKNOWN ignores the rest of the line
+	header, rest, err = read(t, []byte("PROXY UNKNOWN ffff::1 whatever\r\nbody"))
+	require.NoError(t, err)
+	assert.Equal(t, Local, header.Command)
+	assert.Nil(t, header.Source)
+	assert.Equal(t, "body", rest)
+
+	// Test: No header leaves the stream untouched
+	header, rest, err = read(t, []byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Nil(t, header)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+	header, rest, err = read(t, []byte("PROX"))
+	require.NoError(t, err)
+	assert.Nil(t, header)
+	assert.Equal(t, "PROX", rest)
+
+	// Test: Malformed lines
+	for _, line := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP6 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 01 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 70000 2\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	} {
+		_, _, err = read(t, []byte(line))
+		assert.ErrorIs(t, err, ErrInvalidHeader, line)
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	// Test: IPv4 with TLVs, built by hand from the specification
+	data, _ := hex.DecodeString("0d0a0d0a000d0a515549540a" + // signature
+		"21" + "11" + "001f" + // v2 PROXY, TCP over IPv4, 31 bytes
+		"c0000201" + "c6336402" + "dc04" + "01bb" + // 192.0.2.1:56324 -> 198.51.100.2:443
+		"02000b" + hex.EncodeToString([]byte("example.com")) + // AUTHORITY
+		"010002" + hex.EncodeToString([]byte("h2"))) // ALPN
+	header, rest, err := read(t, append(data, "payload"...))
+	require.NoError(t, err)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, Proxy, header.Command)
+	assert.Equal(t, "192.0.2.1:56324", header.Source.String())
+	assert.Equal(t, "198.51.100.2:443", header.Destination.String())
+	assert.Equal(t, "example.com", header.Authority())
+	assert.Equal(t, "h2", header.ALPN())
+	assert.Equal(t, "payload", rest)
+
+	// Test: IPv6 and UDP
+	v6 := &Header{Version: 2, Command: Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}}
+	data, err = v6.Format()
+	require.NoError(t, err)
+	data[13] = 0x22
+	header, _, err = read(t, data)
+	require.NoError(t, err)
+	assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, header.Source)
+
+	// Test: LOCAL skips the addresses
+	data, _ = hex.DecodeString("0d0a0d0a000d0a515549540a" + "20" + "11" + "000c" + "c0000201c6336402dc0401bb")
+	header, _, err = read(t, data)
+	require.NoError(t, err)
+	assert.Equal(t, Local, header.Command)
+	assert.Nil(t, header.Source)
+
+	// Test: Unix sockets
+	block := make([]byte, 216)
+	copy(block, "/var/run/src.sock")
+	copy(block[108:], "/var/run/dst.sock")
+	data = append(append([]byte{}, v2Signature...), 0x21, 0x31, 0, 216)
+	header, _, err = read(t, append(data, block...))
+	require.NoError(t, err)
+	assert.Equal(t, &net.UnixAddr{Name: "/var/run/src.sock", Net: "unix"}, header.Source)
+
+	// Test: Invalid headers
+	for name, tail := range map[string]string{
+		"version":         "11" + "11" + "000c" + "c0000201c6336402dc0401bb",
+		"command":         "22" + "11" + "000c" + "c0000201c6336402dc0401bb",
+		"family":          "21" + "41" + "0000",
+		"short address":   "21" + "11" + "0004" + "c0000201",
+		"truncated TLV":   "21" + "11" + "000e" + "c0000201c6336402dc0401bb" + "0200",
+		"overrunning TLV": "21" + "11" + "0010" + "c0000201c6336402dc0401bb" + "02000a61",
+	} {
+		data, _ = hex.DecodeString("0d0a0d0a000d0a515549540a" + tail)
+		_, _, err = read(t, data)
+		assert.ErrorIs(t, err, ErrInvalidHeader, name)
+	}
+
+	// Test: A truncated header
+	_, _, err = read(t, v2Signature)
+	assert.Error(t, err)
+}
+
+func TestCRC32C(t *testing.T) {
+	h := &Header{Version: 2, Command: Proxy,
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		Destination: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2},
+		TLVs:        []TLV{{Type: TypeCRC32C, Value: make([]byte, 4)}, {Type: TypeNoop, Value: []byte("pad")}},
+	}
+	data, err := h.Format()
+	require.NoError(t, err)
+	sum := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(data[16+12+3:], sum)
+
+	// Test: A matching checksum
+	header, _, err := read(t, data)
+	require.NoError(t, err)
+	assert.Len(t, header.TLVs, 2)
+
+	// Test: A corrupted header
+	data[16]++
+	_, _, err = read(t, data)
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestSSL(t *testing.T) {
+	ssl := []byte{0x07, 0, 0, 0, 0}
+	ssl = append(ssl, SubtypeSSLVersion, 0, 7)
+	ssl = append(ssl, "TLSv1.3"...)
+	ssl = append(ssl, SubtypeSSLCN, 0, 6)
+	ssl = append(ssl, "client"...)
+	h := &Header{TLVs: []TLV{{Type: TypeSSL, Value: ssl}, {Type: TypeUniqueID, Value: []byte{1, 2}}}}
+
+	// Test: The SSL extension and its sub-extensions
+	info, ok := h.SSL()
+	require.True(t, ok)
+	assert.Equal(t, byte(0x07), info.Client)
+	assert.True(t, info.Verified)
+	assert.Equal(t, "TLSv1.3", info.Value(SubtypeSSLVersion))
+	assert.Equal(t, "client", info.Value(SubtypeSSLCN))
+	assert.Equal(t, "", info.Value(SubtypeSSLCipher))
+	assert.Equal(t, []byte{1, 2}, h.UniqueID())
+
+	// Test: A failed verification
+	ssl[4] = 1
+	info, _ = h.SSL()
+	assert.False(t, info.Verified)
+}
+
+func TestFormat(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443}
+
+	// Test: v1
+	data, err := (&Header{Version: 1, Command: Proxy, Source: src, Destination: dst}).Format()
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", string(data))
+	data, err = (&Header{Version: 1, Command: Local}).Format()
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(data))
+
+	// Test: v2 round-trips
+	for _, h := range []*Header{
+		{Version: 2, Command: Proxy, Source: src, Destination: dst, TLVs: []TLV{{Type: TypeAuthority, Value: []byte("example.com")}}},
+		{Version: 2, Command: Proxy,
+			Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}},
+		{Version: 2, Command: Local},
+	} {
+		data, err = h.Format()
+		require.NoError(t, err)
+		parsed, _, err := read(t, data)
+		require.NoError(t, err)
+		assert.Equal(t, h.Command, parsed.Command)
+		assert.Equal(t, h.TLVs, parsed.TLVs)
+		if h.Source != nil {
+			assert.Equal(t, h.Source.String(), parsed.Source.String())
+			assert.Equal(t, h.Destination.String(), parsed.Destination.String())
+		}
+	}
+}
+
+func serveListener(t *testing.T, opts Options) (*Listener, chan *Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := NewListener(inner, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	conns := make(chan *Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn.(*Conn)
+		}
+	}()
+	return l, conns
+}
+
+func dialWith(t *testing.T, l net.Listener, data string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, data)
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	l, conns := serveListener(t, Options{Trusted: []string{"127.0.0.0/8"}})
+
+	// Test: A trusted source's header sets the addresses
+	dialWith(t, l, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nhello")
+	conn := <-conns
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.2:443", conn.LocalAddr().String())
+	assert.Contains(t, conn.ProxyAddr().String(), "127.0.0.1:")
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Test: A trusted source may leave the header out
+	dialWith(t, l, "hello")
+	conn = <-conns
+	header, err := conn.Header()
+	require.NoError(t, err)
+	assert.Nil(t, header)
+	assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+
+	// Test: LOCAL keeps the connection's addresses
+	dialWith(t, l, "PROXY UNKNOWN\r\n")
+	conn = <-conns
+	assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+
+	// Test: Unless a header is required
+	l, conns = serveListener(t, Options{Trusted: []string{"127.0.0.1"}, Required: true})
+	dialWith(t, l, "hello")
+	conn = <-conns
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, ErrMissingHeader)
+
+	// Test: Untrusted sources sending a header are rejected
+	l, conns = serveListener(t, Options{Trusted: []string{"10.0.0.0/8"}})
+	dialWith(t, l, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n")
+	conn = <-conns
+	_, err = conn.Header()
+	assert.ErrorIs(t, err, ErrUntrusted)
+	assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+
+	// Test: Untrusted sources without a header are served as is
+	dialWith(t, l, "hello")
+	conn = <-conns
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Test: A stalled header times out
+	l, conns = serveListener(t, Options{Trusted: []string{"127.0.0.1"}, ReadHeaderTimeout: 20 * time.Millisecond})
+	dialWith(t, l, "PROXY TCP4 192.0.2.1")
+	conn = <-conns
+	_, err = conn.Header()
+	assert.Error(t, err)
+}
+
+func TestNewListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+
+	// Test: Trusted sources are required and validated
+	_, err = NewListener(inner, Options{})
+	assert.Error(t, err)
+	_, err = NewListener(inner, Options{Trusted: []string{"not an address"}})
+	assert.Error(t, err)
+	_, err = NewListener(inner, Options{Trusted: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+	_, err = NewListener(inner, Options{Trusted: []string{"::1", "10.1.2.3/8"}})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,39 @@
+package request
+
+import (
+	"crypto/x509"
+)
+
+// VerifiedChain returns the client certificate chain verified during a mutual
+// TLS handshake, leaf first, or nil when the client was not authenticated.
+func (r *Request) VerifiedChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// ClientSubject returns the distinguished name of the verified client
+// certificate, or "" when there is none.
+func (r *Request) ClientSubject() string {
+	chain := r.VerifiedChain()
+	if chain == nil {
+		return ""
+	}
+	return chain[0].Subject.String()
+}
+
+// SPIFFEID returns the spiffe:// URI SAN of the verified client certificate,
+// or "" when there is none.
+func (r *Request) SPIFFEID() string {
+	chain := r.VerifiedChain()
+	if chain == nil {
+		return ""
+	}
+	for _, uri := range chain[0].URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
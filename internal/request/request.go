@@ -2,11 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/pderyuga/httpfromtcp/internal/headers"
@@ -21,11 +24,34 @@ const (
 	requestStateDone
 )
 
+// kind names the part of the request being parsed in state s.
+func (s State) kind() string {
+	switch s {
+	case requestStateInitialized:
+		return "request_line"
+	case requestStateParsingHeaders:
+		return "header"
+	default:
+		return "body"
+	}
+}
+
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       State
+	// TLS holds the negotiated connection state, or nil for plain connections.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the client's address as reported by the connection.
+	RemoteAddr string
+	// LocalAddr is the address the client connected to.
+	LocalAddr string
+	// Timing records when the parts of the request arrived.
+	Timing Timing
+	state  State
+	// buffered holds bytes read past the end of the request.
+	buffered []byte
+	ctx      context.Context
 }
 
 type RequestLine struct {
@@ -34,6 +60,33 @@ type RequestLine struct {
 	Method        string
 }
 
+// Timing records when parsing reached each part of a request.
+type Timing struct {
+	// Start is when the first byte of the request arrived.
+	Start time.Time
+	// HeadersDone and BodyDone are when the headers and the body were
+	// complete.
+	HeadersDone time.Time
+	BodyDone    time.Time
+}
+
+// ParseError is returned by RequestFromReader for requests that are
+// malformed or cut short, as opposed to failed reads.
+type ParseError struct {
+	// Kind is where parsing failed: "incomplete", "request_line", "header"
+	// or "body".
+	Kind string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 const crlf = "\r\n"
 const bufferSize = 8
 
@@ -55,13 +108,16 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
+					return nil, &ParseError{Kind: "incomplete", Err: fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)}
 				}
 				break
 			}
 			return nil, err
 		}
 		readToIndex += numBytesRead
+		if numBytesRead > 0 && req.Timing.Start.IsZero() {
+			req.Timing.Start = time.Now()
+		}
 
 		numBytesParsed, err := req.parse(buf[:readToIndex])
 		if err != nil {
@@ -71,9 +127,48 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		copy(buf, buf[numBytesParsed:])
 		readToIndex -= numBytesParsed
 	}
+	req.buffered = buf[:readToIndex]
 	return req, nil
 }
 
+// Buffered returns the bytes RequestFromReader read past the end of the
+// request, such as a pipelined request or the first bytes of an upgraded
+// protocol.
+func (r *Request) Buffered() []byte {
+	return r.buffered
+}
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects, the server shuts down or the request times out.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r that uses ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// WithValue returns a shallow copy of r whose context carries value under
+// key, for request-scoped data such as request IDs or the authenticated
+// principal. Keys should be unexported types of the package defining them.
+func (r *Request) WithValue(key, value any) *Request {
+	return r.WithContext(context.WithValue(r.Context(), key, value))
+}
+
+// Value returns the request-scoped value stored under key, or nil.
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
@@ -132,7 +227,7 @@ func (r *Request) parse(data []byte) (int, error) {
 	for r.state != requestStateDone {
 		numBytes, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, err
+			return 0, &ParseError{Kind: r.state.kind(), Err: err}
 		}
 		if numBytes == 0 {
 			return totalBytesParsed, nil
@@ -162,27 +257,31 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		}
 		if parsingHeadersDone {
 			r.state = requestStateParsingBody
+			r.Timing.HeadersDone = time.Now()
 		}
 		return numBytes, nil
 	case requestStateParsingBody:
-		numBytes := len(data)
 		contentLengthString, ok := r.Headers.Get("Content-Length")
 		if !ok {
 			r.state = requestStateDone
-			return numBytes, nil
+			r.Timing.BodyDone = r.Timing.HeadersDone
+			return 0, nil
 		}
 
 		contentLength, err := strconv.Atoi(contentLengthString)
 		if err != nil {
 			return 0, fmt.Errorf("Malformed Content-Length header: %s", err)
 		}
-
-		r.Body = append(r.Body, data...)
-		if len(r.Body) > contentLength {
-			return 0, fmt.Errorf("Request body is too large")
+		if contentLength < 0 {
+			return 0, fmt.Errorf("Malformed Content-Length header: %d", contentLength)
 		}
+
+		// Bytes past the body belong to whatever follows the request.
+		numBytes := min(len(data), contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:numBytes]...)
 		if len(r.Body) == contentLength {
 			r.state = requestStateDone
+			r.Timing.BodyDone = time.Now()
 		}
 
 		return numBytes, nil
@@ -1,8 +1,12 @@
 package request
 
 import (
+	"context"
+	"errors"
 	"io"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -218,3 +222,106 @@ func TestRequestBodyParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestRequestParseError(t *testing.T) {
+	for data, kind := range map[string]string{
+		"GET / HTTP/1.1\r\nHost: local":                   "incomplete",
+		"GET /\r\n\r\n":                                   "request_line",
+		"GET / HTTP/1.1\r\nHost : localhost\r\n\r\n":      "header",
+		"POST / HTTP/1.1\r\nContent-Length: nope\r\n\r\n": "body",
+	} {
+		// Test: Errors say where parsing failed
+		_, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 3})
+		var parseErr *ParseError
+		require.True(t, errors.As(err, &parseErr), data)
+		assert.Equal(t, kind, parseErr.Kind, data)
+	}
+
+	// Test: Read errors are passed through
+	_, err := RequestFromReader(iotest.ErrReader(io.ErrClosedPipe))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	var parseErr *ParseError
+	assert.False(t, errors.As(err, &parseErr))
+}
+
+func TestRequestBuffered(t *testing.T) {
+	// Test: Bytes after a body are kept, not parsed as body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"helloGET /next HTTP/1.1\r\n",
+		numBytesPerRead: 1024,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /next HTTP/1.1\r\n", string(r.Buffered())+string(rest))
+
+	// Test: Bytes after a request without a body
+	reader = &chunkReader{
+		data: "GET /chat HTTP/1.1\r\n" +
+			"Upgrade: websocket\r\n" +
+			"\r\n" +
+			"\x81\x85",
+		numBytesPerRead: 1024,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	rest, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\x81\x85", string(r.Buffered())+string(rest))
+
+	// Test: Nothing buffered
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Buffered())
+}
+
+type testKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Background context by default
+	r := &Request{}
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: Request-scoped values
+	r2 := r.WithValue(testKey{}, "abc")
+	assert.Equal(t, "abc", r2.Value(testKey{}))
+	assert.Nil(t, r.Value(testKey{}), "the original request is unchanged")
+
+	// Test: WithContext keeps the parsed request
+	ctx, cancel := context.WithCancel(context.Background())
+	r3 := (&Request{RequestLine: RequestLine{Method: "GET"}}).WithContext(ctx)
+	assert.Equal(t, "GET", r3.RequestLine.Method)
+	cancel()
+	assert.ErrorIs(t, r3.Context().Err(), context.Canceled)
+}
+
+func TestRequestTiming(t *testing.T) {
+	// Test: Each part is timestamped as it completes
+	before := time.Now()
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.Timing.Start.Before(before))
+	assert.False(t, r.Timing.HeadersDone.Before(r.Timing.Start))
+	assert.False(t, r.Timing.BodyDone.Before(r.Timing.HeadersDone))
+
+	// Test: Without a body, the body is done with the headers
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, r.Timing.HeadersDone, r.Timing.BodyDone)
+}
@@ -0,0 +1,98 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const (
+	defaultHeader    = "X-Request-ID"
+	defaultMaxLength = 128
+)
+
+type Options struct {
+	// Header carries the ID in requests and responses, "X-Request-ID" by
+	// default.
+	Header string
+	// MaxLength is the longest incoming ID accepted, 128 by default.
+	MaxLength int
+	// Generate returns a new ID, a random UUID by default.
+	Generate func() string
+}
+
+type contextKey struct{}
+
+// Handler gives every request to next an ID: the one in the request's
+// header if it is valid, or a new one. A valid ID is at most MaxLength
+// letters, digits and "-_.:+/=@".
+//
+// The ID is stored in the request's context, read with FromContext, and
+// in the access log entry. It replaces the request's header, so proxied
+// requests carry it upstream, and is echoed in the response's header.
+func Handler(next server.Handler, opts Options) server.Handler {
+	if opts.Header == "" {
+		opts.Header = defaultHeader
+	}
+	if opts.MaxLength == 0 {
+		opts.MaxLength = defaultMaxLength
+	}
+	if opts.Generate == nil {
+		opts.Generate = NewUUID
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		id, ok := req.Headers.Get(opts.Header)
+		if !ok || !Valid(id, opts.MaxLength) {
+			id = opts.Generate()
+		}
+
+		req.Headers.Override(opts.Header, id)
+		w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+			h.Override(opts.Header, id)
+		})
+		if entry := accesslog.FromContext(req.Context()); entry != nil {
+			entry.RequestID = id
+		}
+		next(w, req.WithValue(contextKey{}, id))
+	}
+}
+
+// FromContext returns the ID of the request of ctx, or "".
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Valid reports whether id is a non-empty ID of at most maxLength
+// characters that are safe to log and forward.
+func Valid(id string, maxLength int) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=' || c == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewUUID returns a random version 4 UUID (RFC 9562).
+func NewUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
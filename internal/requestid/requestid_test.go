@@ -0,0 +1,135 @@
+package requestid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/proxy"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// serve runs h on a request with the given extra header lines and returns
+// the response and the ID seen by the handler.
+func serve(t *testing.T, opts Options, headerLines string) (*http.Response, string) {
+	t.Helper()
+	var seen string
+	h := Handler(func(w *response.Writer, req *request.Request) {
+		seen = FromContext(req.Context())
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, opts)
+
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n" + headerLines + "\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	h(&response.Writer{Writer: &buf}, req)
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	return resp, seen
+}
+
+func TestHandler(t *testing.T) {
+	// Test: A valid incoming ID is kept and echoed
+	resp, seen := serve(t, Options{}, "X-Request-ID: abc-123_DEF.4:5\r\n")
+	assert.Equal(t, "abc-123_DEF.4:5", seen)
+	assert.Equal(t, "abc-123_DEF.4:5", resp.Header.Get("X-Request-ID"))
+
+	// Test: Otherwise a UUID is generated
+	resp, seen = serve(t, Options{}, "")
+	assert.Regexp(t, uuidPattern, seen)
+	assert.Equal(t, seen, resp.Header.Get("X-Request-ID"))
+
+	for _, id := range []string{"has space", "semi;colon", "<script>", strings.Repeat("a", 129), "a, b"} {
+		// Test: Invalid IDs are replaced
+		_, seen = serve(t, Options{}, "X-Request-ID: "+id+"\r\n")
+		assert.Regexp(t, uuidPattern, seen, id)
+	}
+
+	// Test: Custom header, length and generator
+	opts := Options{Header: "X-Correlation-ID", MaxLength: 4, Generate: func() string { return "generated" }}
+	resp, seen = serve(t, opts, "X-Correlation-ID: abcd\r\n")
+	assert.Equal(t, "abcd", seen)
+	assert.Equal(t, "abcd", resp.Header.Get("X-Correlation-ID"))
+	assert.Empty(t, resp.Header.Get("X-Request-ID"))
+	_, seen = serve(t, opts, "X-Correlation-ID: abcde\r\n")
+	assert.Equal(t, "generated", seen)
+}
+
+func TestPropagation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request-ID"))
+	}))
+	defer upstream.Close()
+	target, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	var out lockedBuffer
+	logger, err := accesslog.New(accesslog.Options{Format: accesslog.JSON, Output: &out, Fields: []string{accesslog.FieldRequestID}})
+	require.NoError(t, err)
+	s, err := server.Serve(0, Handler(proxy.Handler(target, proxy.Options{}), Options{}), server.WithAccessLog(logger))
+	require.NoError(t, err)
+	defer s.Close()
+	defer logger.Close()
+
+	// Test: The ID reaches the upstream, the client and the access log
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", s.Addr().(*net.TCPAddr).Port), nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-ID", "from-client")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "from-client", string(body))
+	assert.Equal(t, "from-client", resp.Header.Get("X-Request-ID"))
+
+	var record map[string]any
+	assert.Eventually(t, func() bool {
+		return json.Unmarshal([]byte(out.String()), &record) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "from-client", record["request_id"])
+}
+
+// lockedBuffer is a bytes.Buffer safe for the logger's writer goroutine.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNewUUID(t *testing.T) {
+	// Test: Version 4 UUIDs
+	a, b := NewUUID(), NewUUID()
+	assert.Regexp(t, uuidPattern, a)
+	assert.NotEqual(t, a, b)
+}
@@ -0,0 +1,255 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+)
+
+// maxRanges bounds the number of parts in a multipart/byteranges response.
+const maxRanges = 32
+
+var ErrUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+func (r Range) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header value such as "bytes=0-99,-500" against a
+// representation of the given size. Ranges that start past the end are
+// dropped; if none remain, ErrUnsatisfiableRange is returned.
+func ParseRange(s string, size int64) ([]Range, error) {
+	unit, spec, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, fmt.Errorf("invalid range unit: %s", s)
+	}
+
+	var ranges []Range
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range: %s", part)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, fmt.Errorf("invalid range: %s", part)
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			ranges = append(ranges, Range{Start: size - suffix, Length: suffix})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid range: %s", part)
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid range: %s", part)
+			}
+		}
+		if start >= size {
+			continue
+		}
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, Range{Start: start, Length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ServeContent writes content as the response to req, honoring Range and
+// If-Range. h holds the representation headers (Content-Type, ETag,
+// Last-Modified, ...) and is extended with the framing headers.
+func (w *Writer) ServeContent(req *request.Request, h headers.Headers, content io.ReadSeeker, size int64) error {
+	h.Override("Accept-Ranges", "bytes")
+
+	rangeHeader, ok := req.Headers.Get("Range")
+	if !ok || !rangeApplies(req.Headers, h) || (req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD") {
+		return w.serveFull(req, h, content, size)
+	}
+
+	ranges, err := ParseRange(rangeHeader, size)
+	if errors.Is(err, ErrUnsatisfiableRange) {
+		h.Remove("Content-Type")
+		h.Override("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.Override("Content-Length", "0")
+		if err := w.WriteStatusLine(StatusRangeNotSatisfiable); err != nil {
+			return err
+		}
+		return w.WriteHeaders(h)
+	}
+	if err != nil || len(ranges) > maxRanges || sumLength(ranges) > size {
+		return w.serveFull(req, h, content, size)
+	}
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+			return err
+		}
+		h.Override("Content-Range", r.contentRange(size))
+		h.Override("Content-Length", strconv.FormatInt(r.Length, 10))
+		if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+			return err
+		}
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		if req.RequestLine.Method == "HEAD" {
+			return nil
+		}
+		_, err := io.CopyN(bodyWriter{w}, content, r.Length)
+		return err
+	}
+
+	contentType, _ := h.Get("Content-Type")
+	h.Remove("Content-Type")
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	for _, r := range ranges {
+		if _, err := mw.CreatePart(partHeader(contentType, r, size)); err != nil {
+			return err
+		}
+		counter.n += r.Length
+	}
+	mw.Close()
+
+	h.Override("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.Override("Content-Length", strconv.FormatInt(counter.n, 10))
+	if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+
+	body := multipart.NewWriter(bodyWriter{w})
+	body.SetBoundary(mw.Boundary())
+	for _, r := range ranges {
+		part, err := body.CreatePart(partHeader(contentType, r, size))
+		if err != nil {
+			return err
+		}
+		if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(part, content, r.Length); err != nil {
+			return err
+		}
+	}
+	return body.Close()
+}
+
+func (w *Writer) serveFull(req *request.Request, h headers.Headers, content io.ReadSeeker, size int64) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h.Override("Content-Length", strconv.FormatInt(size, 10))
+	if err := w.WriteStatusLine(StatusOK); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+	_, err := io.CopyN(bodyWriter{w}, content, size)
+	return err
+}
+
+// rangeApplies evaluates If-Range: a range is only honored when the validator
+// still matches the current representation. Weak ETags never match.
+func rangeApplies(reqHeaders, h headers.Headers) bool {
+	ifRange, ok := reqHeaders.Get("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag, ok := h.Get("ETag")
+		return ok && !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+
+	lastModified, ok := h.Get("Last-Modified")
+	if !ok {
+		return false
+	}
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	modTime, err := http.ParseTime(lastModified)
+	return err == nil && modTime.Equal(since)
+}
+
+func partHeader(contentType string, r Range, size int64) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Range", r.contentRange(size))
+	return header
+}
+
+func sumLength(ranges []Range) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	return total
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+type bodyWriter struct {
+	w *Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
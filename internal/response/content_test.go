@@ -0,0 +1,43 @@
+package response
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	// Test: Single closed range
+	ranges, err := ParseRange("bytes=0-99", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 0, Length: 100}}, ranges)
+
+	// Test: Open ended and suffix ranges
+	ranges, err = ParseRange("bytes=900-, -50", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 900, Length: 100}, {Start: 950, Length: 50}}, ranges)
+
+	// Test: Suffix longer than the representation
+	ranges, err = ParseRange("bytes=-5000", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 0, Length: 1000}}, ranges)
+
+	// Test: Unsatisfiable ranges are dropped
+	ranges, err = ParseRange("bytes=2000-3000, 10-19", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 10, Length: 10}}, ranges)
+
+	// Test: No satisfiable range
+	_, err = ParseRange("bytes=1000-", 1000)
+	assert.ErrorIs(t, err, ErrUnsatisfiableRange)
+
+	// Test: Invalid unit
+	_, err = ParseRange("items=0-1", 1000)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsatisfiableRange)
+
+	// Test: Reversed range
+	_, err = ParseRange("bytes=20-10", 1000)
+	require.Error(t, err)
+}
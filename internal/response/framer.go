@@ -0,0 +1,73 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+)
+
+// A Framer puts the parts of a response on the wire for one protocol. Writer
+// enforces the order of the calls; the framer only encodes them. Close is
+// called once the response is complete.
+type Framer interface {
+	WriteStatusLine(statusCode StatusCode) error
+	WriteHeaders(h headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteChunk(p []byte) (int, error)
+	WriteChunkedBodyDone() (int, error)
+	WriteTrailers(h headers.Headers) error
+	Close() error
+}
+
+type http1Framer struct {
+	w io.Writer
+}
+
+func (f http1Framer) WriteStatusLine(statusCode StatusCode) error {
+	_, err := f.w.Write(GetStatusLine(statusCode))
+	return err
+}
+
+func (f http1Framer) WriteHeaders(h headers.Headers) error {
+	return f.writeFieldBlock(h)
+}
+
+func (f http1Framer) WriteBody(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f http1Framer) WriteChunk(p []byte) (int, error) {
+	chunk := make([]byte, 0, len(p)+20)
+	chunk = fmt.Appendf(chunk, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	return f.w.Write(chunk)
+}
+
+func (f http1Framer) WriteChunkedBodyDone() (int, error) {
+	return f.w.Write([]byte("0\r\n"))
+}
+
+func (f http1Framer) WriteTrailers(h headers.Headers) error {
+	return f.writeFieldBlock(h)
+}
+
+func (f http1Framer) Close() error {
+	return nil
+}
+
+func (f http1Framer) writeFieldBlock(h headers.Headers) error {
+	var buf bytes.Buffer
+
+	for name, header := range h {
+		for _, line := range headers.SplitLines(name, header) {
+			headerString := fmt.Sprintf("%s: %s\r\n", name, line)
+			buf.WriteString(headerString)
+		}
+	}
+	buf.WriteString("\r\n")
+	_, err := f.w.Write(buf.Bytes())
+	return err
+}
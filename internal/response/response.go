@@ -1,10 +1,13 @@
 package response
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pderyuga/httpfromtcp/internal/headers"
 )
@@ -12,9 +15,29 @@ import (
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadrequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols   StatusCode = 101
+	StatusOK                   StatusCode = 200
+	StatusPartialContent       StatusCode = 206
+	StatusMovedPermanently     StatusCode = 301
+	StatusNotModified          StatusCode = 304
+	StatusBadrequest           StatusCode = 400
+	StatusForbidden            StatusCode = 403
+	StatusNotFound             StatusCode = 404
+	StatusMethodNotAllowed     StatusCode = 405
+	StatusProxyAuthRequired    StatusCode = 407
+	StatusContentTooLarge      StatusCode = 413
+	StatusUnsupportedMediaType StatusCode = 415
+	StatusRangeNotSatisfiable  StatusCode = 416
+	StatusUpgradeRequired      StatusCode = 426
+	StatusInternalServerError  StatusCode = 500
+	StatusBadGateway           StatusCode = 502
+	StatusServiceUnavailable   StatusCode = 503
+	StatusGatewayTimeout       StatusCode = 504
+)
+
+var (
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
+	ErrHijacked      = errors.New("connection has been hijacked")
 )
 
 type WriterState int
@@ -24,12 +47,93 @@ const (
 	WritingHeaders
 	WritingBody
 	WritingTrailers
+	WritingDone
 )
 
 type Writer struct {
 	Writer       io.Writer
 	WriterState  WriterState
 	BytesWritten int
+	StatusCode   StatusCode
+	// Framer encodes the response for the wire. When nil, HTTP/1.1 framing
+	// is written to Writer.
+	Framer Framer
+	// Hijacker hands the connection to the handler, along with any bytes
+	// read past the request. When nil the connection cannot be hijacked.
+	Hijacker func() (net.Conn, []byte, error)
+	// Timing records the phases of the request and response. The server
+	// fills in the request and handler times before calling the handler.
+	Timing Timing
+
+	hijacked     bool
+	headerHooks  []func(StatusCode, headers.Headers)
+	trailerHooks []func(headers.Headers)
+	finishHooks  []func()
+	newEncoder   func(io.Writer) io.WriteCloser
+	encoder      io.WriteCloser
+	chunked      bool
+}
+
+// OnWriteHeaders registers fn to be called with the status code and headers
+// just before the headers are written, so it can inspect or adjust them.
+func (w *Writer) OnWriteHeaders(fn func(statusCode StatusCode, h headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// OnWriteTrailers registers fn to be called with the trailers just before
+// they are written, so it can add to them. It is only called for chunked
+// responses, whose trailers Finish writes when the handler does not.
+func (w *Writer) OnWriteTrailers(fn func(h headers.Headers)) {
+	w.trailerHooks = append(w.trailerHooks, fn)
+}
+
+// OnFinish registers fn to be called once Finish has completed the
+// response, even when it fails or the connection was hijacked.
+func (w *Writer) OnFinish(fn func()) {
+	w.finishHooks = append(w.finishHooks, fn)
+}
+
+// EncodeBody routes the body through an encoder created by newEncoder once
+// the headers are written. It is meant to be called from an OnWriteHeaders
+// hook, which is also responsible for the matching Content-Encoding header.
+func (w *Writer) EncodeBody(newEncoder func(io.Writer) io.WriteCloser) {
+	w.newEncoder = newEncoder
+}
+
+// Hijack takes over the connection. Whatever the handler wrote so far has
+// already been sent, the Writer refuses further writes, and the server no
+// longer closes the connection or applies timeouts to it. The returned bytes
+// were read from the connection past the end of the request and must be
+// consumed before reading from the connection.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.Hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if err := w.closeEncoder(); err != nil {
+		return nil, nil, err
+	}
+	conn, buffered, err := w.Hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.WriterState = WritingDone
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether the handler took over the connection.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+func (w *Writer) framer() Framer {
+	if w.Framer != nil {
+		return w.Framer
+	}
+	return http1Framer{w.Writer}
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
@@ -37,11 +141,11 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 		return fmt.Errorf("cannot write status line in state %d", w.WriterState)
 	}
 
-	statusLine := GetStatusLine(statusCode)
-	_, err := w.Writer.Write(statusLine)
+	err := w.framer().WriteStatusLine(statusCode)
 	if err != nil {
 		return err
 	}
+	w.StatusCode = statusCode
 	w.WriterState = WritingHeaders
 	return nil
 }
@@ -51,18 +155,21 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		return fmt.Errorf("cannot write headers in state %d", w.WriterState)
 	}
 
-	var buf bytes.Buffer
-
-	for name, header := range headers {
-		headerString := fmt.Sprintf("%s: %s\r\n", name, header)
-		buf.WriteString(headerString)
+	for _, hook := range w.headerHooks {
+		hook(w.StatusCode, headers)
 	}
-	buf.WriteString("\r\n")
-	_, err := w.Writer.Write(buf.Bytes())
+	transferEncoding, _ := headers.Get("Transfer-Encoding")
+	w.chunked = strings.Contains(strings.ToLower(transferEncoding), "chunked")
+
+	err := w.framer().WriteHeaders(headers)
 	if err != nil {
 		return err
 	}
+	w.Timing.FirstByte = time.Now()
 	w.WriterState = WritingBody
+	if w.newEncoder != nil {
+		w.encoder = w.newEncoder(encodedBodyWriter{w})
+	}
 
 	return nil
 }
@@ -72,7 +179,11 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("cannot write body in state %d", w.WriterState)
 	}
 
-	bytesWritten, err := w.Writer.Write(p)
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+
+	bytesWritten, err := w.framer().WriteBody(p)
 	if err != nil {
 		return 0, err
 	}
@@ -85,11 +196,26 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("cannot write body in state %d", w.WriterState)
 	}
 
-	hexadecimalChunkSize := []byte(fmt.Sprintf("%x\r\n", len(p)))
+	if w.encoder != nil {
+		n, err := w.encoder.Write(p)
+		if err != nil {
+			return n, err
+		}
+		if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+			return n, flusher.Flush()
+		}
+		return n, nil
+	}
 
-	p = append(p, []byte("\r\n")...)
-	p = append(hexadecimalChunkSize, p...)
-	bytesWritten, err := w.Writer.Write(p)
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	bytesWritten, err := w.framer().WriteChunk(p)
 	if err != nil {
 		return 0, err
 	}
@@ -102,8 +228,11 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, fmt.Errorf("cannot write body in state %d", w.WriterState)
 	}
 
-	p := []byte("0\r\n")
-	bytesWritten, err := w.Writer.Write(p)
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
+
+	bytesWritten, err := w.framer().WriteChunkedBodyDone()
 	if err != nil {
 		return 0, err
 	}
@@ -118,31 +247,135 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		return fmt.Errorf("cannot write trailers in state %d", w.WriterState)
 	}
 
-	var buf bytes.Buffer
-
-	for name, header := range h {
-		headerString := fmt.Sprintf("%s: %s\r\n", name, header)
-		buf.WriteString(headerString)
+	if h == nil && len(w.trailerHooks) > 0 {
+		h = headers.NewHeaders()
+	}
+	for _, hook := range w.trailerHooks {
+		hook(h)
 	}
-	buf.WriteString("\r\n")
-	_, err := w.Writer.Write(buf.Bytes())
+	err := w.framer().WriteTrailers(h)
 	if err != nil {
 		return err
 	}
+	w.WriterState = WritingDone
 
 	return nil
 }
 
+// Finish completes the response after the handler returns: it flushes any
+// body encoder and terminates a chunked body that was left open.
+func (w *Writer) Finish() error {
+	defer w.runFinishHooks()
+	if w.hijacked {
+		return nil
+	}
+	switch w.WriterState {
+	case WritingBody:
+		if err := w.closeEncoder(); err != nil {
+			return err
+		}
+		// An empty chunked body still needs its last chunk, or the
+		// client keeps waiting for it.
+		if w.chunked && hasBody(w.StatusCode) {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			if err := w.WriteTrailers(nil); err != nil {
+				return err
+			}
+		}
+	case WritingTrailers:
+		if err := w.WriteTrailers(nil); err != nil {
+			return err
+		}
+	}
+	return w.framer().Close()
+}
+
+// hasBody reports whether a response with statusCode may have a body.
+func hasBody(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != 204 && statusCode != StatusNotModified
+}
+
+func (w *Writer) runFinishHooks() {
+	if w.Timing.LastByte.IsZero() {
+		w.Timing.LastByte = time.Now()
+	}
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+	encoder := w.encoder
+	w.encoder = nil
+	return encoder.Close()
+}
+
+// encodedBodyWriter receives the encoder output and writes it to the wire,
+// framing it as chunks when the response is chunked.
+type encodedBodyWriter struct {
+	w *Writer
+}
+
+func (e encodedBodyWriter) Write(p []byte) (int, error) {
+	if e.w.chunked {
+		if _, err := e.w.writeChunk(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	n, err := e.w.framer().WriteBody(p)
+	e.w.BytesWritten += n
+	return n, err
+}
+
 func GetStatusLine(statusCode StatusCode) []byte {
 	reasonPhrase := ""
 
 	switch statusCode {
+	case StatusSwitchingProtocols:
+		reasonPhrase = "Switching Protocols"
 	case StatusOK:
 		reasonPhrase = "OK"
+	case StatusPartialContent:
+		reasonPhrase = "Partial Content"
+	case StatusMovedPermanently:
+		reasonPhrase = "Moved Permanently"
+	case StatusNotModified:
+		reasonPhrase = "Not Modified"
 	case StatusBadrequest:
 		reasonPhrase = "Bad Request"
+	case StatusForbidden:
+		reasonPhrase = "Forbidden"
+	case StatusNotFound:
+		reasonPhrase = "Not Found"
+	case StatusMethodNotAllowed:
+		reasonPhrase = "Method Not Allowed"
+	case StatusProxyAuthRequired:
+		reasonPhrase = "Proxy Authentication Required"
+	case StatusContentTooLarge:
+		reasonPhrase = "Content Too Large"
+	case StatusUnsupportedMediaType:
+		reasonPhrase = "Unsupported Media Type"
+	case StatusRangeNotSatisfiable:
+		reasonPhrase = "Range Not Satisfiable"
+	case StatusUpgradeRequired:
+		reasonPhrase = "Upgrade Required"
 	case StatusInternalServerError:
 		reasonPhrase = "Internal Server Error"
+	case StatusBadGateway:
+		reasonPhrase = "Bad Gateway"
+	case StatusServiceUnavailable:
+		reasonPhrase = "Service Unavailable"
+	case StatusGatewayTimeout:
+		reasonPhrase = "Gateway Timeout"
 	default:
 		reasonPhrase = ""
 	}
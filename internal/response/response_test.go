@@ -0,0 +1,35 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinishEmptyChunked(t *testing.T) {
+	chunked := func() headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		return h
+	}
+
+	// Test: A chunked body with no chunks is still terminated
+	var buf bytes.Buffer
+	w := &Writer{Writer: &buf}
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "transfer-encoding: chunked\r\n\r\n0\r\n\r\n"), buf.String())
+
+	// Test: Responses that cannot have a body get no last chunk
+	buf.Reset()
+	w = &Writer{Writer: &buf}
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(chunked()))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "transfer-encoding: chunked\r\n\r\n"), buf.String())
+}
@@ -0,0 +1,46 @@
+package response
+
+import (
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+)
+
+// Timing records when a request and its response reached each phase. The
+// request's times come from parsing, the handler's from the server, and
+// the Writer records the first and last byte. Times not reached are zero.
+type Timing struct {
+	request.Timing
+	// HandlerStart and HandlerEnd bracket the call to the handler.
+	HandlerStart time.Time
+	HandlerEnd   time.Time
+	// FirstByte is when the response headers were written, and LastByte
+	// when Finish completed the response.
+	FirstByte time.Time
+	LastByte  time.Time
+}
+
+// Phase is the time spent in one part of a request.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Phases returns the phases that were reached, in order: "header" and
+// "body" for reading the request, "handler", and "first-byte" and
+// "last-byte" from the start of the request to the response's first and
+// last byte.
+func (t Timing) Phases() []Phase {
+	var phases []Phase
+	add := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			phases = append(phases, Phase{Name: name, Duration: to.Sub(from)})
+		}
+	}
+	add("header", t.Start, t.HeadersDone)
+	add("body", t.HeadersDone, t.BodyDone)
+	add("handler", t.HandlerStart, t.HandlerEnd)
+	add("first-byte", t.Start, t.FirstByte)
+	add("last-byte", t.Start, t.LastByte)
+	return phases
+}
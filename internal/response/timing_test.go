@@ -0,0 +1,69 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhases(t *testing.T) {
+	start := time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC)
+	ms := func(n int) time.Time { return start.Add(time.Duration(n) * time.Millisecond) }
+
+	// Test: All phases
+	timing := Timing{
+		Timing:       request.Timing{Start: start, HeadersDone: ms(1), BodyDone: ms(3)},
+		HandlerStart: ms(3),
+		HandlerEnd:   ms(10),
+		FirstByte:    ms(5),
+		LastByte:     ms(11),
+	}
+	assert.Equal(t, []Phase{
+		{"header", time.Millisecond},
+		{"body", 2 * time.Millisecond},
+		{"handler", 7 * time.Millisecond},
+		{"first-byte", 5 * time.Millisecond},
+		{"last-byte", 11 * time.Millisecond},
+	}, timing.Phases())
+
+	// Test: Phases not reached are left out
+	timing = Timing{HandlerStart: ms(3), HandlerEnd: ms(4), LastByte: ms(5)}
+	assert.Equal(t, []Phase{{"handler", time.Millisecond}}, timing.Phases())
+}
+
+func TestWriterTiming(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{Writer: &buf}
+	var finished Timing
+	w.OnFinish(func() { finished = w.Timing })
+
+	// Test: The Writer records the first and last byte
+	before := time.Now()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.True(t, w.Timing.FirstByte.IsZero())
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	assert.False(t, w.Timing.FirstByte.Before(before))
+	require.NoError(t, w.Finish())
+	assert.False(t, finished.LastByte.Before(finished.FirstByte), "set before the finish hooks")
+}
+
+func TestOnWriteTrailers(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{Writer: &buf}
+	w.OnWriteTrailers(func(h headers.Headers) { h.Set("X-Checksum", "abc") })
+
+	// Test: Hooks add to the trailers Finish writes
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "2\r\nhi\r\n0\r\nx-checksum: abc\r\n\r\n")
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+// WithAccessLog logs every request to l once its response is complete,
+// over HTTP/1.1 and HTTP/2 alike, along with the requests that could not
+// be parsed. The server does not close l.
+func WithAccessLog(l *accesslog.Logger) Option {
+	return func(s *Server) {
+		s.accessLog = l
+	}
+}
+
+// Observer is told about connections and requests as the server handles
+// them, to keep metrics. Its methods are called concurrently.
+type Observer interface {
+	// ConnAccepted and ConnClosed bracket each connection the server
+	// serves. A hijacked connection counts as closed once its handler
+	// returns.
+	ConnAccepted()
+	ConnClosed()
+	// ParseError is called for each request that could not be parsed, with
+	// the kind of request.ParseError, or "read" when reading failed.
+	ParseError(kind string)
+	// RequestDone is called once each response is complete.
+	RequestDone(entry accesslog.Entry)
+}
+
+// WithObserver reports connections and requests to o. It can be given
+// more than once.
+func WithObserver(o Observer) Option {
+	return func(s *Server) {
+		s.observers = append(s.observers, o)
+	}
+}
+
+// recordRequests wraps handler so that each request is logged and
+// observed when the Writer finishes. The entry travels in the request's
+// context for middleware to add to.
+func (s *Server) recordRequests(handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := req.Timing.Start
+		if start.IsZero() {
+			start = time.Now()
+		}
+		entry := accesslog.NewEntry(req, start)
+		w.OnFinish(func() {
+			s.recordEntry(entry, w)
+		})
+		handler(w, req.WithContext(accesslog.NewContext(req.Context(), &entry)))
+	}
+}
+
+func (s *Server) recordEntry(entry accesslog.Entry, w *response.Writer) {
+	entry.Status = int(w.StatusCode)
+	entry.Bytes = w.BytesWritten
+	entry.Duration = time.Since(entry.Time)
+	entry.Timing = w.Timing
+	if s.accessLog != nil {
+		s.accessLog.Log(entry)
+	}
+	for _, o := range s.observers {
+		o.RequestDone(entry)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe for the logger's writer goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	var out syncBuffer
+	logger, err := accesslog.New(accesslog.Options{Format: accesslog.Common, Output: &out})
+	require.NoError(t, err)
+	defer logger.Close()
+
+	server, err := Serve(0, StripPrefix("/api", protoHandler), WithHTTP2(), WithAccessLog(logger))
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addr().String()
+
+	// Test: HTTP/1.1, logged with the target as received
+	resp, body := getBody(t, http.DefaultClient, "http://"+addr+"/api/plain")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(out.String(), fmt.Sprintf(`"GET /api/plain HTTP/1.1" 200 %d`+"\n", len(body)))
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: HTTP/2
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	_, body = getBody(t, client, "http://"+addr+"/api/h2")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(out.String(), fmt.Sprintf(`"GET /api/h2 HTTP/2" 200 %d`+"\n", len(body)))
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Requests that cannot be parsed
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "NOT HTTP\r\n\r\n")
+	io.ReadAll(conn)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(out.String(), `"-" 400 `)
+	}, time.Second, 10*time.Millisecond)
+}
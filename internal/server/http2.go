@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+
+	"github.com/pderyuga/httpfromtcp/internal/http2"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+)
+
+// WithHTTP2 enables HTTP/2 alongside HTTP/1.1: negotiated with ALPN "h2" on
+// TLS listeners, and on cleartext listeners either with prior knowledge (the
+// connection starts with the HTTP/2 preface) or an "Upgrade: h2c" request.
+func WithHTTP2() Option {
+	return func(s *Server) {
+		s.http2 = true
+	}
+}
+
+// serveHTTP2 takes over conn when the client negotiated HTTP/2 and reports
+// whether it did.
+func (s *Server) serveHTTP2(ctx context.Context, conn net.Conn, br *bufio.Reader, tlsState *tls.ConnectionState) bool {
+	if !s.http2 {
+		return false
+	}
+	if tlsState != nil && tlsState.NegotiatedProtocol != "h2" {
+		return false
+	}
+	if tlsState == nil && !http2.HasPreface(br) {
+		return false
+	}
+
+	opts := http2.ConnOptions{Reader: br, TLS: tlsState, Context: ctx, RequestTimeout: s.requestTimeout}
+	if err := http2.ServeConn(conn, http2.Handler(s.handler), opts); err != nil {
+		log.Printf("HTTP/2 error from %s: %v", conn.RemoteAddr(), err)
+	}
+	return true
+}
+
+// upgradeHTTP2 switches a cleartext connection to HTTP/2 when req carries
+// "Upgrade: h2c", answering req on stream 1, and reports whether it did.
+func (s *Server) upgradeHTTP2(ctx context.Context, conn net.Conn, br *bufio.Reader, req *request.Request) bool {
+	if !s.http2 || req.TLS != nil {
+		return false
+	}
+	settings, ok := http2.IsUpgradeRequest(req)
+	if !ok {
+		return false
+	}
+
+	if _, err := conn.Write(http2.UpgradeResponse); err != nil {
+		return true
+	}
+	reader := io.MultiReader(bytes.NewReader(req.Buffered()), br)
+	opts := http2.ConnOptions{
+		Reader:          reader,
+		Upgrade:         req,
+		UpgradeSettings: settings,
+		Context:         ctx,
+		RequestTimeout:  s.requestTimeout,
+	}
+	if err := http2.ServeConn(conn, http2.Handler(s.handler), opts); err != nil {
+		log.Printf("HTTP/2 error from %s: %v", conn.RemoteAddr(), err)
+	}
+	return true
+}
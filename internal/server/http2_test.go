@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/certs"
+	"github.com/pderyuga/httpfromtcp/internal/http2"
+	"github.com/pderyuga/httpfromtcp/internal/http2/hpack"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func protoHandler(w *response.Writer, req *request.Request) {
+	body := []byte(fmt.Sprintf("%s %s %s", req.RequestLine.HttpVersion, req.RequestLine.Method, req.RequestLine.RequestTarget))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServeHTTP2TLS(t *testing.T) {
+	cert, err := certs.SelfSigned("localhost")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	server, err := Serve(0, protoHandler, WithTLS(TLSOptions{Certificates: []tls.Certificate{cert}}), WithHTTP2())
+	require.NoError(t, err)
+	defer server.Close()
+	url := fmt.Sprintf("https://localhost:%d/tls", server.Addr().(*net.TCPAddr).Port)
+
+	// Test: ALPN negotiates h2
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, body := getBody(t, client, url)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "2 GET /tls", body)
+
+	// Test: Clients without h2 still get HTTP/1.1
+	client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		TLSNextProto:    map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}}
+	resp, body = getBody(t, client, url)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "1.1 GET /tls", body)
+}
+
+func TestServeHTTP2Cleartext(t *testing.T) {
+	server, err := Serve(0, protoHandler, WithHTTP2())
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addr().String()
+
+	// Test: Prior knowledge with concurrent requests on one connection
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := getBody(t, client, fmt.Sprintf("http://%s/stream/%d", addr, i))
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, fmt.Sprintf("2 GET /stream/%d", i), body)
+		}()
+	}
+	wg.Wait()
+
+	// Test: HTTP/1.1 is unaffected
+	resp, body := getBody(t, http.DefaultClient, "http://"+addr+"/plain")
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "1.1 GET /plain", body)
+
+	// Test: Upgrade: h2c answers the request on stream 1
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 4, 0, 0, 0, 5})
+	fmt.Fprintf(conn, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n", settings)
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := status; line != "\r\n"; {
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	_, err = conn.Write([]byte(http2.Preface))
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, &http2.Frame{Type: http2.FrameSettings}))
+
+	decoder := hpack.NewDecoder(4096)
+	var fields []hpack.HeaderField
+	var data strings.Builder
+	for {
+		frame, err := http2.ReadFrame(br, 1<<14)
+		require.NoError(t, err)
+		if frame.StreamID != 1 {
+			continue
+		}
+		switch frame.Type {
+		case http2.FrameHeaders:
+			fields, err = decoder.Decode(frame.Payload)
+			require.NoError(t, err)
+		case http2.FrameData:
+			data.Write(frame.Payload)
+			// The upgrade settings limit the stream window to 5 bytes.
+			if data.Len() == 5 && !frame.Flags.Has(http2.FlagEndStream) {
+				require.NoError(t, http2.WriteFrame(conn, &http2.Frame{Type: http2.FrameWindowUpdate, StreamID: 1, Payload: []byte{0, 0, 1, 0}}))
+			}
+		}
+		if frame.Flags.Has(http2.FlagEndStream) {
+			break
+		}
+	}
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.Equal(t, "2 GET /upgrade", data.String())
+}
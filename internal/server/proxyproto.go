@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/pderyuga/httpfromtcp/internal/proxyproto"
+)
+
+// WithProxyProtocol reads a PROXY protocol v1 or v2 header at the start of
+// every connection from the trusted sources in opts. The addresses it
+// carries become the connection's RemoteAddr and LocalAddr, and handlers
+// can read the whole header with proxyproto.FromContext.
+func WithProxyProtocol(opts proxyproto.Options) Option {
+	return func(s *Server) {
+		s.proxyProtocol = &opts
+	}
+}
+
+// connContext returns the parent context for the requests on conn, which
+// carries the connection's PROXY protocol header. An error means the
+// connection must be dropped.
+func (s *Server) connContext(conn net.Conn) (context.Context, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	proxyConn, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		return s.ctx, nil
+	}
+	header, err := proxyConn.Header()
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return s.ctx, nil
+	}
+	return proxyproto.NewContext(s.ctx, header), nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pderyuga/httpfromtcp/internal/certs"
+	"github.com/pderyuga/httpfromtcp/internal/proxyproto"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addrHandler(w *response.Writer, req *request.Request) {
+	authority := "none"
+	if header, ok := proxyproto.FromContext(req.Context()); ok {
+		authority = header.Authority()
+	}
+	body := []byte(fmt.Sprintf("%s|%s|%s", req.RemoteAddr, req.LocalAddr, authority))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// proxyGet sends preamble and then a request on conn, returning the body
+// or an error when the server drops the connection.
+func proxyGet(conn net.Conn, preamble []byte) (string, error) {
+	defer conn.Close()
+	conn.Write(preamble)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	server, err := Serve(0, addrHandler, WithProxyProtocol(proxyproto.Options{Trusted: []string{"127.0.0.1", "::1"}}))
+	require.NoError(t, err)
+	defer server.Close()
+	addr := fmt.Sprintf("127.0.0.1:%d", server.Addr().(*net.TCPAddr).Port)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Test: v1 header
+	body, err := proxyGet(dial(), []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324|198.51.100.2:443|", body)
+
+	// Test: v2 header with an authority
+	header := &proxyproto.Header{Version: 2, Command: proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeAuthority, Value: []byte("example.com")}},
+	}
+	preamble, err := header.Format()
+	require.NoError(t, err)
+	body, err = proxyGet(dial(), preamble)
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4242|[2001:db8::2]:80|example.com", body)
+
+	// Test: No header keeps the connection's addresses
+	body, err = proxyGet(dial(), nil)
+	require.NoError(t, err)
+	assert.Contains(t, body, "127.0.0.1:")
+	assert.Contains(t, body, "|none")
+
+	// Test: A malformed header drops the connection
+	_, err = proxyGet(dial(), []byte("PROXY TCP4 nonsense\r\n"))
+	assert.Error(t, err)
+}
+
+func TestServeProxyProtocolUntrusted(t *testing.T) {
+	server, err := Serve(0, addrHandler, WithProxyProtocol(proxyproto.Options{Trusted: []string{"10.0.0.0/8"}}))
+	require.NoError(t, err)
+	defer server.Close()
+	addr := fmt.Sprintf("127.0.0.1:%d", server.Addr().(*net.TCPAddr).Port)
+
+	// Test: Headers from untrusted sources drop the connection
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = proxyGet(conn, []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"))
+	assert.Error(t, err)
+
+	// Test: Plain requests from untrusted sources are served
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	body, err := proxyGet(conn, nil)
+	require.NoError(t, err)
+	assert.Contains(t, body, "127.0.0.1:")
+
+	// Test: Invalid trusted sources fail to start
+	_, err = Serve(0, addrHandler, WithProxyProtocol(proxyproto.Options{}))
+	assert.Error(t, err)
+}
+
+func TestServeProxyProtocolTLS(t *testing.T) {
+	cert, err := certs.SelfSigned("localhost")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	server, err := Serve(0, addrHandler,
+		WithProxyProtocol(proxyproto.Options{Trusted: []string{"127.0.0.1"}}),
+		WithTLS(TLSOptions{Certificates: []tls.Certificate{cert}}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Test: The header precedes the TLS handshake
+	raw, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	_, err = io.WriteString(raw, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n")
+	require.NoError(t, err)
+	conn := tls.Client(raw, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	body, err := proxyGet(conn, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324|198.51.100.2:443|", body)
+}
@@ -1,43 +1,121 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/proxyproto"
 	"github.com/pderyuga/httpfromtcp/internal/request"
 	"github.com/pderyuga/httpfromtcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// StripPrefix removes prefix from the request target before calling handler.
+func StripPrefix(prefix string, handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		target := strings.TrimPrefix(req.RequestLine.RequestTarget, prefix)
+		if !strings.HasPrefix(target, "/") {
+			target = "/" + target
+		}
+		req.RequestLine.RequestTarget = target
+		handler(w, req)
+	}
+}
+
+type Option func(*Server)
+
 type Server struct {
-	handler  Handler
-	listener net.Listener
-	port     int
-	closed   atomic.Bool
+	handler    Handler
+	listener   net.Listener
+	port       int
+	closed     atomic.Bool
+	tlsOptions *TLSOptions
+	http2      bool
+	// ctx is the parent of every request context, cancelled by Close.
+	ctx            context.Context
+	cancel         context.CancelFunc
+	requestTimeout time.Duration
+	proxyProtocol  *proxyproto.Options
+	accessLog      *accesslog.Logger
+	observers      []Observer
+}
+
+// WithRequestTimeout sets a deadline on every request's context, d after
+// the request has been read.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	server := Server{
+		handler: handler,
+		port:    port,
+	}
+	for _, opt := range opts {
+		opt(&server)
+	}
+	if server.accessLog != nil || len(server.observers) > 0 {
+		server.handler = server.recordRequests(server.handler)
+	}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
+		server.cancel()
 		return nil, err
 	}
 
-	server := Server{
-		handler:  handler,
-		listener: listener,
-		port:     port,
+	if server.proxyProtocol != nil {
+		// The header precedes the TLS handshake, so it is read beneath it.
+		proxyListener, err := proxyproto.NewListener(listener, *server.proxyProtocol)
+		if err != nil {
+			listener.Close()
+			server.cancel()
+			return nil, err
+		}
+		listener = proxyListener
+	}
+
+	if server.tlsOptions != nil {
+		config, err := server.tlsOptions.config()
+		if err != nil {
+			listener.Close()
+			server.cancel()
+			return nil, err
+		}
+		if server.http2 {
+			config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+		}
+		listener = tls.NewListener(listener, config)
 	}
+	server.listener = listener
 
 	go server.listen()
 
 	return &server, nil
 }
 
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections and cancels the context of every
+// request in flight.
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.cancel()
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -46,7 +124,6 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) listen() {
-	fmt.Printf("Listening on port :%d\n", s.port)
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -63,24 +140,124 @@ func (s *Server) listen() {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	for _, o := range s.observers {
+		o.ConnAccepted()
+	}
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+		for _, o := range s.observers {
+			o.ConnClosed()
+		}
+	}()
+
+	connCtx, err := s.connContext(conn)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state, err := handshake(tlsConn)
+		if err != nil {
+			log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsState = state
+	}
 
-	fmt.Println("Accepted connection from", conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+	if s.serveHTTP2(connCtx, conn, br, tlsState) {
+		return
+	}
 
 	w := response.Writer{Writer: conn, WriterState: response.WritingStatusLine, BytesWritten: 0}
 
-	req, err := request.RequestFromReader(conn)
+	start := time.Now()
+	req, err := request.RequestFromReader(br)
 	if err != nil {
 		w.WriteStatusLine(response.StatusBadrequest)
 		body := []byte(fmt.Sprintf("Error parsing request: %v", err))
 		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
 		w.WriteBody(body)
+		kind := "read"
+		var parseErr *request.ParseError
+		if errors.As(err, &parseErr) {
+			kind = parseErr.Kind
+		}
+		for _, o := range s.observers {
+			o.ParseError(kind)
+		}
+		s.recordEntry(accesslog.Entry{Time: start, RemoteAddr: conn.RemoteAddr().String()}, &w)
+		return
+	}
+
+	req.TLS = tlsState
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.LocalAddr = conn.LocalAddr().String()
+	if s.upgradeHTTP2(connCtx, conn, br, req) {
 		return
 	}
 
+	ctx, cancel := s.requestContext(connCtx)
+	defer cancel()
+	req = req.WithContext(ctx)
+	watcher := watchConn(conn, br, cancel)
+	defer watcher.stop()
+
+	w.Hijacker = func() (net.Conn, []byte, error) {
+		hijacked = true
+		watcher.stop()
+		conn.SetDeadline(time.Time{})
+		buffered := append([]byte{}, req.Buffered()...)
+		peeked, _ := br.Peek(br.Buffered())
+		return conn, append(buffered, peeked...), nil
+	}
+
+	w.Timing.Timing = req.Timing
+	w.Timing.HandlerStart = time.Now()
 	s.handler(&w, req)
+	w.Timing.HandlerEnd = time.Now()
+	w.Finish()
+}
 
-	fmt.Printf("Sent %d bytes as response\n", w.BytesWritten)
+func (s *Server) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout > 0 {
+		return context.WithTimeout(parent, s.requestTimeout)
+	}
+	return context.WithCancel(parent)
+}
 
-	fmt.Println("Connection to ", conn.RemoteAddr(), "closed")
+// connWatcher cancels a request's context when the client closes the
+// connection while the handler runs. It peeks rather than reads, so bytes
+// the client sends meanwhile stay buffered for a hijacker.
+type connWatcher struct {
+	conn     net.Conn
+	stopping atomic.Bool
+	done     chan struct{}
+}
+
+func watchConn(conn net.Conn, br *bufio.Reader, cancel context.CancelFunc) *connWatcher {
+	watcher := &connWatcher{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(watcher.done)
+		if _, err := br.Peek(1); err != nil && !watcher.stopping.Load() {
+			cancel()
+		}
+	}()
+	return watcher
+}
+
+// stop interrupts the pending peek and waits for it to return.
+func (c *connWatcher) stop() {
+	if c.stopping.Swap(true) {
+		<-c.done
+		return
+	}
+	c.conn.SetReadDeadline(time.Unix(1, 0))
+	<-c.done
+	c.conn.SetReadDeadline(time.Time{})
 }
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	handlerDone := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		defer close(handlerDone)
+		w.WriteStatusLine(response.StatusSwitchingProtocols)
+		w.WriteHeaders(nil)
+
+		conn, buffered, err := w.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = w.WriteBody([]byte("late"))
+		assert.Error(t, err)
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+
+		// Echo raw bytes, starting with those read along with the request,
+		// after the handler has returned.
+		go func() {
+			defer conn.Close()
+			conn.Write(buffered)
+			io.Copy(conn, conn)
+		}()
+	}
+
+	server, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Bytes sent with the request reach the hijacker
+	fmt.Fprint(conn, "GET /raw HTTP/1.1\r\nHost: localhost\r\n\r\nearly")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	early := make([]byte, 5)
+	_, err = io.ReadFull(br, early)
+	require.NoError(t, err)
+	assert.Equal(t, "early", string(early))
+
+	// Test: The server leaves the connection open after the handler returns
+	<-handlerDone
+	fmt.Fprint(conn, "ping")
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
+
+func TestHijackHTTP2(t *testing.T) {
+	errs := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		_, _, err := w.Hijack()
+		errs <- err
+	}
+	server, err := Serve(0, handler, WithHTTP2())
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Test: HTTP/2 streams cannot be hijacked
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	_, err = client.Get("http://" + server.Addr().String() + "/")
+	assert.Error(t, err, "the stream is reset when nothing was written")
+	assert.ErrorIs(t, <-errs, response.ErrNotHijackable)
+}
+
+// waitHandler blocks until the request context ends and reports its error.
+func waitHandler(errs chan<- error) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		errs <- req.Context().Err()
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	errs := make(chan error, 1)
+
+	// Test: Client disconnect cancels the context
+	server, err := Serve(0, waitHandler(errs))
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not cancelled on disconnect")
+	}
+
+	// Test: Server shutdown cancels the context
+	conn, err = net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(20 * time.Millisecond)
+	server.Close()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not cancelled on shutdown")
+	}
+
+	// Test: Per-request deadline
+	server, err = Serve(0, waitHandler(errs), WithRequestTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer server.Close()
+	conn, err = net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(2 * time.Second):
+		t.Fatal("request deadline not applied")
+	}
+}
+
+func TestRequestContextHTTP2(t *testing.T) {
+	errs := make(chan error, 1)
+	server, err := Serve(0, waitHandler(errs), WithHTTP2())
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Test: Cancelling an HTTP/2 request resets the stream and cancels the
+	// handler's context
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+server.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	assert.Error(t, err)
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not cancelled on RST_STREAM")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/certs"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+type ClientAuth int
+
+const (
+	// ClientAuthOff never asks clients for a certificate.
+	ClientAuthOff ClientAuth = iota
+	// ClientAuthRequest asks for a certificate and verifies it if one is sent.
+	ClientAuthRequest
+	// ClientAuthRequire rejects handshakes without a verified certificate.
+	ClientAuthRequire
+)
+
+type TLSOptions struct {
+	// Certificates are selected by the SNI server name; the first one is the
+	// default for clients that send no name or an unknown one.
+	Certificates []tls.Certificate
+	// GetCertificate, when set, is used instead of Certificates.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.2 cipher suites. TLS 1.3 suites are
+	// not configurable. Insecure suites are rejected.
+	CipherSuites []uint16
+	// ClientAuth controls client certificate verification against ClientCAs.
+	ClientAuth ClientAuth
+	ClientCAs  *x509.CertPool
+}
+
+// WithTLS makes the server terminate TLS on every accepted connection.
+func WithTLS(opts TLSOptions) Option {
+	return func(s *Server) {
+		s.tlsOptions = &opts
+	}
+}
+
+func (o *TLSOptions) config() (*tls.Config, error) {
+	getCertificate := o.GetCertificate
+	if getCertificate == nil {
+		store, err := certs.NewStore(o.Certificates...)
+		if err != nil {
+			return nil, err
+		}
+		getCertificate = store.GetCertificate
+	}
+
+	minVersion := o.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	if minVersion < tls.VersionTLS12 {
+		return nil, fmt.Errorf("minimum TLS version %s is not supported", tls.VersionName(minVersion))
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if slices.Contains(o.CipherSuites, suite.ID) {
+			return nil, fmt.Errorf("insecure cipher suite %s", suite.Name)
+		}
+	}
+
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   o.CipherSuites,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	switch o.ClientAuth {
+	case ClientAuthOff:
+		config.ClientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode: %d", o.ClientAuth)
+	}
+	if o.ClientAuth != ClientAuthOff {
+		if o.ClientCAs == nil {
+			return nil, fmt.Errorf("client certificate verification needs ClientCAs")
+		}
+		config.ClientCAs = o.ClientCAs
+	}
+
+	return config, nil
+}
+
+func handshake(conn *tls.Conn) (*tls.ConnectionState, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	return &state, nil
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/certs"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tlsInfoHandler(w *response.Writer, req *request.Request) {
+	body := []byte("plain")
+	if req.TLS != nil {
+		body = []byte(fmt.Sprintf("%s|%s|%s", tls.VersionName(req.TLS.Version), tls.CipherSuiteName(req.TLS.CipherSuite), req.TLS.ServerName))
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func tlsGet(t *testing.T, addr string, config *tls.Config) (*tls.ConnectionState, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", config.ServerName)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	state := conn.ConnectionState()
+	return &state, string(body)
+}
+
+func TestServeTLS(t *testing.T) {
+	localCert, err := certs.SelfSigned("localhost", "127.0.0.1")
+	require.NoError(t, err)
+	apiCert, err := certs.SelfSigned("api.test")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(localCert.Leaf)
+	roots.AddCert(apiCert.Leaf)
+
+	server, err := Serve(0, tlsInfoHandler, WithTLS(TLSOptions{
+		Certificates: []tls.Certificate{localCert, apiCert},
+		MinVersion:   tls.VersionTLS12,
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addr().String()
+
+	// Test: Certificate selected by SNI and state exposed on the request
+	state, body := tlsGet(t, addr, &tls.Config{ServerName: "api.test", RootCAs: roots})
+	assert.Equal(t, apiCert.Leaf.Raw, state.PeerCertificates[0].Raw)
+	assert.Equal(t, fmt.Sprintf("TLS 1.3|%s|api.test", tls.CipherSuiteName(state.CipherSuite)), body)
+
+	// Test: Default certificate
+	state, body = tlsGet(t, addr, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	assert.Equal(t, localCert.Leaf.Raw, state.PeerCertificates[0].Raw)
+	assert.Contains(t, body, "|localhost")
+
+	// Test: TLS 1.2 cipher policy
+	state, body = tlsGet(t, addr, &tls.Config{ServerName: "localhost", RootCAs: roots, MaxVersion: tls.VersionTLS12})
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Contains(t, body, "TLS 1.2|")
+
+	// Test: Versions below the minimum are refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: roots, MaxVersion: tls.VersionTLS11})
+	require.Error(t, err)
+}
+
+func TestTLSOptions(t *testing.T) {
+	cert, err := certs.SelfSigned("localhost")
+	require.NoError(t, err)
+
+	// Test: No certificates
+	_, err = (&TLSOptions{}).config()
+	require.Error(t, err)
+
+	// Test: Insecure cipher suite
+	_, err = (&TLSOptions{Certificates: []tls.Certificate{cert}, CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}}).config()
+	require.Error(t, err)
+
+	// Test: Minimum version below TLS 1.2
+	_, err = (&TLSOptions{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS10}).config()
+	require.Error(t, err)
+
+	// Test: Defaults
+	config, err := (&TLSOptions{Certificates: []tls.Certificate{cert}}).config()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issueClient(t *testing.T, commonName, uri string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Internal"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		parsed, err := url.Parse(uri)
+		require.NoError(t, err)
+		template.URIs = []*url.URL{parsed}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func identityHandler(w *response.Writer, req *request.Request) {
+	body := []byte(fmt.Sprintf("%d|%s|%s", len(req.VerifiedChain()), req.ClientSubject(), req.SPIFFEID()))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	serverCert, err := certs.SelfSigned("localhost")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+
+	ca := newTestCA(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	clientCert := ca.issueClient(t, "billing", "spiffe://example.org/ns/prod/sa/billing")
+	strangerCert := newTestCA(t).issueClient(t, "stranger", "")
+
+	requireServer, err := Serve(0, identityHandler, WithTLS(TLSOptions{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   ClientAuthRequire,
+		ClientCAs:    clientCAs,
+	}))
+	require.NoError(t, err)
+	defer requireServer.Close()
+
+	requestServer, err := Serve(0, identityHandler, WithTLS(TLSOptions{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   ClientAuthRequest,
+		ClientCAs:    clientCAs,
+	}))
+	require.NoError(t, err)
+	defer requestServer.Close()
+
+	// Test: Verified identity exposed to the handler
+	_, body := tlsGet(t, requireServer.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: []tls.Certificate{clientCert}})
+	assert.Equal(t, "2|CN=billing,O=Internal|spiffe://example.org/ns/prod/sa/billing", body)
+
+	// Test: Required certificate missing
+	assert.False(t, tlsRoundTrip(requireServer.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots}))
+
+	// Test: Certificate from an untrusted CA
+	assert.False(t, tlsRoundTrip(requireServer.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: []tls.Certificate{strangerCert}}))
+
+	// Test: Optional certificate omitted
+	_, body = tlsGet(t, requestServer.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots})
+	assert.Equal(t, "0||", body)
+
+	// Test: Optional certificate sent
+	_, body = tlsGet(t, requestServer.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: []tls.Certificate{clientCert}})
+	assert.Contains(t, body, "spiffe://example.org/ns/prod/sa/billing")
+
+	// Test: Verification without a CA bundle
+	_, err = (&TLSOptions{Certificates: []tls.Certificate{serverCert}, ClientAuth: ClientAuthRequire}).config()
+	require.Error(t, err)
+}
+
+// tlsRoundTrip reports whether a request over a new connection got a response.
+// With TLS 1.3 a rejected client certificate only surfaces after the handshake.
+func tlsRoundTrip(addr string, config *tls.Config) bool {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	return err == nil
+}
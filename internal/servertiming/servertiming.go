@@ -0,0 +1,78 @@
+package servertiming
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+const headerName = "Server-Timing"
+
+type Options struct {
+	// Trailer sends the timings of chunked responses in a trailer, once
+	// the whole body has been written, rather than in the header.
+	Trailer bool
+}
+
+// Handler reports the phases of each request to next in a Server-Timing
+// field, which browser devtools show alongside their own timings. Phase
+// durations are in milliseconds, named as in response.Timing.Phases.
+//
+// The header is written before the handler is done, so its handler phase
+// only covers the time until then and it has no first or last byte. A
+// trailer has them all.
+func Handler(next server.Handler, opts Options) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		inTrailer := false
+		w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+			if opts.Trailer && chunked(h) {
+				inTrailer = true
+				h.Set("Trailer", headerName)
+				return
+			}
+			timing := w.Timing
+			timing.HandlerEnd = time.Now()
+			if phases := timing.Phases(); len(phases) > 0 {
+				h.Set(headerName, format(phases))
+			}
+		})
+		w.OnWriteTrailers(func(h headers.Headers) {
+			if !inTrailer {
+				return
+			}
+			now := time.Now()
+			timing := w.Timing
+			if timing.HandlerEnd.IsZero() {
+				timing.HandlerEnd = now
+			}
+			timing.LastByte = now
+			h.Set(headerName, format(timing.Phases()))
+		})
+		next(w, req)
+	}
+}
+
+func chunked(h headers.Headers) bool {
+	transferEncoding, _ := h.Get("Transfer-Encoding")
+	return strings.Contains(strings.ToLower(transferEncoding), "chunked")
+}
+
+// format writes phases as Server-Timing metrics, such as
+// "header;dur=0.052, handler;dur=1.5".
+func format(phases []response.Phase) string {
+	var sb strings.Builder
+	for i, phase := range phases {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(phase.Name)
+		sb.WriteString(";dur=")
+		sb.WriteString(strconv.FormatFloat(float64(phase.Duration)/float64(time.Millisecond), 'f', -1, 64))
+	}
+	return sb.String()
+}
@@ -0,0 +1,98 @@
+package servertiming
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var metric = regexp.MustCompile(`^([a-z-]+);dur=[0-9.]+$`)
+
+// metricNames returns the names of the metrics in a Server-Timing value.
+func metricNames(t *testing.T, value string) []string {
+	t.Helper()
+	var names []string
+	for _, m := range strings.Split(value, ", ") {
+		match := metric.FindStringSubmatch(m)
+		require.NotNil(t, match, value)
+		names = append(names, match[1])
+	}
+	return names
+}
+
+func chunkedHandler(w *response.Writer, _ *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("hello"))
+}
+
+func TestHandler(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	serve := func(h server.Handler) *http.Response {
+		var buf bytes.Buffer
+		w := &response.Writer{Writer: &buf}
+		w.Timing.Timing = req.Timing
+		w.Timing.HandlerStart = time.Now()
+		h(w, req)
+		w.Timing.HandlerEnd = time.Now()
+		require.NoError(t, w.Finish())
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		return resp
+	}
+
+	// Test: The header has the phases so far
+	resp := serve(Handler(func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, Options{}))
+	assert.Equal(t, []string{"header", "body", "handler"}, metricNames(t, resp.Header.Get("Server-Timing")))
+
+	// Test: A trailer has them all
+	resp = serve(Handler(chunkedHandler, Options{Trailer: true}))
+	assert.Empty(t, resp.Header.Get("Server-Timing"))
+	assert.Equal(t, []string{"header", "body", "handler", "first-byte", "last-byte"},
+		metricNames(t, resp.Trailer.Get("Server-Timing")))
+
+	// Test: Responses that are not chunked fall back to the header
+	resp = serve(Handler(func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, Options{Trailer: true}))
+	assert.NotEmpty(t, resp.Header.Get("Server-Timing"))
+	assert.Empty(t, resp.Trailer)
+}
+
+func TestServer(t *testing.T) {
+	s, err := server.Serve(0, Handler(chunkedHandler, Options{Trailer: true}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The server records the phases of real requests
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/", s.Addr().(*net.TCPAddr).Port), "text/plain", strings.NewReader("body"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"header", "body", "handler", "first-byte", "last-byte"},
+		metricNames(t, resp.Trailer.Get("Server-Timing")))
+}
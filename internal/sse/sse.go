@@ -0,0 +1,177 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+const defaultKeepAlive = 15 * time.Second
+
+var ErrClosed = errors.New("sse: stream closed")
+
+type Event struct {
+	// Event is the event type; the browser dispatches "message" when empty.
+	Event string
+	// ID is remembered by the browser and sent back as Last-Event-ID when
+	// it reconnects.
+	ID string
+	// Data may span several lines; each becomes its own data: field.
+	Data string
+	// Retry, when positive, changes the browser's reconnection delay.
+	Retry time.Duration
+}
+
+type Options struct {
+	// KeepAlive is the interval between keep-alive comments, 15 seconds by
+	// default. A negative value disables them.
+	KeepAlive time.Duration
+}
+
+// Stream writes Server-Sent Events to one client.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewStream writes the text/event-stream response headers and starts the
+// keep-alive comments. The handler must call Close before it returns.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	s := &Stream{
+		w:           w,
+		lastEventID: lastEventID,
+		done:        make(chan struct{}),
+	}
+	go s.watch(req.Context(), opts.KeepAlive)
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client sent when reconnecting,
+// or "" on the first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the client has gone away, the request context ends or
+// the stream is closed, so producers can stop.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes ev and flushes it to the client.
+func (s *Stream) Send(ev Event) error {
+	if strings.ContainsAny(ev.Event, "\r\n") || strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("sse: event type and id must be single lines")
+	}
+
+	var b strings.Builder
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(&b, ": %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Close stops the keep-alive comments and refuses further events. The
+// response itself is finished by the server once the handler returns.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown()
+	return nil
+}
+
+// shutdown marks the stream closed; s.mu must be held.
+func (s *Stream) shutdown() {
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+func (s *Stream) write(chunk string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	if _, err := s.w.WriteChunkedBody([]byte(chunk)); err != nil {
+		// A failed write means the client is gone.
+		s.shutdown()
+		return err
+	}
+	return nil
+}
+
+// watch sends keep-alive comments and closes the stream once the request
+// context ends, which is when the server sees the client disconnect.
+func (s *Stream) watch(ctx context.Context, keepAlive time.Duration) {
+	var tick <-chan time.Time
+	if keepAlive > 0 {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.Close()
+			return
+		case <-tick:
+			if err := s.Comment("keep-alive"); err != nil {
+				return
+			}
+		}
+	}
+}
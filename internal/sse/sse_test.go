@@ -0,0 +1,150 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(lastEventID string) *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/events", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	if lastEventID != "" {
+		req.Headers.Set("Last-Event-ID", lastEventID)
+	}
+	return req
+}
+
+// syncBuffer is a bytes.Buffer safe for the keep-alive goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func readBody(t *testing.T, raw string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestStream(t *testing.T) {
+	var buf syncBuffer
+	w := &response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}
+	s, err := NewStream(w, newRequest("41"), Options{KeepAlive: -1})
+	require.NoError(t, err)
+
+	// Test: Last-Event-ID
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Event fields and multi-line data
+	require.NoError(t, s.Send(Event{Event: "build", ID: "42", Retry: 3 * time.Second, Data: "line one\r\nline two"}))
+	require.NoError(t, s.Send(Event{Data: ""}))
+	require.NoError(t, s.Comment("hello"))
+
+	// Test: Invalid fields
+	assert.Error(t, s.Send(Event{ID: "4\n2"}))
+
+	// Test: Events are refused after Close
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	<-s.Done()
+	require.NoError(t, w.Finish())
+
+	resp, body := readBody(t, buf.String())
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "event: build\nid: 42\nretry: 3000\ndata: line one\ndata: line two\n\n"+
+		"data: \n\n"+
+		": hello\n\n", body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: Keep-alive comments are flushed while idle
+	var buf syncBuffer
+	w := &response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}
+	s, err := NewStream(w, newRequest(""), Options{KeepAlive: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Count(buf.String(), ": keep-alive\n\n") >= 2
+	}, time.Second, 5*time.Millisecond)
+	s.Close()
+}
+
+type failingWriter struct {
+	mu     sync.Mutex
+	failed bool
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return 0, errors.New("broken pipe")
+	}
+	return len(p), nil
+}
+
+func TestDisconnect(t *testing.T) {
+	// Test: A failed keep-alive signals Done
+	conn := &failingWriter{}
+	w := &response.Writer{Writer: conn, WriterState: response.WritingStatusLine}
+	s, err := NewStream(w, newRequest(""), Options{KeepAlive: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	conn.mu.Lock()
+	conn.failed = true
+	conn.mu.Unlock()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("disconnect not detected")
+	}
+	assert.ErrorIs(t, s.Send(Event{Data: "x"}), ErrClosed)
+}
+
+func TestContextDone(t *testing.T) {
+	// Test: Cancelling the request context signals Done
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf syncBuffer
+	w := &response.Writer{Writer: &buf, WriterState: response.WritingStatusLine}
+	s, err := NewStream(w, newRequest("").WithContext(ctx), Options{KeepAlive: -1})
+	require.NoError(t, err)
+
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context cancellation not detected")
+	}
+}
@@ -0,0 +1,50 @@
+package statsd
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pderyuga/httpfromtcp/internal/accesslog"
+	"github.com/pderyuga/httpfromtcp/internal/metrics"
+)
+
+// Observer reports the standard server metrics through a Client, tagged
+// like their Prometheus counterparts in the metrics package. Pass it to
+// server.WithObserver.
+type Observer struct {
+	client *Client
+	route  func(target string) string
+	active atomic.Int64
+}
+
+// NewObserver returns an Observer sending to c. route maps request targets
+// to the route tag as in metrics.Options; when nil every request is
+// tagged "other".
+func NewObserver(c *Client, route func(target string) string) *Observer {
+	if route == nil {
+		route = metrics.Routes()
+	}
+	return &Observer{client: c, route: route}
+}
+
+func (o *Observer) ConnAccepted() {
+	o.client.Incr("connections.accepted")
+	o.client.Gauge("connections.active", float64(o.active.Add(1)))
+}
+
+func (o *Observer) ConnClosed() {
+	o.client.Gauge("connections.active", float64(o.active.Add(-1)))
+}
+
+func (o *Observer) ParseError(kind string) {
+	o.client.Incr("parse_errors", "type:"+kind)
+}
+
+func (o *Observer) RequestDone(entry accesslog.Entry) {
+	method := "method:" + metrics.Method(entry.Method)
+	route := "route:" + o.route(entry.Target)
+	o.client.Incr("requests", method, route, "status:"+strconv.Itoa(entry.Status))
+	o.client.Timing("request.duration", entry.Duration, method, route)
+	o.client.Count("request.bytes", int64(entry.RequestBytes), method, route)
+	o.client.Count("response.bytes", int64(entry.Bytes), method, route)
+}
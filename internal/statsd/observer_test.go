@@ -0,0 +1,64 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/metrics"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver(t *testing.T) {
+	addr, read := listen(t)
+	c, err := New(Options{Addr: addr, Prefix: "http."})
+	require.NoError(t, err)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("ok"))
+	}
+	o := NewObserver(c, metrics.Routes("/api"))
+	s, err := server.Serve(0, handler, server.WithObserver(o))
+	require.NoError(t, err)
+	url := fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	resp, err := http.Post(url+"/api/items", "text/plain", strings.NewReader("abc"))
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET /\r\n\r\n")
+	io.ReadAll(conn)
+	conn.Close()
+	assert.Eventually(t, func() bool { return o.active.Load() == 0 }, time.Second, 10*time.Millisecond)
+	s.Close()
+	require.NoError(t, c.Close())
+
+	// Test: Connections, requests and parse errors
+	var lines []string
+	for _, packet := range read() {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	assert.Contains(t, lines, "http.connections.accepted:1|c")
+	assert.Contains(t, lines, "http.connections.active:1|g")
+	assert.Contains(t, lines, "http.requests:1|c|#method:POST,route:/api,status:200")
+	assert.Contains(t, lines, "http.request.bytes:3|c|#method:POST,route:/api")
+	assert.Contains(t, lines, "http.response.bytes:2|c|#method:POST,route:/api")
+	assert.Contains(t, lines, "http.parse_errors:1|c|#type:request_line")
+	var timed bool
+	for _, line := range lines {
+		timed = timed || strings.HasPrefix(line, "http.request.duration:") && strings.HasSuffix(line, "|ms|#method:POST,route:/api")
+	}
+	assert.True(t, timed)
+}
@@ -0,0 +1,217 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMaxPacketSize keeps datagrams within a 1500 byte Ethernet
+	// MTU after the IP and UDP headers, as the DogStatsD clients do.
+	defaultMaxPacketSize = 1432
+	defaultFlushInterval = time.Second
+	defaultBufferSize    = 4096
+)
+
+type Options struct {
+	// Addr is the host:port of the StatsD server.
+	Addr string
+	// Prefix is prepended to every metric name, such as "myapp.".
+	Prefix string
+	// Tags are added to every metric as "key:value" or "value". Tags are a
+	// DogStatsD extension that plain StatsD servers do not understand.
+	Tags []string
+	// MaxPacketSize bounds the datagrams lines are batched into, 1432
+	// bytes by default.
+	MaxPacketSize int
+	// FlushInterval is how long a partial datagram waits for more lines,
+	// 1 second by default.
+	FlushInterval time.Duration
+	// BufferSize is how many lines may wait to be sent, 4096 by default.
+	// Lines sent while the buffer is full are dropped rather than holding
+	// up the caller.
+	BufferSize int
+}
+
+// Client sends metrics to a StatsD server over UDP. Its methods never
+// block: lines are queued and batched into datagrams in the background.
+type Client struct {
+	opts Options
+	conn net.Conn
+	tags string
+
+	mu      sync.RWMutex
+	closed  bool
+	lines   chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// New returns a Client sending to opts.Addr.
+func New(opts Options) (*Client, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("statsd: no address")
+	}
+	if opts.MaxPacketSize == 0 {
+		opts.MaxPacketSize = defaultMaxPacketSize
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+
+	c := &Client{
+		opts:  opts,
+		conn:  conn,
+		tags:  joinTags("", opts.Tags),
+		lines: make(chan []byte, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+	go c.send()
+	return c, nil
+}
+
+// Count adds value to a counter.
+func (c *Client) Count(name string, value int64, tags ...string) {
+	c.enqueue(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Incr adds one to a counter.
+func (c *Client) Incr(name string, tags ...string) {
+	c.Count(name, 1, tags...)
+}
+
+// Gauge sets a gauge to value.
+func (c *Client) Gauge(name string, value float64, tags ...string) {
+	c.enqueue(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// Timing records a duration, sent in milliseconds.
+func (c *Client) Timing(name string, d time.Duration, tags ...string) {
+	c.enqueue(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+// Dropped returns how many lines were dropped because the buffer was full
+// or the Client was closed.
+func (c *Client) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+// Close sends the queued lines and closes the socket.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.lines)
+	c.mu.Unlock()
+
+	<-c.done
+	return c.conn.Close()
+}
+
+// enqueue formats a line as "prefix.name:value|type|#tags".
+func (c *Client) enqueue(name, value, kind string, tags []string) {
+	line := make([]byte, 0, len(c.opts.Prefix)+len(name)+len(value)+len(kind)+len(c.tags)+8)
+	line = append(line, sanitize(c.opts.Prefix+name)...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, kind...)
+	if tagList := joinTags(c.tags, tags); tagList != "" {
+		line = append(line, "|#"...)
+		line = append(line, tagList...)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		c.dropped.Add(1)
+		return
+	}
+	select {
+	case c.lines <- line:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// send batches lines into datagrams of at most MaxPacketSize bytes, and
+// sends a partial one once it has waited FlushInterval.
+func (c *Client) send() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	packet := make([]byte, 0, c.opts.MaxPacketSize)
+	flush := func() {
+		if len(packet) > 0 {
+			// Nothing may be listening; UDP errors are not worth reporting.
+			c.conn.Write(packet)
+			packet = packet[:0]
+		}
+	}
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				flush()
+				return
+			}
+			if len(packet) > 0 && len(packet)+1+len(line) > c.opts.MaxPacketSize {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			// A line longer than a datagram is sent on its own.
+			packet = append(packet, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// joinTags appends tags to the comma-separated list base.
+func joinTags(base string, tags []string) string {
+	if len(tags) == 0 {
+		return base
+	}
+	var sb strings.Builder
+	sb.WriteString(base)
+	for _, tag := range tags {
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(tagReplacer.Replace(tag))
+	}
+	return sb.String()
+}
+
+var (
+	nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", "\n", "_")
+	tagReplacer  = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
+
+func sanitize(name string) string {
+	return nameReplacer.Replace(name)
+}
@@ -0,0 +1,114 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen returns a local UDP socket and a function reading its datagrams.
+func listen(t *testing.T) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	read := func() []string {
+		var packets []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return packets
+			}
+			packets = append(packets, string(buf[:n]))
+		}
+	}
+	return conn.LocalAddr().String(), read
+}
+
+func TestClient(t *testing.T) {
+	addr, read := listen(t)
+	c, err := New(Options{Addr: addr, Prefix: "app.", Tags: []string{"env:test"}})
+	require.NoError(t, err)
+
+	c.Incr("hits")
+	c.Count("bytes", 512, "route:/api")
+	c.Gauge("queue.depth", 2.5)
+	c.Timing("latency", 1500*time.Microsecond, "method:GET", "bad,tag|x")
+	c.Incr("bad:name|#")
+	require.NoError(t, c.Close())
+
+	// Test: Lines batched into one datagram, with global and metric tags
+	packets := read()
+	require.Len(t, packets, 1)
+	assert.Equal(t, []string{
+		"app.hits:1|c|#env:test",
+		"app.bytes:512|c|#env:test,route:/api",
+		"app.queue.depth:2.5|g|#env:test",
+		"app.latency:1.5|ms|#env:test,method:GET,bad_tag_x",
+		"app.bad_name__:1|c|#env:test",
+	}, strings.Split(packets[0], "\n"))
+
+	// Test: Closed clients drop lines
+	c.Incr("late")
+	assert.Equal(t, int64(1), c.Dropped())
+	assert.NoError(t, c.Close())
+}
+
+func TestBatching(t *testing.T) {
+	addr, read := listen(t)
+	c, err := New(Options{Addr: addr, MaxPacketSize: 64})
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		c.Incr("requests.total")
+	}
+	c.Incr(strings.Repeat("x", 100))
+	require.NoError(t, c.Close())
+
+	// Test: Datagrams stay within the packet size, except oversized lines
+	var lines []string
+	for _, packet := range read() {
+		packetLines := strings.Split(packet, "\n")
+		if len(packet) > 64 {
+			assert.Len(t, packetLines, 1)
+		}
+		lines = append(lines, packetLines...)
+	}
+	require.Len(t, lines, 51)
+	assert.Equal(t, "requests.total:1|c", lines[0])
+	assert.Equal(t, strings.Repeat("x", 100)+":1|c", lines[50])
+}
+
+func TestFlushInterval(t *testing.T) {
+	addr, read := listen(t)
+	c, err := New(Options{Addr: addr, FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Test: A partial datagram is sent without waiting for Close
+	c.Gauge("temperature", -3)
+	assert.Equal(t, []string{"temperature:-3|g"}, read())
+}
+
+func TestNonBlocking(t *testing.T) {
+	// Test: Nothing listening and a tiny buffer never hold up the caller
+	c, err := New(Options{Addr: "127.0.0.1:9", BufferSize: 1})
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		c.Incr("hits")
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	assert.NoError(t, c.Close())
+
+	// Test: An address is required
+	_, err = New(Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONExporter writes each span as a line of JSON, for local use.
+type JSONExporter struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewJSONExporter returns a JSONExporter writing to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// OpenFile returns a JSONExporter appending to the file at path.
+func OpenFile(path string) (*JSONExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	e := NewJSONExporter(file)
+	e.closer = file
+	return e, nil
+}
+
+type jsonSpan struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_span_id,omitempty"`
+	TraceState string         `json:"trace_state,omitempty"`
+	Name       string         `json:"name"`
+	Kind       SpanKind       `json:"kind"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMS float64        `json:"duration_ms"`
+	Error      bool           `json:"error,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+func (e *JSONExporter) Export(span *SpanData) {
+	line := jsonSpan{
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		TraceState: span.Context.TraceState,
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start,
+		End:        span.End,
+		DurationMS: float64(span.End.Sub(span.Start)) / float64(time.Millisecond),
+		Error:      span.Error,
+		Attributes: span.Attributes,
+	}
+	if span.Parent.IsValid() {
+		line.ParentID = span.Parent.String()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(line); err != nil {
+		log.Printf("Error exporting span %s: %v", line.SpanID, err)
+	}
+}
+
+// Close closes the file opened by OpenFile.
+func (e *JSONExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
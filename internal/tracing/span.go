@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+type SpanKind string
+
+const (
+	KindServer   SpanKind = "server"
+	KindClient   SpanKind = "client"
+	KindInternal SpanKind = "internal"
+)
+
+// Exporter receives each sampled span once it has ended. It is called
+// concurrently, from the goroutine that ended the span.
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+// SpanData is a finished span as seen by an Exporter.
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Error      bool
+	Attributes map[string]any
+}
+
+// Span is an operation being timed. A nil *Span is valid and does nothing,
+// so code can create spans without checking whether the request is traced.
+type Span struct {
+	exporter Exporter
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// Context returns the span's SpanContext, or the zero one for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// SetAttribute records key, replacing any earlier value.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]any)
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the operation as failed.
+func (s *Span) SetError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+}
+
+// End stops the span and exports it if it is sampled. Later calls do
+// nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = maps.Clone(s.data.Attributes)
+	s.mu.Unlock()
+
+	if s.exporter != nil && data.Context.Sampled() {
+		s.exporter.Export(&data)
+	}
+}
+
+// newSpan starts a span in the trace of parent, which must be valid, with
+// its own span ID.
+func newSpan(name string, kind SpanKind, parent SpanContext, exporter Exporter) *Span {
+	sc := parent
+	sc.SpanID = newSpanID()
+	return &Span{
+		exporter: exporter,
+		data: SpanData{
+			Name:    name,
+			Kind:    kind,
+			Context: sc,
+			Parent:  parent.SpanID,
+			Start:   time.Now(),
+		},
+	}
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a child of the span in ctx, exported along with it,
+// and returns a context carrying the child. Without a span in ctx the
+// request is not traced, and it returns ctx and a nil span.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := newSpan(name, kind, parent.data.Context, parent.exporter)
+	return ContextWithSpan(ctx, s), s
+}
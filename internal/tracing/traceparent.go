@@ -0,0 +1,188 @@
+package tracing
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// maxTraceStateMembers is the limit of the W3C Trace Context specification.
+const maxTraceStateMembers = 32
+
+var ErrInvalidTraceparent = errors.New("tracing: invalid traceparent")
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+const flagSampled = 0x01
+
+// SpanContext is what a span passes on to its children, in-process or in
+// the traceparent and tracestate headers.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// TraceState holds the vendor entries of the tracestate header, which
+	// are passed along untouched.
+	TraceState string
+}
+
+// Sampled reports whether the trace is being recorded.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header as in section 3.2 of the
+// W3C Trace Context specification. Versions after 00 are parsed as 00,
+// ignoring anything they add at the end.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := decodeHex(s[0:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(s) != 55 || version[0] > 0 && len(s) > 55 && s[55] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+
+	traceID, ok := decodeHex(s[3:35])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	spanID, ok := decodeHex(s[36:52])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	flags, ok := decodeHex(s[53:55])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hex, which is all traceparent allows.
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// ParseTraceState validates a tracestate header and returns it with empty
+// members and optional whitespace removed. An invalid header must be
+// discarded, as section 3.3 of the specification requires.
+func ParseTraceState(s string) (string, error) {
+	var members []string
+	seen := make(map[string]bool)
+	for _, member := range strings.Split(s, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || !validTraceStateKey(key) || !validTraceStateValue(value) || seen[key] {
+			return "", fmt.Errorf("tracing: invalid tracestate member %q", member)
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > maxTraceStateMembers {
+		return "", fmt.Errorf("tracing: tracestate has %d members, more than %d", len(members), maxTraceStateMembers)
+	}
+	return strings.Join(members, ","), nil
+}
+
+// validTraceStateKey accepts "key" or "tenant@system" keys made of
+// lowercase letters, digits and _-*/, starting with a letter or, for
+// multi-tenant keys, a digit.
+func validTraceStateKey(key string) bool {
+	tenant, system, multiTenant := strings.Cut(key, "@")
+	if !multiTenant {
+		return len(key) <= 256 && isKeyChars(key) && key[0] >= 'a' && key[0] <= 'z'
+	}
+	return len(tenant) <= 241 && len(system) <= 14 && isKeyChars(tenant) && isKeyChars(system) &&
+		system[0] >= 'a' && system[0] <= 'z'
+}
+
+func isKeyChars(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '*' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// validTraceStateValue accepts up to 256 printable ASCII characters except
+// "," and "=", not ending in a space.
+func validTraceStateValue(value string) bool {
+	if value == "" || len(value) > 256 || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	// Test: The example of the specification
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// Test: Not sampled, and unknown flags kept
+	sc, err = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-02")
+	require.NoError(t, err)
+	assert.False(t, sc.Sampled())
+	assert.Equal(t, byte(2), sc.Flags)
+
+	// Test: Future versions may add fields
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds")
+	require.NoError(t, err)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.",
+	} {
+		// Test: Invalid headers
+		_, err := ParseTraceparent(s)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, s)
+	}
+}
+
+func TestParseTraceState(t *testing.T) {
+	// Test: Members are normalized
+	state, err := ParseTraceState("rojo=00f067aa0ba902b7, ,congo=t61rcWkgMzE,\ttenant1@vendor=x y")
+	require.NoError(t, err)
+	assert.Equal(t, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE,tenant1@vendor=x y", state)
+
+	// Test: The member limit
+	members := make([]string, 33)
+	for i := range members {
+		members[i] = fmt.Sprintf("k%d=v", i)
+	}
+	_, err = ParseTraceState(strings.Join(members[:32], ","))
+	assert.NoError(t, err)
+	_, err = ParseTraceState(strings.Join(members, ","))
+	assert.Error(t, err)
+
+	for _, s := range []string{
+		"Rojo=1",
+		"rojo",
+		"rojo=1,rojo=2",
+		"rojo=a=b",
+		"rojo=tab\tinside",
+		"1rojo=1",
+		"tenant@Vendor=1",
+		"tenant@vendorvendorvendor=1",
+		"rojo=" + strings.Repeat("x", 257),
+	} {
+		// Test: Invalid members
+		_, err := ParseTraceState(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestNewIDs(t *testing.T) {
+	// Test: Generated IDs are valid and distinct
+	assert.True(t, newTraceID().IsValid())
+	assert.NotEqual(t, newTraceID(), newTraceID())
+	assert.True(t, newSpanID().IsValid())
+	assert.NotEqual(t, newSpanID(), newSpanID())
+}
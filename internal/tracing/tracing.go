@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/metrics"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+)
+
+type Options struct {
+	// Exporter receives the sampled server spans and their children. When
+	// nil, trace context is still propagated but nothing is recorded.
+	Exporter Exporter
+	// SampleRate is the fraction of new traces sampled, from 0 to 1. Zero
+	// samples none of them. Requests that carry a traceparent keep the
+	// caller's decision.
+	SampleRate float64
+	// Route maps a request target to the http.route attribute and the
+	// span name as in metrics.Options. Targets it maps to "other", all of
+	// them by default, get neither.
+	Route func(target string) string
+}
+
+// Handler traces the requests to next. Each request gets a server span,
+// a child of the caller's span when the request carries a valid
+// traceparent header, stored in the request's context for handlers to
+// extend with StartSpan and for the proxy to propagate. The span ends
+// once the response is complete.
+func Handler(next server.Handler, opts Options) server.Handler {
+	if opts.Route == nil {
+		opts.Route = metrics.Routes()
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		parent, ok := incoming(req)
+		if !ok {
+			parent = SpanContext{TraceID: newTraceID()}
+			if rand.Float64() < opts.SampleRate {
+				parent.Flags |= flagSampled
+			}
+		}
+
+		name := req.RequestLine.Method
+		route := opts.Route(req.RequestLine.RequestTarget)
+		if route != "other" {
+			name += " " + route
+		}
+		span := newSpan(name, KindServer, parent, opts.Exporter)
+		span.SetAttribute("http.request.method", req.RequestLine.Method)
+		if route != "other" {
+			span.SetAttribute("http.route", route)
+		}
+		// The query is left out, as it may carry tokens.
+		path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+		span.SetAttribute("url.path", path)
+		span.SetAttribute("network.protocol.version", req.RequestLine.HttpVersion)
+		span.SetAttribute("client.address", req.RemoteAddr)
+		if userAgent, ok := req.Headers.Get("User-Agent"); ok {
+			span.SetAttribute("user_agent.original", userAgent)
+		}
+
+		w.OnFinish(func() {
+			span.SetAttribute("http.response.status_code", int(w.StatusCode))
+			span.SetAttribute("http.response.body.size", w.BytesWritten)
+			if w.StatusCode >= 500 {
+				span.SetError()
+			}
+			span.End()
+		})
+		next(w, req.WithContext(ContextWithSpan(req.Context(), span)))
+	}
+}
+
+// Inject sets the traceparent and tracestate headers of an outgoing
+// request to continue the trace of sc.
+func Inject(h http.Header, sc SpanContext) {
+	h.Set("Traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set("Tracestate", sc.TraceState)
+	} else {
+		h.Del("Tracestate")
+	}
+}
+
+// incoming returns the caller's span context from the traceparent and
+// tracestate headers. An invalid tracestate is dropped on its own.
+func incoming(req *request.Request) (SpanContext, bool) {
+	traceparent, ok := req.Headers.Get("traceparent")
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if tracestate, ok := req.Headers.Get("tracestate"); ok {
+		sc.TraceState, _ = ParseTraceState(tracestate)
+	}
+	return sc, true
+}
@@ -0,0 +1,202 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pderyuga/httpfromtcp/internal/metrics"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (e *recordingExporter) Export(span *SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// serve runs h on a request with the given extra header lines and
+// returns the response, after finishing the Writer as the server does.
+func serve(t *testing.T, h func(*response.Writer, *request.Request), headerLines string) *http.Response {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /api/items?id=1 HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\n" + headerLines + "\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	var buf bytes.Buffer
+	w := &response.Writer{Writer: &buf}
+	h(w, req)
+	w.Finish()
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestHandler(t *testing.T) {
+	exporter := &recordingExporter{}
+	var seen SpanContext
+	next := func(w *response.Writer, req *request.Request) {
+		ctx, child := StartSpan(req.Context(), "load items", KindInternal)
+		child.SetAttribute("items", 3)
+		child.End()
+		assert.Equal(t, child, SpanFromContext(ctx))
+
+		seen = SpanFromContext(req.Context()).Context()
+		w.WriteStatusLine(response.StatusInternalServerError)
+		w.WriteHeaders(response.GetDefaultHeaders(4))
+		w.WriteBody([]byte("oops"))
+	}
+	h := Handler(next, Options{Exporter: exporter, SampleRate: 1, Route: metrics.Routes("/api")})
+
+	// Test: A new trace with a server span and a child
+	serve(t, h, "")
+	require.Len(t, exporter.spans, 2)
+	child, server := exporter.spans[0], exporter.spans[1]
+	assert.Equal(t, "GET /api", server.Name)
+	assert.Equal(t, KindServer, server.Kind)
+	assert.Equal(t, seen, server.Context)
+	assert.True(t, server.Context.Sampled())
+	assert.False(t, server.Parent.IsValid())
+	assert.True(t, server.Error)
+	assert.False(t, server.End.Before(server.Start))
+	assert.Equal(t, map[string]any{
+		"http.request.method":       "GET",
+		"http.route":                "/api",
+		"url.path":                  "/api/items",
+		"network.protocol.version":  "1.1",
+		"client.address":            "192.0.2.1:1234",
+		"user_agent.original":       "test",
+		"http.response.status_code": 500,
+		"http.response.body.size":   4,
+	}, server.Attributes)
+	assert.Equal(t, "load items", child.Name)
+	assert.Equal(t, server.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, server.Context.SpanID, child.Parent)
+	assert.Equal(t, map[string]any{"items": 3}, child.Attributes)
+
+	// Test: The caller's trace continues, with its tracestate
+	exporter.spans = nil
+	serve(t, h, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: rojo=00f067aa0ba902b7\r\n")
+	require.Len(t, exporter.spans, 2)
+	server = exporter.spans[1]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.Context.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.String())
+	assert.NotEqual(t, server.Parent, server.Context.SpanID)
+	assert.Equal(t, "rojo=00f067aa0ba902b7", server.Context.TraceState)
+
+	// Test: An invalid tracestate is dropped on its own
+	exporter.spans = nil
+	serve(t, h, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: Invalid\r\n")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", exporter.spans[1].Context.TraceID.String())
+	assert.Equal(t, "", exporter.spans[1].Context.TraceState)
+
+	// Test: The caller's decision not to sample is kept
+	exporter.spans = nil
+	serve(t, h, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n")
+	assert.Empty(t, exporter.spans)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", seen.TraceID.String())
+
+	// Test: An invalid traceparent starts a new trace
+	serve(t, h, "traceparent: 00-00000000000000000000000000000000-00f067aa0ba902b7-01\r\n")
+	require.Len(t, exporter.spans, 2)
+	assert.NotEqual(t, "00000000000000000000000000000000", exporter.spans[1].Context.TraceID.String())
+
+	// Test: New traces can be sampled out
+	exporter.spans = nil
+	serve(t, Handler(next, Options{Exporter: exporter, SampleRate: 1e-12}), "")
+	assert.Empty(t, exporter.spans)
+	assert.False(t, seen.Sampled())
+
+	// Test: None are sampled by default, and unknown routes are left out
+	serve(t, Handler(next, Options{Exporter: exporter}), "")
+	assert.Empty(t, exporter.spans)
+	serve(t, Handler(next, Options{Exporter: exporter, SampleRate: 1}), "")
+	require.Len(t, exporter.spans, 2)
+	assert.Equal(t, "GET", exporter.spans[1].Name)
+	assert.NotContains(t, exporter.spans[1].Attributes, "http.route")
+}
+
+func TestNilSpan(t *testing.T) {
+	// Test: Untraced requests get nil spans that do nothing
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	ctx, span := StartSpan(req.Context(), "untraced", KindInternal)
+	assert.Nil(t, span)
+	assert.Equal(t, req.Context(), ctx)
+	span.SetAttribute("key", "value")
+	span.SetError()
+	span.End()
+	assert.False(t, span.Context().IsValid())
+}
+
+func TestInject(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	// Test: Headers of an outgoing request replace the incoming ones
+	h := http.Header{"Tracestate": {"stale=1"}}
+	Inject(h, sc)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", h.Get("Traceparent"))
+	assert.Empty(t, h.Values("Tracestate"))
+	sc.TraceState = "rojo=1"
+	Inject(h, sc)
+	assert.Equal(t, "rojo=1", h.Get("Tracestate"))
+}
+
+func TestJSONExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := OpenFile(path)
+	require.NoError(t, err)
+	next := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	h := Handler(next, Options{Exporter: exporter, SampleRate: 1, Route: metrics.Routes("/api")})
+	serve(t, h, "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: rojo=1\r\n")
+	serve(t, h, "")
+	require.NoError(t, exporter.Close())
+
+	// Test: One JSON object per line
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var span map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &span))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", span["parent_span_id"])
+	assert.Len(t, span["span_id"], 16)
+	assert.Equal(t, "rojo=1", span["trace_state"])
+	assert.Equal(t, "GET /api", span["name"])
+	assert.Equal(t, "server", span["kind"])
+	assert.Contains(t, span, "start")
+	assert.Contains(t, span, "duration_ms")
+	assert.Equal(t, float64(200), span["attributes"].(map[string]any)["http.response.status_code"])
+	assert.NotContains(t, span, "error")
+
+	span = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &span))
+	assert.NotContains(t, span, "parent_span_id")
+
+	// Test: Writers
+	var buf bytes.Buffer
+	NewJSONExporter(&buf).Export(&SpanData{Name: "op", Kind: KindClient})
+	line, err := io.ReadAll(&buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(line), `"name":"op","kind":"client"`)
+}
@@ -0,0 +1,403 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseInternalServerErr  = 1011
+)
+
+const (
+	maxControlPayload = 125
+	closeTimeout      = 5 * time.Second
+)
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage once the peer closes the connection,
+// or once the connection is closed because the peer broke the protocol.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Conn is a server side WebSocket connection. ReadMessage must be called from
+// one goroutine at a time; writes may come from any goroutine.
+type Conn struct {
+	conn           net.Conn
+	reader         io.Reader
+	subprotocol    string
+	maxMessageSize int64
+
+	// messageMu is held while a message is written, from NextWriter
+	// until its writer is closed, so that data frames of different
+	// messages do not interleave. Control frames only take writeMu and
+	// may go between fragments.
+	messageMu sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+
+	closeErr *CloseError
+	// PongHandler, when set, is called with the payload of each pong.
+	PongHandler func(payload []byte)
+}
+
+type frame struct {
+	fin     bool
+	opcode  opcode
+	payload []byte
+}
+
+func newConn(conn net.Conn, reader io.Reader, subprotocol string, maxMessageSize int64) *Conn {
+	return &Conn{conn: conn, reader: reader, subprotocol: subprotocol, maxMessageSize: maxMessageSize}
+}
+
+// Subprotocol returns the negotiated subprotocol, or "" if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ReadMessage reads the next complete message, reassembling fragments. Pings
+// are answered and pongs handed to PongHandler in between. When the peer
+// closes the connection the close is echoed and a *CloseError returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.closeErr != nil {
+		return 0, nil, c.closeErr
+	}
+
+	var messageType MessageType
+	var message []byte
+	for {
+		f, err := c.readFrame(int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation without a message")
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new message before the previous one finished")
+			}
+			messageType = MessageType(f.opcode)
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayloadData, "invalid UTF-8 in text message")
+		}
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads and unmasks one frame. buffered is the size of the message
+// reassembled so far, used to enforce the message size limit.
+func (c *Conn) readFrame(buffered int64) (*frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, c.abnormal(err)
+	}
+
+	f := &frame{fin: header[0]&0x80 != 0, opcode: opcode(header[0] & 0x0f)}
+	if header[0]&0x70 != 0 {
+		return nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", f.opcode))
+	}
+	if header[1]&0x80 == 0 {
+		return nil, c.fail(CloseProtocolError, "client frame is not masked")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, c.abnormal(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, c.abnormal(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	control := f.opcode >= opClose
+	if control && (!f.fin || length > maxControlPayload) {
+		return nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	if !control && length > uint64(c.maxMessageSize-buffered) {
+		return nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return nil, c.abnormal(err)
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, c.abnormal(err)
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	code, reason := CloseNoStatusReceived, ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "truncated close code")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return c.fail(CloseInvalidPayloadData, "invalid UTF-8 in close reason")
+		}
+	}
+
+	// Echo the close unless we started the closing handshake ourselves.
+	echo := CloseNormalClosure
+	if code != CloseNoStatusReceived {
+		echo = code
+	}
+	c.writeClose(echo, "")
+	c.closeErr = &CloseError{Code: code, Reason: reason}
+	return c.closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the connection with code after a protocol violation.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.closeErr = &CloseError{Code: code, Reason: reason}
+	c.conn.Close()
+	return c.closeErr
+}
+
+func (c *Conn) abnormal(err error) error {
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+	c.closeErr = &CloseError{Code: CloseAbnormalClosure, Reason: err.Error()}
+	return c.closeErr
+}
+
+// WriteMessage sends data as a single frame.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	return c.writeFrame(opcode(messageType), data)
+}
+
+// NextWriter returns a writer for one message sent as a sequence of
+// fragments, one per Write call. Close sends the final fragment. Other
+// messages wait until the writer is closed, so it must be closed before
+// the same goroutine writes another.
+func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	return &messageWriter{c: c, opcode: opcode(messageType)}, nil
+}
+
+// Ping sends a ping; the peer's pong is passed to PongHandler by ReadMessage.
+func (c *Conn) Ping(payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return errors.New("websocket: ping payload too long")
+	}
+	return c.writeFrame(opPing, payload)
+}
+
+// Close starts the closing handshake, waits briefly for the peer's close
+// frame and closes the connection. It must not run concurrently with
+// ReadMessage; when ReadMessage already returned a CloseError it only closes
+// the connection.
+func (c *Conn) Close(code int, reason string) error {
+	if c.closeErr == nil {
+		if err := c.writeClose(code, reason); err != nil {
+			c.conn.Close()
+			return err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for c.closeErr == nil {
+			if _, _, err := c.ReadMessage(); err != nil {
+				break
+			}
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	return writeFrame(c.conn, true, opClose, payload)
+}
+
+func (c *Conn) writeFrame(op opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return writeFrame(c.conn, true, op, payload)
+}
+
+// writeFrame writes an unmasked frame, as servers must.
+func writeFrame(w io.Writer, fin bool, op opcode, payload []byte) error {
+	header := make([]byte, 2, 10+len(payload))
+	header[0] = byte(op)
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+type messageWriter struct {
+	c      *Conn
+	opcode opcode
+	closed bool
+}
+
+func (m *messageWriter) Write(p []byte) (int, error) {
+	if m.closed {
+		return 0, ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := m.writeFragment(false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *messageWriter) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	defer m.c.messageMu.Unlock()
+	return m.writeFragment(true, nil)
+}
+
+func (m *messageWriter) writeFragment(fin bool, p []byte) error {
+	m.c.writeMu.Lock()
+	defer m.c.writeMu.Unlock()
+	if m.c.closeSent {
+		return ErrClosed
+	}
+	err := writeFrame(m.c.conn, fin, m.opcode, p)
+	m.opcode = opContinuation
+	return err
+}
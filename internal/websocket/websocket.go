@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pderyuga/httpfromtcp/internal/headers"
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+)
+
+// acceptGUID is appended to Sec-WebSocket-Key before hashing (RFC 6455
+// section 4.2.2).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const defaultMaxMessageSize = 1 << 20
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+type Options struct {
+	// Subprotocols lists the supported subprotocols in order of preference.
+	Subprotocols []string
+	// CheckOrigin rejects the handshake with 403 when it returns false. All
+	// origins are accepted when nil.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize limits a reassembled message, 1 MiB by default. Larger
+	// messages close the connection with CloseMessageTooBig.
+	MaxMessageSize int64
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether req asks for a WebSocket upgrade.
+func IsUpgrade(req *request.Request) bool {
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	return hasToken(upgrade, "websocket") && hasToken(connection, "upgrade")
+}
+
+// Upgrade validates the opening handshake in req, answers it with 101
+// Switching Protocols and takes over the connection. A rejected handshake
+// is answered with an error response and ErrBadHandshake. The connection
+// is hijacked, so the Conn may outlive the handler and must be closed by
+// the caller.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	if req.RequestLine.Method != "GET" || req.RequestLine.HttpVersion != "1.1" || !IsUpgrade(req) {
+		return nil, reject(w, response.StatusBadrequest, nil, "not a websocket handshake")
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); strings.TrimSpace(version) != "13" {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Version", "13")
+		return nil, reject(w, response.StatusUpgradeRequired, h, "unsupported websocket version")
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, reject(w, response.StatusBadrequest, nil, "invalid Sec-WebSocket-Key")
+	}
+	if opts.CheckOrigin != nil && !opts.CheckOrigin(req) {
+		return nil, reject(w, response.StatusForbidden, nil, "origin not allowed")
+	}
+
+	if w.Hijacker == nil {
+		return nil, reject(w, response.StatusBadrequest, nil, response.ErrNotHijackable.Error())
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	subprotocol := negotiateSubprotocol(req, opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), netConn))
+	return newConn(netConn, reader, subprotocol, opts.MaxMessageSize), nil
+}
+
+func reject(w *response.Writer, statusCode response.StatusCode, h headers.Headers, reason string) error {
+	body := []byte(reason)
+	defaults := response.GetDefaultHeaders(len(body))
+	defaults.Override("Content-Type", "text/plain")
+	for name, value := range h {
+		defaults.Override(name, value)
+	}
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(defaults)
+	w.WriteBody(body)
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+func negotiateSubprotocol(req *request.Request, supported []string) string {
+	requested, _ := req.Headers.Get("Sec-WebSocket-Protocol")
+	for _, protocol := range supported {
+		for _, offered := range strings.Split(requested, ",") {
+			if strings.TrimSpace(offered) == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
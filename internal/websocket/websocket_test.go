@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pderyuga/httpfromtcp/internal/request"
+	"github.com/pderyuga/httpfromtcp/internal/response"
+	"github.com/pderyuga/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// echoServer echoes every message until the client closes.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	handler := func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, Options{Subprotocols: []string{"chat"}, MaxMessageSize: 64})
+		if err != nil {
+			return
+		}
+		defer conn.Close(CloseNormalClosure, "")
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(message) == "fragmented" {
+				writer, _ := conn.NextWriter(messageType)
+				io.WriteString(writer, "frag")
+				io.WriteString(writer, "mented")
+				writer.Close()
+				continue
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dial(t *testing.T, addr string, extra string) (*testClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\n%s\r\n", extra)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	return &testClient{t: t, conn: conn, br: br}, resp
+}
+
+func upgradeHeaders(protocols string) string {
+	return "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\nSec-WebSocket-Protocol: " + protocols + "\r\n"
+}
+
+func (c *testClient) send(fin bool, op opcode, payload []byte) {
+	c.t.Helper()
+	header := []byte{byte(op), 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		header[1] |= byte(len(payload))
+	default:
+		header[1] |= 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	_, err := c.conn.Write(append(append(header, mask...), masked...))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) receive() (bool, opcode, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	require.NoError(c.t, err)
+	require.Zero(c.t, header[1]&0x80, "server frames are not masked")
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return header[0]&0x80 != 0, opcode(header[0] & 0x0f), payload
+}
+
+func (c *testClient) expectClose(code int) {
+	c.t.Helper()
+	_, op, payload := c.receive()
+	require.Equal(c.t, opClose, op)
+	assert.Equal(c.t, code, int(binary.BigEndian.Uint16(payload)))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: RFC 6455 section 1.3 example
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+}
+
+func TestHandshake(t *testing.T) {
+	addr := echoServer(t)
+
+	// Test: Successful upgrade with subprotocol negotiation
+	_, resp := dial(t, addr, upgradeHeaders("superchat, chat"))
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// Test: Unsupported version
+	_, resp = dial(t, addr, strings.Replace(upgradeHeaders("chat"), "Version: 13", "Version: 8", 1))
+	assert.Equal(t, 426, resp.StatusCode)
+	assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+
+	// Test: Missing key
+	_, resp = dial(t, addr, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: Not an upgrade
+	_, resp = dial(t, addr, "")
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestMessages(t *testing.T) {
+	addr := echoServer(t)
+	c, resp := dial(t, addr, upgradeHeaders("chat"))
+	require.Equal(t, 101, resp.StatusCode)
+
+	// Test: Text echo
+	c.send(true, opText, []byte("hello"))
+	fin, op, payload := c.receive()
+	assert.True(t, fin)
+	assert.Equal(t, opText, op)
+	assert.Equal(t, "hello", string(payload))
+
+	// Test: Fragmented message with a ping in between
+	c.send(false, opBinary, []byte("ab"))
+	c.send(true, opPing, []byte("p"))
+	c.send(true, opContinuation, []byte("cd"))
+	_, op, payload = c.receive()
+	assert.Equal(t, opPong, op)
+	assert.Equal(t, "p", string(payload))
+	_, op, payload = c.receive()
+	assert.Equal(t, opBinary, op)
+	assert.Equal(t, "abcd", string(payload))
+
+	// Test: Fragmented write
+	c.send(true, opText, []byte("fragmented"))
+	fin, op, payload = c.receive()
+	assert.Equal(t, []any{false, opText, "frag"}, []any{fin, op, string(payload)})
+	fin, op, payload = c.receive()
+	assert.Equal(t, []any{false, opContinuation, "mented"}, []any{fin, op, string(payload)})
+	fin, op, _ = c.receive()
+	assert.Equal(t, []any{true, opContinuation}, []any{fin, op})
+
+	// Test: Close handshake is echoed
+	c.send(true, opClose, binary.BigEndian.AppendUint16(nil, CloseGoingAway))
+	c.expectClose(CloseGoingAway)
+	_, err := c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	server, client := net.Pipe()
+	var received bytes.Buffer
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(&received, client)
+		close(drained)
+	}()
+	c := &Conn{conn: server, reader: server}
+
+	// Test: A message waits for the open writer
+	writer, err := c.NextWriter(TextMessage)
+	require.NoError(t, err)
+	io.WriteString(writer, "frag")
+	done := make(chan error)
+	go func() {
+		done <- c.WriteMessage(TextMessage, []byte("other"))
+	}()
+	select {
+	case <-done:
+		t.Fatal("WriteMessage went between fragments")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: Control frames may go between fragments
+	require.NoError(t, c.Ping([]byte("p")))
+	io.WriteString(writer, "mented")
+	require.NoError(t, writer.Close())
+	require.NoError(t, <-done)
+	server.Close()
+	<-drained
+
+	tc := &testClient{t: t, br: bufio.NewReader(&received)}
+	var frames []string
+	for range 5 {
+		fin, op, payload := tc.receive()
+		frames = append(frames, fmt.Sprintf("%v %d %s", fin, op, payload))
+	}
+	assert.Equal(t, []string{"false 1 frag", "true 9 p", "false 0 mented", "true 0 ", "true 1 other"}, frames)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr := echoServer(t)
+	tests := []struct {
+		name string
+		send func(c *testClient)
+		code int
+	}{
+		{"invalid UTF-8", func(c *testClient) { c.send(true, opText, []byte{0xff, 0xfe}) }, CloseInvalidPayloadData},
+		{"message too big", func(c *testClient) { c.send(true, opBinary, make([]byte, 65)) }, CloseMessageTooBig},
+		{"fragments too big", func(c *testClient) {
+			c.send(false, opBinary, make([]byte, 40))
+			c.send(true, opContinuation, make([]byte, 40))
+		}, CloseMessageTooBig},
+		{"fragmented ping", func(c *testClient) { c.send(false, opPing, nil) }, CloseProtocolError},
+		{"orphan continuation", func(c *testClient) { c.send(true, opContinuation, []byte("x")) }, CloseProtocolError},
+		{"unknown opcode", func(c *testClient) { c.send(true, 0x3, nil) }, CloseProtocolError},
+		{"unmasked frame", func(c *testClient) { c.conn.Write([]byte{0x81, 0x01, 'x'}) }, CloseProtocolError},
+		{"invalid close code", func(c *testClient) { c.send(true, opClose, binary.BigEndian.AppendUint16(nil, 1005)) }, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		// Test: Protocol violations close the connection with a status code
+		t.Run(tt.name, func(t *testing.T) {
+			c, resp := dial(t, addr, upgradeHeaders("chat"))
+			require.Equal(t, 101, resp.StatusCode)
+			tt.send(c)
+			c.expectClose(tt.code)
+		})
+	}
+}
+
+func TestFrameWithHandshake(t *testing.T) {
+	addr := echoServer(t)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: A frame sent right behind the handshake is not lost
+	frame := []byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2}
+	_, err = conn.Write(append([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\n"+upgradeHeaders("chat")+"\r\n"), frame...))
+	require.NoError(t, err)
+
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.br, nil)
+	require.NoError(t, err)
+	require.Equal(t, 101, resp.StatusCode)
+	_, op, payload := c.receive()
+	assert.Equal(t, opText, op)
+	assert.Equal(t, "hi", string(payload))
+}